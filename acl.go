@@ -0,0 +1,193 @@
+package kv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Permission is a set of operations a client can do on keys
+type Permission uint8
+
+const (
+	// Read keys (kget, kget-bulk, kget-all and reads in transactions)
+	PermRead Permission = 1 << iota
+
+	// Write and delete keys (kset, kset-bulk, kcas, kdel and writes in transactions)
+	PermWrite
+
+	// Subscribe to keys and receive pushes for them (ksub, ksub-prefix)
+	PermSubscribe
+
+	// List keys (klist)
+	PermList
+
+	// Every permission
+	PermAll = PermRead | PermWrite | PermSubscribe | PermList
+)
+
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{PermRead, "read"},
+	{PermWrite, "write"},
+	{PermSubscribe, "subscribe"},
+	{PermList, "list"},
+}
+
+func (p Permission) String() string {
+	var names []string
+	for _, permission := range permissionNames {
+		if p&permission.perm != 0 {
+			names = append(names, permission.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParsePermission parses a comma-separated list of permission names (read, write, subscribe, list, all or none)
+func ParsePermission(str string) (Permission, error) {
+	var result Permission
+	for _, name := range strings.Split(str, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "none":
+			continue
+		case "all":
+			result |= PermAll
+			continue
+		}
+		found := false
+		for _, permission := range permissionNames {
+			if permission.name == name {
+				result |= permission.perm
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown permission \"%s\"", name)
+		}
+	}
+	return result, nil
+}
+
+func (p Permission) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Permission) UnmarshalText(text []byte) error {
+	perm, err := ParsePermission(string(text))
+	if err != nil {
+		return err
+	}
+	*p = perm
+	return nil
+}
+
+// ACLRule grants permissions on every key matching a pattern
+type ACLRule struct {
+	// Keys the rule applies to, relative to the client's namespace. A * matches any
+	// sequence of characters, so "overlay/*" matches every key starting with "overlay/".
+	Pattern string `json:"pattern"`
+
+	Permissions Permission `json:"permissions"`
+}
+
+// ACL is a list of rules deciding what a client can do. Permissions are only granted by
+// rules, so a key that matches no rule can't be accessed at all.
+//
+// A nil ACL grants every permission on every key.
+type ACL []ACLRule
+
+// Allows returns true if the ACL grants a permission on a key
+func (a ACL) Allows(key string, perm Permission) bool {
+	if a == nil {
+		return true
+	}
+	var granted Permission
+	for _, rule := range a {
+		if globMatch(rule.Pattern, key, false) {
+			granted |= rule.Permissions
+		}
+	}
+	return granted&perm == perm
+}
+
+// AllowsPrefix returns true if the ACL might grant a permission on some key starting with
+// prefix. Results of prefix operations still need to be checked key by key.
+func (a ACL) AllowsPrefix(prefix string, perm Permission) bool {
+	if a == nil {
+		return true
+	}
+	for _, rule := range a {
+		if rule.Permissions&perm == perm && globMatch(rule.Pattern, prefix, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches a string against a pattern where * matches any sequence of characters.
+// If partial is set, it also matches strings that are a prefix of a matching string.
+func globMatch(pattern string, str string, partial bool) bool {
+	// Position of the last * seen and of the string when we met it, for backtracking
+	star, starStr := -1, 0
+	p, s := 0, 0
+	for s < len(str) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, starStr = p, s
+			p++
+		case p < len(pattern) && pattern[p] == str[s]:
+			p++
+			s++
+		case star >= 0:
+			// Let the last * eat one more character
+			starStr++
+			p, s = star+1, starStr
+		default:
+			return false
+		}
+	}
+	if partial {
+		// Whatever is left of the pattern can be matched by the rest of the key
+		return true
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// SetACL replaces a client's ACL, e.g. after a custom authentication.
+// The ACL is kept if the client logs out.
+func (hub *Hub) SetACL(id int64, acl ACL) error {
+	return hub.clients.SetACL(id, acl)
+}
+
+// requirePermission checks that a client has a permission on every given key
+// (relative to its namespace), sending an error to the client if it doesn't
+func requirePermission(h *Hub, client Client, msg Request, perm Permission, keys ...string) bool {
+	acl := h.clientOptions(client).ACL
+	for _, key := range keys {
+		if !acl.Allows(key, perm) {
+			sendErr(h, client, msg, ErrPermissionDenied, fmt.Sprintf("%s permission required for key \"%s\"", perm, key))
+			return false
+		}
+	}
+	return true
+}
+
+// requirePrefixPermission checks that a client might have a permission on keys starting
+// with prefix (relative to its namespace), sending an error to the client if it can't
+func requirePrefixPermission(h *Hub, client Client, msg Request, perm Permission, prefix string) bool {
+	if !h.clientOptions(client).ACL.AllowsPrefix(prefix, perm) {
+		sendErr(h, client, msg, ErrPermissionDenied, fmt.Sprintf("%s permission required for prefix \"%s\"", perm, prefix))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package kv
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		partial bool
+		match   bool
+	}{
+		{"overlay/*", "overlay/title", false, true},
+		{"overlay/*", "overlay/", false, true},
+		{"overlay/*", "overlay", false, false},
+		{"overlay/*", "overlay", true, true},
+		{"*/title", "overlay/title", false, true},
+		{"*/title", "overlay/titles", false, false},
+		{"a*b*c", "aXbYbZc", false, true},
+		{"a*b*c", "aXbYbZ", false, false},
+		{"a*b*c", "aXbYbZ", true, true},
+		{"exact", "exact", false, true},
+		{"exact", "exac", true, true},
+		{"exact", "exactly", true, false},
+		{"*", "", false, true},
+		{"", "", false, true},
+		{"", "x", true, false},
+	}
+	for _, test := range tests {
+		if got := globMatch(test.pattern, test.str, test.partial); got != test.match {
+			t.Errorf("globMatch(%q, %q, %v): expected %v, got %v", test.pattern, test.str, test.partial, test.match, got)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl := ACL{
+		{Pattern: "public/*", Permissions: PermRead | PermSubscribe | PermList},
+		{Pattern: "public/mine", Permissions: PermWrite},
+	}
+	if !acl.Allows("public/mine", PermRead|PermWrite) {
+		t.Error("permissions from multiple rules should add up")
+	}
+	if acl.Allows("public/other", PermWrite) {
+		t.Error("write permission granted on a read-only key")
+	}
+	if acl.Allows("private/key", PermRead) {
+		t.Error("permission granted on a key matching no rule")
+	}
+	if !acl.AllowsPrefix("pub", PermSubscribe) || acl.AllowsPrefix("priv", PermSubscribe) {
+		t.Error("prefix permissions don't match the rules")
+	}
+	if !ACL(nil).Allows("anything", PermAll) {
+		t.Error("nil ACL should allow everything")
+	}
+	if (ACL{}).Allows("anything", PermRead) {
+		t.Error("empty ACL should allow nothing")
+	}
+}
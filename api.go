@@ -0,0 +1,61 @@
+package kv
+
+// These let Go code embedding the hub read and write keys directly. Keys are not namespaced,
+// and writes are ordered with the ones made by clients and notify subscribers like them.
+// They're safe to call from any goroutine, and don't need the hub to be running.
+
+// Get returns the value of a key, or ErrorKeyNotFound if it doesn't exist
+func (hub *Hub) Get(key string) (string, error) {
+	return hub.db.Get(key)
+}
+
+// Set writes a key and notifies its subscribers
+func (hub *Hub) Set(key string, value string) error {
+	unlock := hub.locks.Lock(key)
+	defer unlock()
+
+	changes := hub.recordChanges(nil, "")
+	changes.before(key)
+	if err := hub.writeKey(key, value, 0); err != nil {
+		return err
+	}
+	changes.set(key, value)
+	hub.subscriptions.KeyChanged(key, value, PushEventSet)
+	return nil
+}
+
+// SetBulk writes several keys at once and notifies their subscribers
+func (hub *Hub) SetBulk(kvs map[string]string) error {
+	keys := make([]string, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	unlock := hub.locks.Lock(keys...)
+	defer unlock()
+
+	changes := hub.recordChanges(nil, "")
+	changes.before(keys...)
+	if err := hub.writeBulk(kvs); err != nil {
+		return err
+	}
+	for key, value := range kvs {
+		changes.set(key, value)
+		hub.subscriptions.KeyChanged(key, value, PushEventSet)
+	}
+	return nil
+}
+
+// Delete removes a key and notifies its subscribers
+func (hub *Hub) Delete(key string) error {
+	unlock := hub.locks.Lock(key)
+	defer unlock()
+
+	changes := hub.recordChanges(nil, "")
+	changes.before(key)
+	if err := hub.removeKey(key); err != nil {
+		return err
+	}
+	changes.remove(key)
+	hub.subscriptions.KeyChanged(key, "", PushEventDelete)
+	return nil
+}
@@ -0,0 +1,322 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AuditEvent describes a change made to a key by a client
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+
+	// Command that made the change, like "kset"
+	Command string `json:"command"`
+
+	// Client that sent the command
+	Client int64  `json:"client"`
+	Addr   string `json:"addr,omitempty"`
+
+	// User (or token, as "token:<id>") the client authenticated as, if any
+	User string `json:"user,omitempty"`
+
+	Namespace string `json:"namespace,omitempty"`
+
+	// Key that was changed, relative to the namespace
+	Key string `json:"key"`
+
+	// Whether the key was deleted
+	Deleted bool `json:"deleted,omitempty"`
+
+	// Size of the value before and after the change, -1 if the key didn't exist before or after
+	OldSize int `json:"old_size"`
+	NewSize int `json:"new_size"`
+
+	// Values before and after the change
+	OldValue string `json:"old_value,omitempty"`
+	NewValue string `json:"new_value,omitempty"`
+}
+
+// AuditSink receives an event for every key changed by a client command (expired keys are not
+// reported). It's called while the key is locked, so it should be quick.
+type AuditSink interface {
+	Audit(event AuditEvent) error
+}
+
+// changeRecord collects the changes made by a single command (or Hub method) for the
+// audit sink and watchers
+type changeRecord struct {
+	hub    *Hub
+	client Client
+
+	// Set if changes are audited, only changes made by clients are
+	audit bool
+	event AuditEvent
+
+	// Values of keys before the command, nil if the key didn't exist
+	old map[string]*string
+}
+
+// recordChanges starts recording the changes made for a client (nil for changes made by
+// the hub itself), it returns nil (which records nothing) if nobody would get them
+func (hub *Hub) recordChanges(client Client, command string) *changeRecord {
+	audit := hub.options.Audit != nil && client != nil
+	if !audit && !hub.watchers.any() {
+		return nil
+	}
+	record := &changeRecord{
+		hub:    hub,
+		client: client,
+		audit:  audit,
+		old:    make(map[string]*string),
+	}
+	if audit {
+		record.event = AuditEvent{
+			Command:   command,
+			Client:    client.UID(),
+			Namespace: hub.clientOptions(client).Namespace,
+		}
+		if addr, ok := client.(remoteAddresser); ok {
+			record.event.Addr = addr.RemoteAddr()
+		}
+		record.event.User, _ = hub.clients.User(client.UID())
+	}
+	return record
+}
+
+// before saves the values of keys before they change. The keys must be locked.
+func (r *changeRecord) before(keys ...string) {
+	if r == nil {
+		return
+	}
+	for _, key := range keys {
+		if _, ok := r.old[key]; ok {
+			continue
+		}
+		// Don't bother reading keys nobody cares about
+		if !r.audit && !r.hub.watchers.matches(key) {
+			continue
+		}
+		value, err := r.hub.db.Get(key)
+		switch {
+		case err == nil:
+			r.old[key] = &value
+		case errors.Is(err, ErrorKeyNotFound):
+			r.old[key] = nil
+		default:
+			r.hub.logger.Error("could not read previous value of key", zap.String("key", key), zap.Error(err))
+			r.old[key] = nil
+		}
+	}
+}
+
+// set reports a key that was written
+func (r *changeRecord) set(key string, value string) {
+	r.changed(key, &value, PushEventSet)
+}
+
+// remove reports a key that was deleted
+func (r *changeRecord) remove(key string) {
+	r.changed(key, nil, PushEventDelete)
+}
+
+// expire reports a key that expired
+func (r *changeRecord) expire(key string) {
+	r.changed(key, nil, PushEventExpire)
+}
+
+func (r *changeRecord) changed(key string, value *string, event PushEvent) {
+	if r == nil {
+		return
+	}
+	old := r.old[key]
+	if r.audit {
+		r.auditChange(key, old, value)
+	}
+
+	change := Change{
+		Key:    key,
+		Event:  event,
+		Client: r.client,
+	}
+	if old != nil {
+		change.OldValue = *old
+		change.OldExists = true
+	}
+	if value != nil {
+		change.NewValue = *value
+	}
+	r.hub.watchers.notify(change)
+}
+
+func (r *changeRecord) auditChange(key string, old *string, value *string) {
+	event := r.event
+	event.Time = time.Now()
+	event.Key = strings.TrimPrefix(key, event.Namespace)
+	event.OldSize, event.NewSize = -1, -1
+	if old != nil {
+		event.OldValue = *old
+		event.OldSize = len(*old)
+	}
+	if value != nil {
+		event.NewValue = *value
+		event.NewSize = len(*value)
+	} else {
+		event.Deleted = true
+	}
+	if err := r.hub.options.Audit.Audit(event); err != nil {
+		r.hub.logger.Error("could not write audit event", zap.String("key", key), zap.Error(err))
+	}
+}
+
+const (
+	defaultAuditMaxSize  = 10 * 1024 * 1024
+	defaultAuditMaxFiles = 5
+)
+
+type FileAuditSinkOptions struct {
+	// The file is rotated when it gets bigger than this (defaults to 10 MiB)
+	MaxSize int64
+
+	// Number of rotated files to keep (named <path>.1, <path>.2 and so on, from the newest),
+	// defaults to 5
+	MaxFiles int
+
+	// Leave values out of events, only keeping their size
+	RedactValues bool
+}
+
+// FileAuditSink is an AuditSink that writes events to a file, one JSON object per line
+type FileAuditSink struct {
+	path    string
+	options FileAuditSinkOptions
+
+	file   *os.File
+	size   int64
+	closed bool
+	mu     sync.Mutex
+}
+
+// OpenFileAuditSink opens (or creates) a file to append audit events to
+func OpenFileAuditSink(path string, options FileAuditSinkOptions) (*FileAuditSink, error) {
+	if options.MaxSize <= 0 {
+		options.MaxSize = defaultAuditMaxSize
+	}
+	if options.MaxFiles <= 0 {
+		options.MaxFiles = defaultAuditMaxFiles
+	}
+	sink := &FileAuditSink{
+		path:    path,
+		options: options,
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *FileAuditSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileAuditSink) Audit(event AuditEvent) error {
+	if s.options.RedactValues {
+		event.OldValue, event.NewValue = "", ""
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	// A previous rotation might have failed to open the new file, try again
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	var rotateErr error
+	if s.size > 0 && s.size+int64(len(line)) > s.options.MaxSize {
+		rotateErr = s.rotate()
+		if s.file == nil {
+			return rotateErr
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if rotateErr != nil {
+		// The event was still written, to the file that couldn't be rotated
+		return fmt.Errorf("audit log not rotated: %w", rotateErr)
+	}
+	return nil
+}
+
+// rotate renames the current file to <path>.1 (shifting older files) and starts a new one.
+// If that fails, the current file is opened again so events are not lost.
+// Must be called with mu held.
+func (s *FileAuditSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err == nil {
+		err = s.shift()
+	}
+
+	// Either the old file (if it couldn't be moved) or a new one
+	if openErr := s.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// shift renames the current file to <path>.1, shifting older files and removing the oldest one
+func (s *FileAuditSink) shift() error {
+	_ = os.Remove(fmt.Sprintf("%s.%d", s.path, s.options.MaxFiles))
+	for i := s.options.MaxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(s.path, s.path+".1")
+}
+
+// Close closes the file, events sent after closing are discarded with an error
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,204 @@
+package kv
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+type auditEvents struct {
+	events []AuditEvent
+	mu     sync.Mutex
+}
+
+func (a *auditEvents) Audit(event AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, event)
+	return nil
+}
+
+func (a *auditEvents) take() []AuditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	events := a.events
+	a.events = nil
+	return events
+}
+
+func TestAuditCommands(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub := createInMemoryHub(t, log)
+	audit := &auditEvents{}
+	hub.SetOptions(HubOptions{Audit: audit})
+	makeHubClientWith(t, hub, log, func(hub *Hub, client *LocalClient) {
+		send := func(cmd string, data map[string]interface{}) {
+			req, chn := client.MakeRequest(cmd, data)
+			hub.SendMessage(req)
+			mustSucceed(t, waitReply(t, chn))
+		}
+
+		send(CmdWriteKey, map[string]interface{}{"key": "audit", "data": "first"})
+		send(CmdWriteKey, map[string]interface{}{"key": "audit", "data": "second!"})
+		send(CmdRemoveKey, map[string]interface{}{"key": "audit"})
+		events := audit.take()
+		if len(events) != 3 {
+			t.Fatalf("expected 3 events, got %d: %+v", len(events), events)
+		}
+		expected := []struct {
+			command  string
+			old, new int
+			deleted  bool
+		}{
+			{CmdWriteKey, -1, 5, false},
+			{CmdWriteKey, 5, 7, false},
+			{CmdRemoveKey, 7, -1, true},
+		}
+		for index, event := range events {
+			want := expected[index]
+			if event.Command != want.command || event.Key != "audit" || event.OldSize != want.old || event.NewSize != want.new || event.Deleted != want.deleted {
+				t.Errorf("unexpected event #%d: %+v", index, event)
+			}
+			if event.Client != client.UID() || event.Time.IsZero() {
+				t.Errorf("event #%d is missing client or time: %+v", index, event)
+			}
+		}
+		if events[1].OldValue != "first" || events[1].NewValue != "second!" {
+			t.Errorf("wrong values in event: %+v", events[1])
+		}
+
+		// Reads and failed writes are not audited
+		req, chn := client.MakeRequest(CmdReadKey, map[string]interface{}{"key": "audit"})
+		hub.SendMessage(req)
+		waitReply(t, chn)
+		req, chn = client.MakeRequest(CmdTransaction, map[string]interface{}{
+			"ops": []interface{}{
+				map[string]interface{}{"op": "compare", "key": "audit", "exists": true},
+				map[string]interface{}{"op": "set", "key": "audit", "data": "nope"},
+			},
+		})
+		hub.SendMessage(req)
+		mustFail(t, waitReply(t, chn))
+		if events := audit.take(); len(events) != 0 {
+			t.Fatalf("unexpected events: %+v", events)
+		}
+
+		// Transactions report the final state of every key they changed
+		send(CmdTransaction, map[string]interface{}{
+			"ops": []interface{}{
+				map[string]interface{}{"op": "set", "key": "tx-a", "data": "1"},
+				map[string]interface{}{"op": "set", "key": "tx-a", "data": "22"},
+				map[string]interface{}{"op": "delete", "key": "tx-b"},
+			},
+		})
+		events = audit.take()
+		if len(events) != 2 {
+			t.Fatalf("expected 2 events, got %d: %+v", len(events), events)
+		}
+		if events[0].Key != "tx-a" || events[0].NewValue != "22" || events[0].Command != CmdTransaction {
+			t.Errorf("unexpected event: %+v", events[0])
+		}
+		if events[1].Key != "tx-b" || !events[1].Deleted {
+			t.Errorf("unexpected event: %+v", events[1])
+		}
+	})
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := OpenFileAuditSink(path, FileAuditSinkOptions{MaxSize: 200, MaxFiles: 2, RedactValues: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	for i := 0; i < 10; i++ {
+		err := sink.Audit(AuditEvent{Command: CmdWriteKey, Key: "key", OldSize: -1, NewSize: 6, NewValue: "secret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the current file and two rotated ones are kept
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := file.Stat()
+		if info.Size() > 200 {
+			t.Errorf("%s is over the size limit (%d bytes)", name, info.Size())
+		}
+		lines := 0
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event AuditEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				t.Fatalf("invalid line in %s: %s", name, err)
+			}
+			if event.NewValue != "" || event.NewSize != 6 {
+				t.Errorf("value not redacted: %+v", event)
+			}
+			lines++
+		}
+		file.Close()
+		if lines == 0 {
+			t.Errorf("%s is empty", name)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("too many rotated files kept")
+	}
+
+	sink.Close()
+	if err := sink.Audit(AuditEvent{}); err == nil {
+		t.Fatal("wrote to a closed sink")
+	}
+}
+
+func TestFileAuditSinkFailedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := OpenFileAuditSink(path, FileAuditSinkOptions{MaxSize: 200, MaxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// The current file can't be renamed over a directory that isn't empty
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	failures := 0
+	for i := 0; i < 10; i++ {
+		if err := sink.Audit(AuditEvent{Command: CmdWriteKey, Key: "key", OldSize: -1, NewSize: 5}); err != nil {
+			failures++
+		}
+	}
+	if failures == 0 {
+		t.Fatal("rotation should have failed")
+	}
+
+	// Rotation works again once the problem is gone, and no event was lost
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Audit(AuditEvent{Command: CmdWriteKey, Key: "key", OldSize: -1, NewSize: 5}); err != nil {
+		t.Fatalf("rotation still failing: %s", err)
+	}
+	lines := 0
+	for _, name := range []string{path, path + ".1"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += strings.Count(string(data), "\n")
+	}
+	if lines != 11 {
+		t.Fatalf("expected 11 events, found %d", lines)
+	}
+}
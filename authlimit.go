@@ -0,0 +1,151 @@
+package kv
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultChallengeTimeout = time.Minute
+	defaultAuthMaxFailures  = 3
+	defaultAuthLockout      = time.Second
+	defaultAuthMaxLockout   = 5 * time.Minute
+)
+
+// authFailures keeps track of failed authentications from a client or address
+type authFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// authLimiter locks out clients and addresses after too many failed authentications.
+// After maxFailures failures every new one locks them out for twice as long as the
+// previous one, starting from lockout and up to maxLockout.
+type authLimiter struct {
+	failures  map[string]*authFailures
+	lastPrune time.Time
+	mu        sync.Mutex
+}
+
+func newAuthLimiter() *authLimiter {
+	return &authLimiter{
+		failures: make(map[string]*authFailures),
+	}
+}
+
+// authKeys returns the keys failures of a client are tracked with, one for the client
+// itself and one for its address (if it has one)
+func authKeys(client Client) []string {
+	keys := []string{"client:" + strconv.FormatInt(client.UID(), 10)}
+	if addr, ok := client.(remoteAddresser); ok {
+		host, _, err := net.SplitHostPort(addr.RemoteAddr())
+		if err != nil {
+			host = addr.RemoteAddr()
+		}
+		if host != "" {
+			keys = append(keys, "addr:"+host)
+		}
+	}
+	return keys
+}
+
+// lockedFor returns how long a client has to wait before trying to authenticate again
+func (l *authLimiter) lockedFor(client Client, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range authKeys(client) {
+		if failures, ok := l.failures[key]; ok && now.Before(failures.lockedUntil) {
+			if remaining := failures.lockedUntil.Sub(now); remaining > wait {
+				wait = remaining
+			}
+		}
+	}
+	return wait
+}
+
+// fail records a failed authentication, returning how long the client is now locked out for
+func (l *authLimiter) fail(client Client, options HubOptions, now time.Time) time.Duration {
+	maxFailures, lockout, maxLockout := options.authLimits()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now, maxLockout)
+
+	var wait time.Duration
+	for _, key := range authKeys(client) {
+		failures, ok := l.failures[key]
+		if !ok {
+			failures = &authFailures{}
+			l.failures[key] = failures
+		}
+		failures.count++
+		failures.last = now
+		if failures.count <= maxFailures {
+			continue
+		}
+
+		duration := lockout
+		for i := maxFailures + 1; i < failures.count && duration < maxLockout; i++ {
+			duration *= 2
+		}
+		if duration > maxLockout {
+			duration = maxLockout
+		}
+		failures.lockedUntil = now.Add(duration)
+		if duration > wait {
+			wait = duration
+		}
+	}
+	return wait
+}
+
+// succeed forgets the failures of a client and its address
+func (l *authLimiter) succeed(client Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range authKeys(client) {
+		delete(l.failures, key)
+	}
+}
+
+// prune forgets failures that are old enough not to matter anymore. Must be called with mu held.
+func (l *authLimiter) prune(now time.Time, maxLockout time.Duration) {
+	if now.Sub(l.lastPrune) < maxLockout {
+		return
+	}
+	l.lastPrune = now
+	for key, failures := range l.failures {
+		if now.Sub(failures.last) > maxLockout && !now.Before(failures.lockedUntil) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// authLimits returns the lockout options, with defaults for the ones not set
+func (options HubOptions) authLimits() (maxFailures int, lockout time.Duration, maxLockout time.Duration) {
+	maxFailures, lockout, maxLockout = options.AuthMaxFailures, options.AuthLockout, options.AuthMaxLockout
+	if maxFailures <= 0 {
+		maxFailures = defaultAuthMaxFailures
+	}
+	if lockout <= 0 {
+		lockout = defaultAuthLockout
+	}
+	if maxLockout <= 0 {
+		maxLockout = defaultAuthMaxLockout
+	}
+	if maxLockout < lockout {
+		maxLockout = lockout
+	}
+	return
+}
+
+func (options HubOptions) challengeTimeout() time.Duration {
+	if options.ChallengeTimeout <= 0 {
+		return defaultChallengeTimeout
+	}
+	return options.ChallengeTimeout
+}
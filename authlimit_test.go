@@ -0,0 +1,52 @@
+package kv
+
+import (
+	"testing"
+	"time"
+)
+
+type addrClient struct {
+	*LocalClient
+	addr string
+}
+
+func (c addrClient) RemoteAddr() string {
+	return c.addr
+}
+
+func TestAuthLimiter(t *testing.T) {
+	limiter := newAuthLimiter()
+	options := HubOptions{AuthMaxFailures: 2, AuthLockout: time.Second, AuthMaxLockout: 4 * time.Second}
+	now := time.Now()
+
+	client := addrClient{NewLocalClient(ClientOptions{}, nil), "10.0.0.1:1234"}
+	client.SetUID(1)
+
+	// Lockouts start after AuthMaxFailures and double up to AuthMaxLockout
+	for i, expected := range []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if lockout := limiter.fail(client, options, now); lockout != expected {
+			t.Fatalf("failure #%d: expected a %s lockout, got %s", i+1, expected, lockout)
+		}
+	}
+	if wait := limiter.lockedFor(client, now.Add(time.Second)); wait != 3*time.Second {
+		t.Fatalf("expected to wait 3s, got %s", wait)
+	}
+
+	// Same address, different client
+	other := addrClient{NewLocalClient(ClientOptions{}, nil), "10.0.0.1:5678"}
+	other.SetUID(2)
+	if limiter.lockedFor(other, now) == 0 {
+		t.Fatal("address should be locked out for every client")
+	}
+
+	// Different address
+	other.addr = "10.0.0.2:5678"
+	if limiter.lockedFor(other, now) != 0 {
+		t.Fatal("unrelated client is locked out")
+	}
+
+	limiter.succeed(client)
+	if limiter.lockedFor(client, now) != 0 {
+		t.Fatal("client still locked out after authenticating")
+	}
+}
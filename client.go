@@ -12,8 +12,30 @@ type Client interface {
 	UID() int64
 }
 
+// pushSender is implemented by clients that want to know which key a push is
+// about, e.g. to coalesce pushes for the same key
+type pushSender interface {
+	SendPush(key string, data []byte)
+}
+
+// remoteAddresser is implemented by clients connected over the network, so
+// failed authentications can be tracked per address
+type remoteAddresser interface {
+	RemoteAddr() string
+}
+
 // ClientOptions is a list of tunable options for clients
 type ClientOptions struct {
 	// Adds a prefix to all key operations to restrict them to a namespace
 	Namespace string
+
+	// Maximum number of messages waiting to be sent to the client (defaults to 256)
+	QueueSize int
+
+	// What to do when the client doesn't read messages fast enough and its queue is full (defaults to SlowClientDropOldest)
+	SlowClientPolicy SlowClientPolicy
+
+	// Restricts what the client can do, nil grants every permission on every key.
+	// Can be replaced after connecting with Hub.SetACL.
+	ACL ACL
 }
@@ -0,0 +1,253 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrClientNotConnected = errors.New("client is not connected to a hub")
+	ErrClientClosed       = errors.New("client is closed")
+	ErrHubClosed          = errors.New("hub is closed")
+)
+
+// Error returns the error code as is, so codes can be matched with errors.Is
+func (e ErrCode) Error() string {
+	return string(e)
+}
+
+// CommandError is returned by LocalClient methods when the hub replies with an error,
+// it can be matched against error codes with errors.Is (e.g. errors.Is(err, ErrPermissionDenied))
+type CommandError struct {
+	Code    ErrCode
+	Details string
+
+	// For rate limited requests, how long to wait before trying again (0 if retrying won't help)
+	RetryAfter time.Duration
+}
+
+func (e *CommandError) Error() string {
+	if e.Details == "" {
+		return string(e.Code)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Details)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Code
+}
+
+// Do sends a command to the hub and waits for its reply, errors sent by the hub are
+// returned as a *CommandError. The client must have been added with Hub.AddClient.
+// If ctx is done before the reply arrives, the reply is discarded and ctx.Err() is returned.
+// If the hub is closed before replying, ErrHubClosed is returned.
+func (c *LocalClient) Do(ctx context.Context, cmd string, data map[string]any) (Response, error) {
+	c.mu.Lock()
+	hub := c.hub
+	c.mu.Unlock()
+	if hub == nil {
+		return Response{}, ErrClientNotConnected
+	}
+	if err := ctx.Err(); err != nil {
+		return Response{}, err
+	}
+
+	requestID, message, chn := c.makeRequest(cmd, data)
+	if err := hub.sendMessageContext(ctx, message); err != nil {
+		c.forget(requestID)
+		return Response{}, err
+	}
+
+	select {
+	case reply := <-chn:
+		switch reply := reply.(type) {
+		case Response:
+			return reply, nil
+		case Error:
+			return Response{}, &CommandError{
+				Code:       reply.Error,
+				Details:    reply.Details,
+				RetryAfter: time.Duration(reply.RetryAfter) * time.Millisecond,
+			}
+		default:
+			return Response{}, fmt.Errorf("unexpected reply %T", reply)
+		}
+	case <-ctx.Done():
+		c.forget(requestID)
+		return Response{}, ctx.Err()
+	case <-c.done:
+		c.forget(requestID)
+		return Response{}, ErrClientClosed
+	case <-hub.context.Done():
+		c.forget(requestID)
+		return Response{}, ErrHubClosed
+	}
+}
+
+// forget stops waiting for the reply of a request
+func (c *LocalClient) forget(requestID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, requestID)
+}
+
+// do sends a command and decodes the data of its reply into out, if it's not nil
+func (c *LocalClient) do(ctx context.Context, cmd string, data map[string]any, out any) error {
+	resp, err := c.Do(ctx, cmd, data)
+	if err != nil || out == nil {
+		return err
+	}
+	// Replies are decoded generically by Run, go through JSON again to get the right types
+	raw, err := json.Marshal(resp.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// Get returns the value of a key, or ErrorKeyNotFound if it doesn't exist
+func (c *LocalClient) Get(ctx context.Context, key string) (string, error) {
+	var result KeyValue
+	if err := c.do(ctx, CmdReadKey, map[string]any{"key": key}, &result); err != nil {
+		return "", err
+	}
+	if !result.Exists {
+		return "", ErrorKeyNotFound
+	}
+	return result.Value, nil
+}
+
+// GetBulk returns the values of several keys, leaving out the ones that don't exist
+func (c *LocalClient) GetBulk(ctx context.Context, keys []string) (map[string]string, error) {
+	list := make([]any, len(keys))
+	for index, key := range keys {
+		list[index] = key
+	}
+	result := make(map[string]string)
+	err := c.do(ctx, CmdReadBulk, map[string]any{"keys": list}, &result)
+	return result, err
+}
+
+// GetPrefix returns every key starting with prefix and its value
+func (c *LocalClient) GetPrefix(ctx context.Context, prefix string) (map[string]string, error) {
+	result := make(map[string]string)
+	err := c.do(ctx, CmdReadPrefix, map[string]any{"prefix": prefix}, &result)
+	return result, err
+}
+
+// Set writes a key
+func (c *LocalClient) Set(ctx context.Context, key string, value string) error {
+	return c.do(ctx, CmdWriteKey, map[string]any{"key": key, "data": value}, nil)
+}
+
+// SetBulk writes several keys at once
+func (c *LocalClient) SetBulk(ctx context.Context, kvs map[string]string) error {
+	data := make(map[string]any, len(kvs))
+	for key, value := range kvs {
+		data[key] = value
+	}
+	return c.do(ctx, CmdWriteBulk, data, nil)
+}
+
+// Delete removes a key
+func (c *LocalClient) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, CmdRemoveKey, map[string]any{"key": key}, nil)
+}
+
+// List returns the keys starting with prefix
+func (c *LocalClient) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := c.do(ctx, CmdListKeys, map[string]any{"prefix": prefix}, &keys)
+	return keys, err
+}
+
+// Subscribe calls callback every time key changes, until the returned ID is passed to Unsubscribe
+func (c *LocalClient) Subscribe(ctx context.Context, key string, callback SubscriptionCallback) (int64, error) {
+	return c.subscribe(ctx, CmdSubscribeKey, "key", key, callback)
+}
+
+// SubscribePrefix calls callback every time a key starting with prefix changes,
+// until the returned ID is passed to Unsubscribe
+func (c *LocalClient) SubscribePrefix(ctx context.Context, prefix string, callback SubscriptionCallback) (int64, error) {
+	return c.subscribe(ctx, CmdSubscribePrefix, "prefix", prefix, callback)
+}
+
+func (c *LocalClient) subscribe(ctx context.Context, cmd string, param string, target string, callback SubscriptionCallback) (int64, error) {
+	if err := c.lockSubscriptions(ctx); err != nil {
+		return 0, err
+	}
+	defer c.unlockSubscriptions()
+
+	// Add the callback first, pushes can arrive right after the hub replies
+	var id int64
+	if cmd == CmdSubscribeKey {
+		id = c.SetKeySubCallback(target, callback)
+	} else {
+		id = c.SetPrefixSubCallback(target, callback)
+	}
+	if err := c.do(ctx, cmd, map[string]any{param: target}, nil); err != nil {
+		c.UnsetCallback(id)
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	subscription := localSubscription{cmd, target}
+	c.remote[id] = subscription
+	c.remoteCount[subscription]++
+	return id, nil
+}
+
+// Unsubscribe stops calling a callback added with Subscribe or SubscribePrefix, the hub
+// stops sending changes once no other callback needs them
+func (c *LocalClient) Unsubscribe(ctx context.Context, id int64) error {
+	if err := c.lockSubscriptions(ctx); err != nil {
+		return err
+	}
+	defer c.unlockSubscriptions()
+
+	c.mu.Lock()
+	subscription, ok := c.remote[id]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	delete(c.remote, id)
+	c.remoteCount[subscription]--
+	last := c.remoteCount[subscription] == 0
+	if last {
+		delete(c.remoteCount, subscription)
+	}
+	c.mu.Unlock()
+	c.UnsetCallback(id)
+
+	if !last {
+		return nil
+	}
+	if subscription.cmd == CmdSubscribeKey {
+		return c.do(ctx, CmdUnsubscribeKey, map[string]any{"key": subscription.target}, nil)
+	}
+	return c.do(ctx, CmdUnsubscribePrefix, map[string]any{"prefix": subscription.target}, nil)
+}
+
+// lockSubscriptions waits for other calls to Subscribe, SubscribePrefix and Unsubscribe to be done
+func (c *LocalClient) lockSubscriptions(ctx context.Context) error {
+	select {
+	case c.subscribing <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *LocalClient) unlockSubscriptions() {
+	<-c.subscribing
+}
+
+// localSubscription is a subscription made on the hub by Subscribe or SubscribePrefix
+type localSubscription struct {
+	cmd    string
+	target string
+}
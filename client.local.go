@@ -15,14 +15,29 @@ type LocalClient struct {
 	// Unique ID
 	uid int64
 
-	// Buffered channel of outbound messages.
+	// Channel of outbound messages.
 	send chan []byte
 
+	// Closed when the client is closed
+	done      chan struct{}
+	closeOnce sync.Once
+
 	subscriptions *subscriptionManager
 	callbacks     map[int64]SubscriptionCallback
 	pending       map[string]chan interface{}
 	responses     chan Response
 
+	// Hub the client was added to, used by the typed API
+	hub *Hub
+
+	// Subscriptions made by Subscribe and SubscribePrefix, by callback and how many callbacks use them
+	remote      map[int64]localSubscription
+	remoteCount map[localSubscription]int
+
+	// Held while subscribing or unsubscribing until the hub replies, so the hub's
+	// subscriptions can't get out of step with remoteCount
+	subscribing chan struct{}
+
 	logger  *zap.Logger
 	options ClientOptions
 
@@ -38,10 +53,14 @@ func NewLocalClient(options ClientOptions, log *zap.Logger) *LocalClient {
 	client := &LocalClient{
 		uid:           0,
 		send:          make(chan []byte),
+		done:          make(chan struct{}),
 		subscriptions: makeSubscriptionManager(),
 		callbacks:     make(map[int64]SubscriptionCallback),
 		pending:       make(map[string]chan any),
 		responses:     make(chan Response, 100),
+		remote:        make(map[int64]localSubscription),
+		remoteCount:   make(map[localSubscription]int),
+		subscribing:   make(chan struct{}, 1),
 		logger:        log,
 		options:       options,
 		mu:            sync.Mutex{},
@@ -54,7 +73,14 @@ func NewLocalClient(options ClientOptions, log *zap.Logger) *LocalClient {
 }
 
 func (c *LocalClient) Run() {
-	for data := range c.send {
+	for {
+		var data []byte
+		select {
+		case data = <-c.send:
+		case <-c.done:
+			return
+		}
+
 		c.logger.Debug("received from server", zap.String("data", string(data)))
 		var response Response
 		err := jsoniter.ConfigFastest.Unmarshal(data, &response)
@@ -104,12 +130,14 @@ func (c *LocalClient) Run() {
 				continue
 			}
 			subscriberIds := c.subscriptions.GetSubscribers(push.Key)
+			c.mu.Lock()
 			for _, subscriberId := range subscriberIds {
 				callback, ok := c.callbacks[subscriberId]
 				if ok {
 					go callback(push.Key, push.NewValue)
 				}
 			}
+			c.mu.Unlock()
 		case "hello":
 			c.ready.Done()
 		}
@@ -121,6 +149,11 @@ func (c *LocalClient) Wait() {
 }
 
 func (c *LocalClient) MakeRequest(cmd string, data map[string]any) (Message, <-chan any) {
+	_, message, chn := c.makeRequest(cmd, data)
+	return message, chn
+}
+
+func (c *LocalClient) makeRequest(cmd string, data map[string]any) (string, Message, <-chan any) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	var requestID string
@@ -139,7 +172,7 @@ func (c *LocalClient) MakeRequest(cmd string, data map[string]any) (Message, <-c
 		Data:      data,
 		RequestID: requestID,
 	})
-	return Message{c, byt}, chn
+	return requestID, Message{c, byt}, chn
 }
 
 func (c *LocalClient) createCallback(callback SubscriptionCallback) (id int64) {
@@ -171,14 +204,13 @@ func (c *LocalClient) SetPrefixSubCallback(key string, callback SubscriptionCall
 }
 
 func (c *LocalClient) UnsetCallback(id int64) {
-	_, ok := c.callbacks[id]
-	if !ok {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.callbacks[id]; !ok {
 		return
 	}
-	c.mu.Lock()
 	c.subscriptions.UnsubscribeAll(id)
 	delete(c.callbacks, id)
-	c.mu.Unlock()
 }
 
 func (c *LocalClient) SetUID(uid int64) {
@@ -191,11 +223,22 @@ func (c *LocalClient) UID() int64 {
 
 func (c *LocalClient) SendJSON(data any) {
 	msg, _ := json.Marshal(data)
-	c.send <- msg
+	c.SendMessage(msg)
 }
 
+// SendMessage delivers a message to the client, messages sent after the client is closed are discarded
 func (c *LocalClient) SendMessage(data []byte) {
-	c.send <- data
+	select {
+	case c.send <- data:
+	case <-c.done:
+	}
+}
+
+// setHub is called when the client is added to a hub
+func (c *LocalClient) setHub(hub *Hub) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hub = hub
 }
 
 func (c *LocalClient) Options() ClientOptions {
@@ -203,8 +246,7 @@ func (c *LocalClient) Options() ClientOptions {
 }
 
 func (c *LocalClient) Close() {
-	if c.send != nil {
-		close(c.send)
-		c.send = nil
-	}
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
 }
@@ -0,0 +1,170 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestLocalClientAPI(t *testing.T) {
+	makeHubClient(t, func(hub *Hub, client *LocalClient) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if _, err := client.Get(ctx, "api-missing"); err != ErrorKeyNotFound {
+			t.Fatalf("expected ErrorKeyNotFound, got %v", err)
+		}
+		if err := client.Set(ctx, "api-a", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := client.Get(ctx, "api-a"); err != nil || value != "1" {
+			t.Fatalf("expected 1, got %s (%v)", value, err)
+		}
+		if err := client.SetBulk(ctx, map[string]string{"api-b": "2", "api-c": "3"}); err != nil {
+			t.Fatal(err)
+		}
+		values, err := client.GetBulk(ctx, []string{"api-a", "api-c", "api-missing"})
+		if err != nil || len(values) != 2 || values["api-c"] != "3" {
+			t.Fatalf("unexpected bulk values %v (%v)", values, err)
+		}
+		values, err = client.GetPrefix(ctx, "api-")
+		if err != nil || len(values) != 3 {
+			t.Fatalf("unexpected prefix values %v (%v)", values, err)
+		}
+		keys, err := client.List(ctx, "api-")
+		if err != nil || len(keys) != 3 {
+			t.Fatalf("unexpected keys %v (%v)", keys, err)
+		}
+		if err := client.Delete(ctx, "api-b"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Errors from the hub can be matched by code
+		_, err = client.Do(ctx, "kmystery", nil)
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) || !errors.Is(err, ErrUnknownCmd) {
+			t.Fatalf("expected unknown command error, got %v", err)
+		}
+
+		// Subscriptions
+		pushes := make(chan string, 10)
+		id, err := client.Subscribe(ctx, "api-a", func(key string, value string) {
+			pushes <- value
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Set(ctx, "api-a", "changed"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("push took too long to arrive")
+		case push := <-pushes:
+			if push != "changed" {
+				t.Fatalf("wrong push received: %s", push)
+			}
+		}
+		if err := client.Unsubscribe(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if subscribers := hub.subscriptions.GetSubscribers(test_namespace + "api-a"); len(subscribers) != 0 {
+			t.Fatal("hub subscription still present after unsubscribing")
+		}
+
+		// Cancelled requests don't leave anything behind
+		cancelled, cancelNow := context.WithCancel(ctx)
+		cancelNow()
+		if _, err := client.Get(cancelled, "api-a"); err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		client.mu.Lock()
+		pending := len(client.pending)
+		client.mu.Unlock()
+		if pending != 0 {
+			t.Fatalf("%d requests still pending after cancellation", pending)
+		}
+	})
+}
+
+func TestLocalClientNotConnected(t *testing.T) {
+	client := NewLocalClient(ClientOptions{}, nil)
+	defer client.Close()
+	if _, err := client.Get(context.Background(), "key"); err != ErrClientNotConnected {
+		t.Fatalf("expected ErrClientNotConnected, got %v", err)
+	}
+}
+
+func TestLocalClientHubClosed(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub := createInMemoryHub(t, log)
+	stopped := make(chan struct{})
+	go func() {
+		hub.Run()
+		close(stopped)
+	}()
+
+	client := NewLocalClient(ClientOptions{}, log)
+	defer client.Close()
+	go client.Run()
+	hub.AddClient(client)
+	client.Wait()
+
+	hub.Close()
+	<-stopped
+
+	// More requests than the hub can queue, none of them must hang
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 2*cap(hub.incoming); i++ {
+			if _, err := client.Do(context.Background(), CmdProtoVersion, nil); err != ErrHubClosed {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected ErrHubClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Do blocked on a closed hub")
+	}
+}
+
+func TestLocalClientSubscribePushAfterReply(t *testing.T) {
+	makeHubClient(t, func(hub *Hub, client *LocalClient) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// Change the key as soon as the subscription is acknowledged
+		hub.Use(func(next Handler) Handler {
+			return func(hub *Hub, client Client, msg Request) {
+				next(hub, client, msg)
+				if msg.CmdName == CmdSubscribeKey {
+					_ = hub.Set(test_namespace+"api-a", "right away")
+				}
+			}
+		})
+
+		pushes := make(chan string, 10)
+		if _, err := client.Subscribe(ctx, "api-a", func(key string, value string) {
+			pushes <- value
+		}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("push sent right after subscribing was lost")
+		case push := <-pushes:
+			if push != "right away" {
+				t.Fatalf("wrong push received: %s", push)
+			}
+		}
+	})
+}
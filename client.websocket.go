@@ -38,11 +38,14 @@ type WebsocketClient struct {
 	conn *websocket.Conn
 	addr string
 
+	// Address the client is counted as connecting from, for connection limits
+	ip string
+
 	// Context with timeouts
 	ctx context.Context
 
-	// Buffered channel of outbound messages.
-	send chan []byte
+	// Bounded queue of outbound messages.
+	queue *outboundQueue
 
 	options ClientOptions
 }
@@ -56,6 +59,7 @@ func (c *WebsocketClient) readPump() {
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.CloseNow()
+		c.hub.connections.release(c.ip)
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 
@@ -73,7 +77,7 @@ func (c *WebsocketClient) readNext() error {
 		return err
 	}
 	message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-	c.hub.incoming <- Message{c, message}
+	c.hub.SendMessage(Message{c, message})
 	return nil
 }
 
@@ -90,14 +94,22 @@ func (c *WebsocketClient) writePump() {
 	}()
 	for c.ctx.Err() == nil {
 		select {
-		case message, ok := <-c.send:
-			if !ok {
-				// The hub closed the channel.
+		case <-c.queue.wake:
+			messages, closed, overflowed := c.queue.take()
+			if overflowed {
+				c.conn.Close(websocket.StatusPolicyViolation, "client too slow")
+				return
+			}
+			if len(messages) > 0 {
+				if err := c.write(messages); err != nil {
+					return
+				}
+			}
+			if closed {
+				// The hub closed the queue.
 				c.conn.Close(websocket.StatusNormalClosure, "bye")
 				return
 			}
-
-			c.write(message)
 		case <-ticker.C:
 			if err := c.conn.Ping(c.ctx); err != nil {
 				return
@@ -106,23 +118,39 @@ func (c *WebsocketClient) writePump() {
 	}
 }
 
-func (c *WebsocketClient) write(message []byte) {
+// write sends every queued message in a single frame, separated by newlines
+func (c *WebsocketClient) write(messages [][]byte) error {
 	ctx, cancel := context.WithTimeout(c.ctx, writeWait)
 	defer cancel()
 
 	w, err := c.conn.Writer(ctx, websocket.MessageText)
 	if err != nil {
-		return
+		return err
+	}
+	for i, message := range messages {
+		if i > 0 {
+			w.Write(newline)
+		}
+		w.Write(message)
 	}
-	w.Write(message)
+	return w.Close()
+}
 
-	// Read other queued messages
-	n := len(c.send)
-	for i := 0; i < n; i++ {
-		w.Write(newline)
-		w.Write(<-c.send)
+// enqueue adds a message to the outbound queue without blocking, applying
+// the client's slow client policy if the queue is full
+func (c *WebsocketClient) enqueue(msg queuedMessage) {
+	dropped, disconnect := c.queue.push(msg)
+	switch {
+	case disconnect:
+		c.hub.logger.Warn("outbound queue full, disconnecting slow client", zap.Int64("client", c.uid), zap.String("addr", c.addr))
+	case dropped:
+		c.hub.dropped.Add(1)
+		if count := c.queue.droppedCount(); count == 1 {
+			c.hub.logger.Warn("outbound queue full, dropping messages for slow client", zap.Int64("client", c.uid), zap.String("addr", c.addr))
+		} else {
+			c.hub.logger.Debug("dropped message for slow client", zap.Int64("client", c.uid), zap.Uint64("dropped", count))
+		}
 	}
-	w.Close()
 }
 
 func (c *WebsocketClient) SetUID(uid int64) {
@@ -135,11 +163,26 @@ func (c *WebsocketClient) UID() int64 {
 
 func (c *WebsocketClient) SendJSON(data any) {
 	msg, _ := json.Marshal(data)
-	c.send <- msg
+	c.enqueue(queuedMessage{data: msg})
 }
 
 func (c *WebsocketClient) SendMessage(data []byte) {
-	c.send <- data
+	c.enqueue(queuedMessage{data: data})
+}
+
+// SendPush queues a push for a key, pushes can be dropped or coalesced if the client is too slow
+func (c *WebsocketClient) SendPush(key string, data []byte) {
+	c.enqueue(queuedMessage{data: data, key: key, isPush: true})
+}
+
+// DroppedMessages returns how many messages were dropped because the client was too slow
+func (c *WebsocketClient) DroppedMessages() uint64 {
+	return c.queue.droppedCount()
+}
+
+// RemoteAddr returns the address the client is connecting from
+func (c *WebsocketClient) RemoteAddr() string {
+	return c.addr
 }
 
 func (c *WebsocketClient) Options() ClientOptions {
@@ -147,5 +190,5 @@ func (c *WebsocketClient) Options() ClientOptions {
 }
 
 func (c *WebsocketClient) Close() {
-	close(c.send)
+	c.queue.close()
 }
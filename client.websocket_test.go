@@ -20,3 +20,84 @@ func TestWebsocketServer(t *testing.T) {
 	})
 	httptest.NewServer(mux)
 }
+
+func queuedData(q *outboundQueue) string {
+	messages, _, _ := q.take()
+	result := ""
+	for _, msg := range messages {
+		result += string(msg) + " "
+	}
+	return result
+}
+
+func TestOutboundQueue(t *testing.T) {
+	response := func(data string) queuedMessage {
+		return queuedMessage{data: []byte(data)}
+	}
+	push := func(key string, data string) queuedMessage {
+		return queuedMessage{data: []byte(data), key: key, isPush: true}
+	}
+
+	t.Run("drop oldest", func(t *testing.T) {
+		q := newOutboundQueue(3, SlowClientDropOldest)
+		q.push(response("r1"))
+		q.push(push("a", "a1"))
+		q.push(push("b", "b1"))
+		if dropped, _ := q.push(push("a", "a2")); !dropped {
+			t.Fatal("expected a message to be dropped")
+		}
+		if got := queuedData(q); got != "r1 b1 a2 " {
+			t.Fatalf("unexpected queue contents: %s", got)
+		}
+		if q.droppedCount() != 1 {
+			t.Fatalf("expected 1 dropped message, got %d", q.droppedCount())
+		}
+	})
+
+	t.Run("coalesce", func(t *testing.T) {
+		q := newOutboundQueue(3, SlowClientCoalesce)
+		q.push(push("a", "a1"))
+		q.push(push("b", "b1"))
+		q.push(push("c", "c1"))
+		q.push(push("b", "b2"))
+		q.push(push("d", "d1"))
+		if got := queuedData(q); got != "c1 b2 d1 " {
+			t.Fatalf("unexpected queue contents: %s", got)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		q := newOutboundQueue(2, SlowClientDisconnect)
+		q.push(push("a", "a1"))
+		q.push(push("b", "b1"))
+		if _, disconnect := q.push(push("c", "c1")); !disconnect {
+			t.Fatal("expected client to be disconnected")
+		}
+		if _, disconnect := q.push(push("d", "d1")); disconnect {
+			t.Fatal("disconnect must only be reported once")
+		}
+		if _, _, overflowed := q.take(); !overflowed {
+			t.Fatal("queue not marked as overflowed")
+		}
+	})
+
+	t.Run("responses are never dropped", func(t *testing.T) {
+		q := newOutboundQueue(2, SlowClientDropOldest)
+		q.push(response("r1"))
+		q.push(response("r2"))
+		if _, disconnect := q.push(push("a", "a1")); !disconnect {
+			t.Fatal("expected client to be disconnected when only responses are queued")
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		q := newOutboundQueue(2, SlowClientDropOldest)
+		q.push(response("r1"))
+		q.close()
+		q.push(response("r2"))
+		messages, closed, _ := q.take()
+		if !closed || len(messages) != 1 {
+			t.Fatalf("expected 1 message and a closed queue, got %d messages (closed: %v)", len(messages), closed)
+		}
+	})
+}
@@ -1,32 +1,159 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 
 	kv "git.sr.ht/~ashkeel/kilovolt/v11"
 	"go.uber.org/zap"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		runTokenCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verifier" {
+		runVerifierCommand(os.Args[2:])
+		return
+	}
+
 	bind := flag.String("port", ":8080", "host:port to listen on")
 	password := flag.String("password", "", "password to use (leave blank for no password)")
+	passwordVerifier := flag.String("password-verifier", "", "SCRAM verifier of the password to use instead of -password (create one with the verifier command)")
+	dataDir := flag.String("data", "", "directory to store the database in (leave blank for in-memory storage)")
+	snapshot := flag.String("snapshot", "", "file to load/save in-memory storage from/to on start/exit (ignored if -data is set)")
+	usersFile := flag.String("users", "", "JSON file with users (and their roles) clients can authenticate as")
+	origins := flag.String("origins", "", "comma-separated list of origins to accept connections from, like \"*.example.com\" (leave blank to accept any origin)")
+	requireSubprotocol := flag.Bool("require-subprotocol", false, "refuse clients that don't ask for the "+kv.Subprotocol+" subprotocol")
+	maxConnections := flag.Int("max-connections", 0, "maximum number of connected clients (0 for no limit)")
+	maxConnectionsPerIP := flag.Int("max-connections-per-ip", 0, "maximum number of clients connected from the same address (0 for no limit)")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated list of addresses or ranges of reverse proxies whose X-Forwarded-For header is trusted")
+	tokensFile := flag.String("tokens", "", "JSON file with API tokens clients can authenticate with (manage with the token command)")
+	auditFile := flag.String("audit", "", "file to log every change made by clients to, one JSON object per line (rotated when it reaches -audit-max-size)")
+	auditMaxSize := flag.Int64("audit-max-size", 10*1024*1024, "size in bytes the audit log is rotated at")
+	auditRedact := flag.Bool("audit-redact", false, "leave values out of the audit log, only logging their size")
 	flag.Parse()
 
 	log, err := zap.NewDevelopment()
 	checkErr(err)
 
-	driver := kv.MakeBackend()
-	hub, err := kv.NewHub(driver, kv.HubOptions{Password: *password}, log)
+	var driver kv.Driver
+	if *dataDir != "" {
+		fileDriver, err := kv.OpenFileBackend(*dataDir, kv.FileBackendOptions{})
+		checkErr(err)
+		defer fileDriver.Close()
+		driver = fileDriver
+	} else {
+		memDriver, err := kv.NewMemoryBackend(kv.MemoryBackendOptions{SnapshotPath: *snapshot})
+		checkErr(err)
+		defer memDriver.Close()
+		driver = memDriver
+	}
+
+	options := kv.HubOptions{
+		Password: *password,
+		Connections: kv.ConnectionPolicy{
+			AllowedOrigins:      splitList(*origins),
+			RequireSubprotocol:  *requireSubprotocol,
+			MaxConnections:      *maxConnections,
+			MaxConnectionsPerIP: *maxConnectionsPerIP,
+			TrustedProxies:      splitList(*trustedProxies),
+		},
+	}
+	if *passwordVerifier != "" {
+		verifier, err := kv.ParseScramVerifier(*passwordVerifier)
+		checkErr(err)
+		options.PasswordVerifier = &verifier
+	}
+	if *usersFile != "" {
+		users, err := kv.OpenFileUserStore(*usersFile)
+		checkErr(err)
+		options.Users = users
+		options.Roles = users.Roles()
+	}
+	if *tokensFile != "" {
+		tokens, err := kv.OpenFileTokenStore(*tokensFile)
+		checkErr(err)
+		options.Tokens = tokens
+	}
+	if *auditFile != "" {
+		audit, err := kv.OpenFileAuditSink(*auditFile, kv.FileAuditSinkOptions{
+			MaxSize:      *auditMaxSize,
+			RedactValues: *auditRedact,
+		})
+		checkErr(err)
+		defer audit.Close()
+		options.Audit = audit
+	}
+
+	hub, err := kv.NewHub(driver, options, log)
 	checkErr(err)
 
 	defer hub.Close()
 	go hub.Run()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		hub.CreateWebsocketClient(w, r, kv.ClientOptions{})
-	})
-	checkErr(http.ListenAndServe(*bind, nil))
+	server := &http.Server{
+		Addr: *bind,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hub.CreateWebsocketClient(w, r, kv.ClientOptions{})
+		}),
+	}
+
+	// Shut down cleanly on interrupt so drivers get a chance to save their data
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		checkErr(err)
+	}
+}
+
+// runVerifierCommand prints the SCRAM verifier of a password, to be used with -password-verifier
+// or as the verifier of a user
+func runVerifierCommand(args []string) {
+	flags := flag.NewFlagSet("verifier", flag.ExitOnError)
+	iterations := flags.Int("iterations", kv.ScramIterations, "number of PBKDF2 iterations")
+	_ = flags.Parse(args)
+
+	var password string
+	if flags.NArg() > 0 {
+		password = flags.Arg(0)
+	} else {
+		// Read from stdin so the password doesn't end up in the shell history
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			checkErr(err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	verifier, err := kv.NewScramVerifier(password, *iterations)
+	checkErr(err)
+	fmt.Println(verifier)
+}
+
+// splitList splits a comma-separated flag value, returning nil if it's empty
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
 }
 
 func checkErr(err error) {
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	kv "git.sr.ht/~ashkeel/kilovolt/v11"
+)
+
+const tokenUsage = `usage: kv-server token <command> [options]
+
+commands:
+  mint     create a new token and print it
+  revoke   revoke a token by ID
+  list     list every token
+`
+
+// scopeList collects -scope flags in the form pattern=permissions
+type scopeList kv.ACL
+
+func (s *scopeList) String() string {
+	var rules []string
+	for _, rule := range *s {
+		rules = append(rules, rule.Pattern+"="+rule.Permissions.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+func (s *scopeList) Set(value string) error {
+	pattern, perms, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("scope must be in the form pattern=permissions")
+	}
+	permission, err := kv.ParsePermission(perms)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, kv.ACLRule{Pattern: pattern, Permissions: permission})
+	return nil
+}
+
+func runTokenCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, tokenUsage)
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	tokensFile := flags.String("tokens", "tokens.json", "JSON file the tokens are stored in")
+
+	switch args[0] {
+	case "mint":
+		name := flags.String("name", "", "description of what the token is used for")
+		namespace := flags.String("namespace", "", "namespace clients using the token are moved to")
+		ttl := flags.Duration("ttl", 0, "how long the token is valid for (0 means forever)")
+		var scopes scopeList
+		flags.Var(&scopes, "scope", "pattern=permissions the token is allowed (can be repeated, no scopes means full access)")
+		_ = flags.Parse(args[1:])
+
+		store, err := kv.OpenFileTokenStore(*tokensFile)
+		checkErr(err)
+		template := kv.Token{
+			Name:      *name,
+			Namespace: *namespace,
+			Scopes:    kv.ACL(scopes),
+		}
+		if *ttl > 0 {
+			template.ExpiresAt = time.Now().Add(*ttl)
+		}
+		str, _, err := store.Mint(template)
+		checkErr(err)
+		fmt.Println(str)
+	case "revoke":
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "usage: kv-server token revoke [-tokens file] <id>")
+			os.Exit(2)
+		}
+
+		store, err := kv.OpenFileTokenStore(*tokensFile)
+		checkErr(err)
+		checkErr(store.Revoke(flags.Arg(0)))
+	case "list":
+		_ = flags.Parse(args[1:])
+
+		store, err := kv.OpenFileTokenStore(*tokensFile)
+		checkErr(err)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tNAMESPACE\tSCOPES\tEXPIRES")
+		now := time.Now()
+		for _, token := range store.Tokens() {
+			scopes := scopeList(token.Scopes)
+			scopeStr := scopes.String()
+			switch {
+			case token.Scopes == nil:
+				scopeStr = "all"
+			case len(token.Scopes) == 0:
+				scopeStr = "none"
+			}
+			expires := "never"
+			switch {
+			case token.Expired(now):
+				expires = "expired"
+			case !token.ExpiresAt.IsZero():
+				expires = token.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", token.ID, token.Name, token.Namespace, scopeStr, expires)
+		}
+		_ = w.Flush()
+	default:
+		fmt.Fprint(os.Stderr, tokenUsage)
+		os.Exit(2)
+	}
+}
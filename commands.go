@@ -6,19 +6,22 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
+	"math"
 	"strconv"
+	"time"
 
 	"go.uber.org/zap"
 )
 
-type commandHandlerFn func(*Hub, Client, Request)
-
-var handlers = map[string]commandHandlerFn{
+// Built-in commands, every hub starts with these
+var handlers = map[string]Handler{
 	CmdReadKey:           cmdReadKey,
 	CmdReadBulk:          cmdReadBulk,
 	CmdReadPrefix:        cmdReadPrefix,
 	CmdWriteKey:          cmdWriteKey,
 	CmdWriteBulk:         cmdWriteBulk,
+	CmdCompareAndSwap:    cmdCompareAndSwap,
+	CmdTransaction:       cmdTransaction,
 	CmdRemoveKey:         cmdRemoveKey,
 	CmdSubscribeKey:      cmdSubscribeKey,
 	CmdUnsubscribeKey:    cmdUnsubscribeKey,
@@ -28,6 +31,8 @@ var handlers = map[string]commandHandlerFn{
 	CmdListKeys:          cmdListKeys,
 	CmdAuthRequest:       cmdAuthRequest,
 	CmdAuthChallenge:     cmdAuthChallenge,
+	CmdLogout:            cmdLogout,
+	CmdResume:            cmdResume,
 	CmdInternalClientID:  cmdInternalClientID,
 }
 
@@ -39,26 +44,37 @@ func cmdReadKey(h *Hub, client Client, msg Request) {
 	// Check params
 	key, ok := msg.Data["key"].(string)
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'key' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'key' parameter")
+		return
+	}
+	if !requirePermission(h, client, msg, PermRead, key) {
 		return
 	}
 
 	// Remap key if necessary
-	options := client.Options()
+	options := h.clientOptions(client)
 	realKey := options.Namespace + key
 
-	data, err := h.db.Get(realKey)
+	var result KeyValue
+	var err error
+	// Only look up revision if asked, it might be more expensive
+	if withRevision, _ := msg.Data["revision"].(bool); withRevision {
+		result.Value, result.Revision, err = h.readRevision(realKey)
+	} else {
+		result.Value, err = h.db.Get(realKey)
+	}
 	if err != nil {
 		if err == ErrorKeyNotFound {
-			client.SendJSON(Response{"response", true, msg.RequestID, ""})
+			client.SendJSON(Response{"response", true, msg.RequestID, result})
 			h.logger.Debug("get for non-existent key", zap.Int64("client", client.UID()), zap.String("key", realKey))
 			return
 		} else {
-			sendErr(client, ErrServerError, err.Error(), msg.RequestID)
+			sendErr(h, client, msg, ErrServerError, err.Error())
 			return
 		}
 	}
-	client.SendJSON(Response{"response", true, msg.RequestID, data})
+	result.Exists = true
+	client.SendJSON(Response{"response", true, msg.RequestID, result})
 	h.logger.Debug("get key", zap.Int64("client", client.UID()), zap.String("key", realKey))
 }
 
@@ -70,25 +86,28 @@ func cmdReadBulk(h *Hub, client Client, msg Request) {
 	// Check params
 	keys, ok := msg.Data["keys"].([]interface{})
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'keys' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'keys' parameter")
 		return
 	}
 
-	options := client.Options()
+	options := h.clientOptions(client)
 	realKeys := make([]string, len(keys))
 	for index, key := range keys {
 		// Remap key if necessary
 		realKeys[index], ok = key.(string)
 		if !ok {
-			sendErr(client, ErrMissingParam, "invalid entry in 'keys' parameter", msg.RequestID)
+			sendErr(h, client, msg, ErrMissingParam, "invalid entry in 'keys' parameter")
+			return
+		}
+		if !requirePermission(h, client, msg, PermRead, realKeys[index]) {
 			return
 		}
 		realKeys[index] = options.Namespace + realKeys[index]
 	}
 
-	results, err := h.db.GetBulk(realKeys)
+	results, err := h.getBulk(realKeys)
 	if err != nil {
-		sendErr(client, ErrServerError, "server error: "+err.Error(), msg.RequestID)
+		sendErr(h, client, msg, ErrServerError, "server error: "+err.Error())
 		return
 	}
 
@@ -110,24 +129,30 @@ func cmdReadPrefix(h *Hub, client Client, msg Request) {
 	// Check params
 	prefix, ok := msg.Data["prefix"].(string)
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'prefix' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'prefix' parameter")
+		return
+	}
+	if !requirePrefixPermission(h, client, msg, PermRead, prefix) {
 		return
 	}
 
 	// Remap key if necessary
-	options := client.Options()
+	options := h.clientOptions(client)
 	realPrefix := options.Namespace + prefix
 
 	results, err := h.db.GetPrefix(realPrefix)
 	if err != nil {
-		sendErr(client, ErrServerError, err.Error(), msg.RequestID)
+		sendErr(h, client, msg, ErrServerError, err.Error())
 		return
 	}
 
-	// Remap keys if necessary
+	// Remap keys if necessary, leaving out the ones the client can't read
 	out := make(map[string]string)
 	for key, value := range results {
-		out[key[len(options.Namespace):]] = value
+		key = key[len(options.Namespace):]
+		if options.ACL.Allows(key, PermRead) {
+			out[key] = value
+		}
 	}
 
 	h.logger.Debug("get all (prefix)", zap.Int64("client", client.UID()), zap.String("prefix", prefix))
@@ -142,28 +167,56 @@ func cmdWriteKey(h *Hub, client Client, msg Request) {
 	// Check params
 	key, ok := msg.Data["key"].(string)
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'key' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'key' parameter")
+		return
+	}
+	if !requirePermission(h, client, msg, PermWrite, key) {
 		return
 	}
 	data, ok := msg.Data["data"].(string)
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'data' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'data' parameter")
+		return
+	}
+
+	ttl, ok := ttlParam(msg.Data)
+	if !ok {
+		sendErr(h, client, msg, ErrMissingParam, "invalid 'ttl' parameter")
+		return
+	}
+
+	// Conditional write
+	if _, ok := msg.Data["if_revision"]; ok {
+		revision, ok := revisionParam(msg.Data["if_revision"])
+		if !ok {
+			sendErr(h, client, msg, ErrMissingParam, "invalid 'if_revision' parameter")
+			return
+		}
+		compareAndSwap(h, client, msg, key, data, revision, ttl)
 		return
 	}
 
 	// Remap key if necessary
-	options := client.Options()
+	options := h.clientOptions(client)
 	realKey := options.Namespace + key
 
-	err := h.db.Set(realKey, data)
+	// Hold the key until subscribers are notified, so pushes follow the order of writes
+	unlock := h.locks.Lock(realKey)
+	defer unlock()
+
+	changes := h.recordChanges(client, msg.CmdName)
+	changes.before(realKey)
+
+	err := h.writeKey(realKey, data, ttl)
 	if err != nil {
-		sendErr(client, ErrServerError, err.Error(), msg.RequestID)
+		sendErr(h, client, msg, ErrServerError, err.Error())
 		return
 	}
+	changes.set(realKey, data)
 	// Send OK response
 	client.SendJSON(Response{"response", true, msg.RequestID, nil})
 
-	h.subscriptions.KeyChanged(realKey, data)
+	h.subscriptions.KeyChanged(realKey, data, PushEventSet)
 	h.logger.Debug("modified key", zap.Int64("client", client.UID()), zap.String("key", realKey))
 }
 
@@ -175,23 +228,33 @@ func cmdRemoveKey(h *Hub, client Client, msg Request) {
 	// Check params
 	key, ok := msg.Data["key"].(string)
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'key' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'key' parameter")
+		return
+	}
+	if !requirePermission(h, client, msg, PermWrite, key) {
 		return
 	}
 
 	// Remap key if necessary
-	options := client.Options()
+	options := h.clientOptions(client)
 	realKey := options.Namespace + key
 
-	err := h.db.Delete(realKey)
+	unlock := h.locks.Lock(realKey)
+	defer unlock()
+
+	changes := h.recordChanges(client, msg.CmdName)
+	changes.before(realKey)
+
+	err := h.removeKey(realKey)
 	if err != nil {
-		sendErr(client, ErrServerError, err.Error(), msg.RequestID)
+		sendErr(h, client, msg, ErrServerError, err.Error())
 		return
 	}
+	changes.remove(realKey)
 	// Send OK response
 	client.SendJSON(Response{"response", true, msg.RequestID, nil})
 
-	h.subscriptions.KeyChanged(realKey, "")
+	h.subscriptions.KeyChanged(realKey, "", PushEventDelete)
 	h.logger.Debug("removed key", zap.Int64("client", client.UID()), zap.String("key", realKey))
 }
 
@@ -200,32 +263,131 @@ func cmdWriteBulk(h *Hub, client Client, msg Request) {
 		return
 	}
 
-	options := client.Options()
+	options := h.clientOptions(client)
 	// Copy data over
 	kvs := make(map[string]string)
+	keys := make([]string, 0, len(msg.Data))
 	for k, v := range msg.Data {
 		strval, ok := v.(string)
 		if !ok {
-			sendErr(client, ErrInvalidFmt, fmt.Sprintf("invalid value for key \"%s\"", k), msg.RequestID)
+			sendErr(h, client, msg, ErrInvalidFmt, fmt.Sprintf("invalid value for key \"%s\"", k))
+			return
+		}
+		if !requirePermission(h, client, msg, PermWrite, k) {
 			return
 		}
 		kvs[options.Namespace+k] = strval
+		keys = append(keys, options.Namespace+k)
 	}
 
-	err := h.db.SetBulk(kvs)
+	unlock := h.locks.Lock(keys...)
+	defer unlock()
+
+	changes := h.recordChanges(client, msg.CmdName)
+	changes.before(keys...)
+
+	err := h.writeBulk(kvs)
 	if err != nil {
-		sendErr(client, ErrServerError, err.Error(), msg.RequestID)
+		sendErr(h, client, msg, ErrServerError, err.Error())
 		return
 	}
+	for k, v := range kvs {
+		changes.set(k, v)
+	}
 	// Send OK response
 	client.SendJSON(Response{"response", true, msg.RequestID, nil})
 
 	for k, v := range kvs {
-		h.subscriptions.KeyChanged(k, v)
+		h.subscriptions.KeyChanged(k, v, PushEventSet)
 	}
 	h.logger.Debug("bulk modify keys", zap.Int64("client", client.UID()))
 }
 
+func cmdCompareAndSwap(h *Hub, client Client, msg Request) {
+	if !requireAuth(h, client, msg) {
+		return
+	}
+
+	// Check params
+	key, ok := msg.Data["key"].(string)
+	if !ok {
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'key' parameter")
+		return
+	}
+	if !requirePermission(h, client, msg, PermWrite, key) {
+		return
+	}
+	data, ok := msg.Data["data"].(string)
+	if !ok {
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'data' parameter")
+		return
+	}
+	revision, ok := revisionParam(msg.Data["revision"])
+	if !ok {
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'revision' parameter")
+		return
+	}
+	ttl, ok := ttlParam(msg.Data)
+	if !ok {
+		sendErr(h, client, msg, ErrMissingParam, "invalid 'ttl' parameter")
+		return
+	}
+
+	compareAndSwap(h, client, msg, key, data, revision, ttl)
+}
+
+func compareAndSwap(h *Hub, client Client, msg Request, key string, data string, revision uint64, ttl time.Duration) {
+	// Remap key if necessary
+	options := h.clientOptions(client)
+	realKey := options.Namespace + key
+
+	unlock := h.locks.Lock(realKey)
+	defer unlock()
+
+	changes := h.recordChanges(client, msg.CmdName)
+	changes.before(realKey)
+
+	newRevision, err := h.compareAndSet(realKey, data, revision, ttl)
+	if err != nil {
+		if err == ErrorRevisionMismatch {
+			sendErr(h, client, msg, ErrRevisionMismatch, fmt.Sprintf("key \"%s\" is not at revision %d", key, revision))
+		} else {
+			sendErr(h, client, msg, ErrServerError, err.Error())
+		}
+		return
+	}
+	changes.set(realKey, data)
+	// Send OK response with new revision
+	client.SendJSON(Response{"response", true, msg.RequestID, struct {
+		Revision uint64 `json:"revision"`
+	}{newRevision}})
+
+	h.subscriptions.KeyChanged(realKey, data, PushEventSet)
+	h.logger.Debug("modified key (compare and swap)", zap.Int64("client", client.UID()), zap.String("key", realKey), zap.Uint64("revision", newRevision))
+}
+
+// revisionParam reads a revision from a request parameter, which must be a non-negative integer
+func revisionParam(raw interface{}) (uint64, bool) {
+	revision, ok := raw.(float64)
+	if !ok || revision < 0 || revision != math.Trunc(revision) {
+		return 0, false
+	}
+	return uint64(revision), true
+}
+
+// ttlParam reads the optional 'ttl' parameter (in seconds), returning 0 if it's not present
+func ttlParam(data map[string]interface{}) (time.Duration, bool) {
+	raw, ok := data["ttl"]
+	if !ok {
+		return 0, true
+	}
+	seconds, ok := raw.(float64)
+	if !ok || seconds <= 0 || seconds > float64(math.MaxInt64/int64(time.Second)) {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
 func cmdSubscribeKey(h *Hub, client Client, msg Request) {
 	if !requireAuth(h, client, msg) {
 		return
@@ -234,12 +396,15 @@ func cmdSubscribeKey(h *Hub, client Client, msg Request) {
 	// Check params
 	key, ok := msg.Data["key"].(string)
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'key' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'key' parameter")
+		return
+	}
+	if !requirePermission(h, client, msg, PermSubscribe, key) {
 		return
 	}
 
 	// Remap key if necessary
-	options := client.Options()
+	options := h.clientOptions(client)
 	realKey := options.Namespace + key
 
 	h.subscriptions.SubscribeKey(client.UID(), realKey)
@@ -256,12 +421,15 @@ func cmdSubscribePrefix(h *Hub, client Client, msg Request) {
 	// Check params
 	prefix, ok := msg.Data["prefix"].(string)
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'prefix' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'prefix' parameter")
+		return
+	}
+	if !requirePrefixPermission(h, client, msg, PermSubscribe, prefix) {
 		return
 	}
 
 	// Remap key if necessary
-	options := client.Options()
+	options := h.clientOptions(client)
 	realPrefix := options.Namespace + prefix
 
 	h.subscriptions.SubscribePrefix(client.UID(), realPrefix)
@@ -278,12 +446,12 @@ func cmdUnsubscribeKey(h *Hub, client Client, msg Request) {
 	// Check params
 	key, ok := msg.Data["key"].(string)
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'key' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'key' parameter")
 		return
 	}
 
 	// Remap key if necessary
-	options := client.Options()
+	options := h.clientOptions(client)
 	realKey := options.Namespace + key
 
 	h.subscriptions.UnsubscribeKey(client.UID(), realKey)
@@ -300,12 +468,12 @@ func cmdUnsubscribePrefix(h *Hub, client Client, msg Request) {
 	// Check params
 	prefix, ok := msg.Data["prefix"].(string)
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'prefix' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'prefix' parameter")
 		return
 	}
 
 	// Remap key if necessary
-	options := client.Options()
+	options := h.clientOptions(client)
 	realPrefix := options.Namespace + prefix
 
 	// Add to prefix subscriber map
@@ -336,18 +504,26 @@ func cmdListKeys(h *Hub, client Client, msg Request) {
 		prefix, _ = prefixRaw.(string)
 	}
 
+	if !requirePrefixPermission(h, client, msg, PermList, prefix) {
+		return
+	}
+
 	// Remap key if necessary
-	options := client.Options()
+	options := h.clientOptions(client)
 	realPrefix := options.Namespace + prefix
 
-	out, err := h.db.List(realPrefix)
+	keys, err := h.db.List(realPrefix)
 	if err != nil {
-		sendErr(client, ErrServerError, err.Error(), msg.RequestID)
+		sendErr(h, client, msg, ErrServerError, err.Error())
 		return
 	}
-	// If no keys are found, return empty array instead of null
-	if len(out) < 1 {
-		out = []string{}
+
+	// Leave out keys the client can't list (if no keys are found, return empty array instead of null)
+	out := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if options.ACL.Allows(key[len(options.Namespace):], PermList) {
+			out = append(out, key)
+		}
 	}
 	h.logger.Debug("list keys", zap.Int64("client", client.UID()), zap.String("prefix", prefix))
 	client.SendJSON(Response{"response", true, msg.RequestID, out})
@@ -355,7 +531,13 @@ func cmdListKeys(h *Hub, client Client, msg Request) {
 
 func cmdAuthRequest(h *Hub, client Client, msg Request) {
 	if h.authRequired() == false {
-		sendErr(client, ErrAuthNotRequired, "authentication is not required", msg.RequestID)
+		sendErr(h, client, msg, ErrAuthNotRequired, "authentication is not required")
+		return
+	}
+	if !requireUnauthenticated(h, client, msg) {
+		return
+	}
+	if !allowAuthAttempt(h, client, msg) {
 		return
 	}
 
@@ -366,8 +548,8 @@ func cmdAuthRequest(h *Hub, client Client, msg Request) {
 		if ok {
 			challengeTypeStr, ok := challengeTypeRaw.(string)
 			challengeType = AuthType(challengeTypeStr)
-			if !ok || challengeType != AuthTypeChallenge && challengeType != AuthTypeInteractive {
-				sendErr(client, ErrInvalidFmt, "invalid 'auth' parameter", msg.RequestID)
+			if !ok || challengeType != AuthTypeChallenge && challengeType != AuthTypeInteractive && challengeType != AuthTypeToken && challengeType != AuthTypeScram {
+				sendErr(h, client, msg, ErrInvalidFmt, "invalid 'auth' parameter")
 				return
 			}
 		}
@@ -375,26 +557,201 @@ func cmdAuthRequest(h *Hub, client Client, msg Request) {
 
 	switch challengeType {
 	case AuthTypeChallenge:
-		if h.options.Password == "" {
-			sendErr(client, ErrAuthNotSupported, "challenge auth not available", msg.RequestID)
+		username, _ := msg.Data["username"].(string)
+		switch {
+		case username != "" && h.options.Users == nil:
+			sendErr(h, client, msg, ErrAuthNotSupported, "user authentication not available")
+			return
+		case username == "" && h.options.Password == "":
+			if h.options.Users == nil {
+				sendErr(h, client, msg, ErrAuthNotSupported, "challenge auth not available")
+			} else {
+				sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'username' parameter")
+			}
 			return
 		}
-		sendChallenge(h, client, msg)
+		sendChallenge(h, client, msg, username)
 	case AuthTypeInteractive:
 		if h.interactiveFn == nil {
-			sendErr(client, ErrAuthNotSupported, "interactive auth not available", msg.RequestID)
+			sendErr(h, client, msg, ErrAuthNotSupported, "interactive auth not available")
 			return
 		}
 		// This can take forever, so run in a goroutine
 		go sendInteractiveRequest(h, client, msg)
+	case AuthTypeToken:
+		authenticateToken(h, client, msg)
+	case AuthTypeScram:
+		sendScramChallenge(h, client, msg)
+	}
+}
+
+func sendScramChallenge(h *Hub, client Client, msg Request) {
+	clientNonce, ok := msg.Data["nonce"].(string)
+	if !ok || !validScramNonce(clientNonce) {
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'nonce' parameter")
+		return
+	}
+
+	username, _ := msg.Data["username"].(string)
+	challenge := authChallenge{User: username}
+	var verifier ScramVerifier
+	switch {
+	case username != "":
+		if h.options.Users == nil {
+			sendErr(h, client, msg, ErrAuthNotSupported, "user authentication not available")
+			return
+		}
+		// Unknown users still get a (stable) salt, so clients can't tell which users exist
+		user, err := h.options.Users.GetUser(username)
+		if err != nil && err != ErrUserNotFound {
+			sendErr(h, client, msg, ErrServerError, err.Error())
+			return
+		}
+		verifier, ok = h.scramVerifier(user.Verifier, user.Password, username)
+		challenge.UnknownUser = err == ErrUserNotFound || !ok
+	case h.options.PasswordVerifier != nil || h.options.Password != "":
+		verifier, _ = h.scramVerifier(h.options.PasswordVerifier, h.options.Password, "")
+	case h.options.Users == nil:
+		sendErr(h, client, msg, ErrAuthNotSupported, "scram auth not available")
+		return
+	default:
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'username' parameter")
+		return
+	}
+
+	exchange, nonce := newScramExchange(username, clientNonce, base64.StdEncoding.EncodeToString(h.randomBytes()), verifier)
+	challenge.Scram = &exchange
+	challenge.Expires = time.Now().Add(h.options.challengeTimeout())
+	_ = h.clients.SetChallenge(client.UID(), challenge)
+
+	client.SendJSON(Response{"response", true, msg.RequestID, struct {
+		Nonce      string `json:"nonce"`
+		Salt       string `json:"salt"`
+		Iterations int    `json:"iterations"`
+	}{
+		nonce,
+		base64.StdEncoding.EncodeToString(verifier.Salt),
+		verifier.Iterations,
+	}})
+}
+
+// scramVerifier returns the stored verifier for a password, or derives one from the plaintext
+// password if there's none. If neither are set it returns a verifier nothing can match.
+//
+// A verifier is derived every time, even if it's not used, so how long this takes doesn't tell
+// clients whether a user exists or how its password is stored.
+func (h *Hub) scramVerifier(verifier *ScramVerifier, password string, username string) (ScramVerifier, bool) {
+	secret := password
+	if secret == "" {
+		// Nobody knows this one
+		secret = base64.StdEncoding.EncodeToString(hmacSHA256(h.secret, []byte("scram-unknown:"+username)))
+	}
+	derived := deriveScramVerifier(secret, h.scramSalt(username), ScramIterations)
+	switch {
+	case verifier != nil:
+		return *verifier, true
+	case password != "":
+		return derived, true
+	default:
+		return derived, false
 	}
 }
 
-func sendChallenge(h *Hub, client Client, msg Request) {
+// scramSalt returns a salt that doesn't change for the lifetime of the hub
+func (h *Hub) scramSalt(username string) []byte {
+	return hmacSHA256(h.secret, []byte("scram-salt:"+username))[:16]
+}
+
+func cmdScramProof(h *Hub, client Client, msg Request, challengeData authChallenge) {
+	proofStr, ok := msg.Data["proof"].(string)
+	if !ok {
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'proof' parameter")
+		return
+	}
+	proof, err := base64.StdEncoding.DecodeString(proofStr)
+	if err != nil {
+		sendErr(h, client, msg, ErrInvalidFmt, "invalid 'proof' parameter")
+		return
+	}
+
+	signature, ok := challengeData.Scram.Verify(proof)
+	if !ok || challengeData.UnknownUser {
+		authFailed(h, client, msg, AuthTypeScram, challengeData.User)
+		return
+	}
+
+	if challengeData.User != "" {
+		user, err := h.options.Users.GetUser(challengeData.User)
+		switch {
+		case err == ErrUserNotFound:
+			// User was removed after the challenge was sent
+			authFailed(h, client, msg, AuthTypeScram, challengeData.User)
+			return
+		case err != nil:
+			sendErr(h, client, msg, ErrServerError, err.Error())
+			return
+		}
+		if !applyUser(h, client, msg, AuthTypeScram, user) {
+			return
+		}
+	}
+
+	session := authSucceeded(h, client, AuthTypeScram, challengeData.User)
+
+	// Send the server signature so the client can check we know its password too
+	client.SendJSON(Response{"response", true, msg.RequestID, authResponse{
+		Signature: base64.StdEncoding.EncodeToString(signature),
+		Session:   session,
+	}})
+}
+
+func authenticateToken(h *Hub, client Client, msg Request) {
+	if h.options.Tokens == nil {
+		sendErr(h, client, msg, ErrAuthNotSupported, "token auth not available")
+		return
+	}
+	str, ok := msg.Data["token"].(string)
+	if !ok || str == "" {
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'token' parameter")
+		return
+	}
+
+	token, err := h.options.Tokens.ValidateToken(str)
+	switch err {
+	case nil:
+	case ErrTokenNotFound, ErrTokenExpired, ErrInvalidToken:
+		authFailed(h, client, msg, AuthTypeToken, "")
+		return
+	default:
+		sendErr(h, client, msg, ErrServerError, err.Error())
+		return
+	}
+
+	user := "token:" + token.ID
+	_ = h.clients.SetUser(client.UID(), user, token.Namespace, token.Scopes)
+	_ = h.clients.SetToken(client.UID(), str, token.ExpiresAt)
+	session := authSucceeded(h, client, AuthTypeToken, user)
+
+	client.SendJSON(Response{"response", true, msg.RequestID, authResponse{Session: session}})
+}
+
+func sendChallenge(h *Hub, client Client, msg Request, username string) {
 	// Create challenge
 	challenge := authChallenge{
 		Challenge: h.randomBytes(),
 		Salt:      h.randomBytes(),
+		User:      username,
+		Expires:   time.Now().Add(h.options.challengeTimeout()),
+	}
+	if username != "" {
+		// Unknown users still get a challenge, so clients can't tell which users exist
+		if _, err := h.options.Users.GetUser(username); err != nil {
+			if err != ErrUserNotFound {
+				sendErr(h, client, msg, ErrServerError, err.Error())
+				return
+			}
+			challenge.UnknownUser = true
+		}
 	}
 	_ = h.clients.SetChallenge(client.UID(), challenge)
 
@@ -410,51 +767,165 @@ func sendChallenge(h *Hub, client Client, msg Request) {
 
 func sendInteractiveRequest(h *Hub, client Client, msg Request) {
 	if h.interactiveFn(client, msg.Data) == false {
-		sendErr(client, ErrAuthFailed, "authentication failed", msg.RequestID)
+		authFailed(h, client, msg, AuthTypeInteractive, "")
 		return
 	}
-	_ = h.clients.SetAuthenticated(client.UID(), true)
-	client.SendJSON(Response{"response", true, msg.RequestID, nil})
+	// The client might have disconnected while waiting
+	if !h.clients.Has(client) {
+		return
+	}
+	session := authSucceeded(h, client, AuthTypeInteractive, "")
+	client.SendJSON(Response{"response", true, msg.RequestID, authResponse{Session: session}})
 }
 
 func cmdAuthChallenge(h *Hub, client Client, msg Request) {
+	if !requireUnauthenticated(h, client, msg) {
+		return
+	}
+	if !allowAuthAttempt(h, client, msg) {
+		return
+	}
+
+	// Challenges can only be used once, whatever the outcome
+	challengeData, ok := h.clients.TakeChallenge(client.UID())
+	if !ok {
+		sendErr(h, client, msg, ErrAuthNotInit, "you must start an authentication challenge first")
+		return
+	}
+	if time.Now().After(challengeData.Expires) {
+		sendErr(h, client, msg, ErrAuthNotInit, "authentication challenge expired, start a new one")
+		return
+	}
+
+	// SCRAM proofs are submitted with kauth too
+	if challengeData.Scram != nil {
+		cmdScramProof(h, client, msg, challengeData)
+		return
+	}
+
 	// Check params
 	challenge, ok := msg.Data["hash"].(string)
 	if !ok {
-		sendErr(client, ErrMissingParam, "invalid or missing 'challenge' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'challenge' parameter")
 		return
 	}
 
 	// Decode challenge
 	challengeBytes, err := base64.StdEncoding.DecodeString(challenge)
 	if err != nil {
-		sendErr(client, ErrInvalidFmt, "invalid 'challenge' parameter", msg.RequestID)
+		sendErr(h, client, msg, ErrInvalidFmt, "invalid 'challenge' parameter")
 		return
 	}
 
-	// Get UID
-	uid := client.UID()
-
 	// Generate hash
-	challengeData, err := h.clients.Challenge(uid)
-	if err != nil {
-		sendErr(client, ErrAuthNotInit, "you must start an authentication challenge first", msg.RequestID)
-		return
+	password := h.options.Password
+	var user User
+	if challengeData.User != "" && !challengeData.UnknownUser {
+		user, err = h.options.Users.GetUser(challengeData.User)
+		if err != nil && err != ErrUserNotFound {
+			sendErr(h, client, msg, ErrServerError, err.Error())
+			return
+		}
+		// User might have been removed after the challenge was sent, users with only
+		// a SCRAM verifier can't use challenge auth
+		challengeData.UnknownUser = err == ErrUserNotFound || user.Password == ""
+		password = user.Password
 	}
-	hash := hmac.New(sha256.New, append([]byte(h.options.Password), challengeData.Salt...))
+	hash := hmac.New(sha256.New, append([]byte(password), challengeData.Salt...))
 	hash.Write(challengeData.Challenge)
 	hashBytes := hash.Sum(nil)
 
 	// Check if hash matches
-	if subtle.ConstantTimeCompare(hashBytes, challengeBytes) != 1 {
-		sendErr(client, ErrAuthFailed, "authentication failed", msg.RequestID)
+	if subtle.ConstantTimeCompare(hashBytes, challengeBytes) != 1 || challengeData.UnknownUser {
+		authFailed(h, client, msg, AuthTypeChallenge, challengeData.User)
 		return
 	}
 
-	_ = h.clients.SetAuthenticated(uid, true)
+	if challengeData.User != "" && !applyUser(h, client, msg, AuthTypeChallenge, user) {
+		return
+	}
+
+	session := authSucceeded(h, client, AuthTypeChallenge, challengeData.User)
 
 	// Send OK response
-	client.SendJSON(Response{"response", true, msg.RequestID, nil})
+	client.SendJSON(Response{"response", true, msg.RequestID, authResponse{Session: session}})
+}
+
+// applyUser applies the namespace and permissions of the user a client authenticated as,
+// sending an error to the client if that's not possible
+func applyUser(h *Hub, client Client, msg Request, method AuthType, user User) bool {
+	namespace, acl, ok := h.userOptions(user, h.clientOptions(client))
+	if !ok {
+		h.logger.Warn("user has an unknown role", zap.String("user", user.Name), zap.String("role", user.Role))
+		authFailed(h, client, msg, method, user.Name)
+		return false
+	}
+	_ = h.clients.SetUser(client.UID(), user.Name, namespace, acl)
+	return true
+}
+
+// requireUnauthenticated checks that a client hasn't authenticated yet, sending an error to the client
+// if it has. Authenticating again could move the client to another namespace and ACL while it keeps
+// subscriptions that were checked against the old ones, so clients have to klogout first.
+func requireUnauthenticated(h *Hub, client Client, msg Request) bool {
+	if !h.clients.Authenticated(client.UID()) {
+		return true
+	}
+	sendErr(h, client, msg, ErrAlreadyAuth, "already authenticated, log out first")
+	return false
+}
+
+// allowAuthAttempt checks that a client isn't locked out after too many failed
+// authentications, sending an error to the client if it is
+func allowAuthAttempt(h *Hub, client Client, msg Request) bool {
+	wait := h.authLimiter.lockedFor(client, time.Now())
+	if wait <= 0 {
+		return true
+	}
+	sendErr(h, client, msg, ErrAuthLocked, fmt.Sprintf("too many failed attempts, try again in %s", wait.Truncate(time.Millisecond)))
+	return false
+}
+
+// authFailed tells a client its authentication failed, locking it out for a while if it failed too many times
+func authFailed(h *Hub, client Client, msg Request, method AuthType, user string) {
+	lockout := h.authLimiter.fail(client, h.options, time.Now())
+	fields := authLogFields(client, method, user)
+	if lockout > 0 {
+		fields = append(fields, zap.Duration("lockout", lockout))
+	}
+	h.logger.Warn("authentication failed", fields...)
+	sendErr(h, client, msg, ErrAuthFailed, "authentication failed")
+}
+
+// authResponse is sent to clients that authenticated successfully
+type authResponse struct {
+	// Server signature, for SCRAM authentication
+	Signature string `json:"signature,omitempty"`
+
+	// Token to resume the session with after reconnecting
+	Session string `json:"session,omitempty"`
+}
+
+// authSucceeded marks a client as authenticated, forgetting its failed attempts,
+// and returns the token to resume its session with
+func authSucceeded(h *Hub, client Client, method AuthType, user string) string {
+	h.authLimiter.succeed(client)
+	_ = h.clients.SetAuthenticated(client.UID(), true)
+	h.logger.Info("authentication succeeded", authLogFields(client, method, user)...)
+	session := h.startSession(client)
+	h.clientAuthenticated(client, method)
+	return session
+}
+
+func authLogFields(client Client, method AuthType, user string) []zap.Field {
+	fields := []zap.Field{zap.Int64("client", client.UID()), zap.String("method", string(method))}
+	if user != "" {
+		fields = append(fields, zap.String("user", user))
+	}
+	if addr, ok := client.(remoteAddresser); ok {
+		fields = append(fields, zap.String("addr", addr.RemoteAddr()))
+	}
+	return fields
 }
 
 func requireAuth(h *Hub, client Client, msg Request) bool {
@@ -464,9 +935,34 @@ func requireAuth(h *Hub, client Client, msg Request) bool {
 	}
 
 	if !h.clients.Authenticated(client.UID()) {
-		sendErr(client, ErrAuthRequired, "authentication required", msg.RequestID)
+		sendErr(h, client, msg, ErrAuthRequired, "authentication required")
 		return false
 	}
 
-	return true
+	return requireValidToken(h, client, msg)
+}
+
+// requireValidToken checks that the token a client authenticated with (if any) hasn't expired or
+// been revoked since, logging the client out and sending it an error if it has
+func requireValidToken(h *Hub, client Client, msg Request) bool {
+	auth, _ := h.clients.AuthState(client.UID())
+	if auth.token == "" {
+		return true
+	}
+
+	var err error = ErrTokenNotFound
+	if h.options.Tokens != nil {
+		_, err = h.options.Tokens.ValidateToken(auth.token)
+	}
+	switch err {
+	case nil:
+		return true
+	case ErrTokenNotFound, ErrTokenExpired, ErrInvalidToken:
+		h.logout(client.UID())
+		h.logger.Info("token expired or revoked, logging client out", authLogFields(client, AuthTypeToken, auth.user)...)
+		sendErr(h, client, msg, ErrAuthRequired, "token expired or revoked, authentication required")
+	default:
+		sendErr(h, client, msg, ErrServerError, err.Error())
+	}
+	return false
 }
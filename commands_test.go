@@ -4,6 +4,8 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,11 +16,14 @@ const test_namespace = "@test/"
 
 func makeHubClient(t *testing.T, test func(hub *Hub, client *LocalClient)) {
 	log, _ := zap.NewDevelopment()
-	hub := createInMemoryHub(t, log)
+	makeHubClientWith(t, createInMemoryHub(t, log), log, test)
+}
+
+func makeHubClientWith(t *testing.T, hub *Hub, log *zap.Logger, test func(hub *Hub, client *LocalClient)) {
 	defer hub.Close()
 	go hub.Run()
 
-	client := NewLocalClient(ClientOptions{test_namespace}, log)
+	client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
 	defer client.Close()
 	go client.Run()
 
@@ -92,7 +97,8 @@ func TestKeyGet(t *testing.T) {
 		hub.SendMessage(req)
 		resp := mustSucceed(t, waitReply(t, chn))
 		// Check that reply is correct
-		if resp.Data.(string) != "test-value" {
+		value := resp.Data.(map[string]interface{})
+		if value["value"] != "test-value" || value["exists"] != true {
 			t.Fatalf("response value for kget expected to be \"testvalue\", got \"%v\"", resp.Data)
 		}
 	})
@@ -132,7 +138,7 @@ func TestKeyGetBulk(t *testing.T) {
 		prepareKey(t, hub, "key1", "value1")
 		prepareKey(t, hub, "key2", "value2")
 		req, chn := client.MakeRequest(CmdReadBulk, map[string]interface{}{
-			"keys": []string{"key1", "key2"},
+			"keys": []string{"key1", "key2", "missing"},
 		})
 		hub.SendMessage(req)
 		resp := mustSucceed(t, waitReply(t, chn))
@@ -141,6 +147,42 @@ func TestKeyGetBulk(t *testing.T) {
 		if values["key1"].(string) != "value1" || values["key2"].(string) != "value2" {
 			t.Fatal("response values are different from what expected", values)
 		}
+		if _, ok := values["missing"]; ok {
+			t.Fatal("missing key should not be in the response", values)
+		}
+	})
+}
+
+// legacyBulkDriver fills in missing keys with empty values in GetBulk, like drivers written for older versions
+type legacyBulkDriver struct {
+	Driver
+}
+
+func (d legacyBulkDriver) GetBulk(keys []string) (map[string]string, error) {
+	results := make(map[string]string)
+	for _, key := range keys {
+		results[key], _ = d.Get(key)
+	}
+	return results, nil
+}
+
+func TestKeyGetBulkLegacyDriver(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub, err := NewHub(legacyBulkDriver{MakeBackend()}, HubOptions{}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeHubClientWith(t, hub, log, func(hub *Hub, client *LocalClient) {
+		prepareKey(t, hub, "key", "value")
+		prepareKey(t, hub, "empty", "")
+		req, chn := client.MakeRequest(CmdReadBulk, map[string]interface{}{
+			"keys": []string{"key", "empty", "missing"},
+		})
+		hub.SendMessage(req)
+		values := mustSucceed(t, waitReply(t, chn)).Data.(map[string]interface{})
+		if len(values) != 2 || values["key"] != "value" || values["empty"] != "" {
+			t.Fatal("missing keys should be left out, empty ones kept", values)
+		}
 	})
 }
 
@@ -169,15 +211,317 @@ func TestKeyGetEmpty(t *testing.T) {
 		hub.SendMessage(req)
 		resp := mustSucceed(t, waitReply(t, chn))
 		// Check that reply is correct (empty)
-		if resp.Data.(string) != "" {
+		value := resp.Data.(map[string]interface{})
+		if value["value"] != "" || value["exists"] != false {
 			t.Fatalf("response value for kget expected to be empty, got \"%v\"", resp.Data)
 		}
 	})
 }
 
+func TestCompareAndSwap(t *testing.T) {
+	test := func(hub *Hub, client *LocalClient) {
+		// Create key only if it doesn't exist
+		req, chn := client.MakeRequest(CmdWriteKey, map[string]interface{}{
+			"key":         "test",
+			"data":        "first",
+			"if_revision": 0,
+		})
+		hub.SendMessage(req)
+		resp := mustSucceed(t, waitReply(t, chn))
+		firstRevision := resp.Data.(map[string]interface{})["revision"].(float64)
+
+		// Read revision back
+		req, chn = client.MakeRequest(CmdReadKey, map[string]interface{}{
+			"key":      "test",
+			"revision": true,
+		})
+		hub.SendMessage(req)
+		resp = mustSucceed(t, waitReply(t, chn))
+		value := resp.Data.(map[string]interface{})
+		if value["value"] != "first" || value["revision"].(float64) != firstRevision {
+			t.Fatalf("unexpected kget response: %v", value)
+		}
+
+		// Trying to create it again must fail
+		req, chn = client.MakeRequest(CmdCompareAndSwap, map[string]interface{}{
+			"key":      "test",
+			"data":     "nope",
+			"revision": 0,
+		})
+		hub.SendMessage(req)
+		if err := mustFail(t, waitReply(t, chn)); err.Error != ErrRevisionMismatch {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrRevisionMismatch, err.Error)
+		}
+
+		// Swap with the right revision
+		req, chn = client.MakeRequest(CmdCompareAndSwap, map[string]interface{}{
+			"key":      "test",
+			"data":     "second",
+			"revision": firstRevision,
+		})
+		hub.SendMessage(req)
+		resp = mustSucceed(t, waitReply(t, chn))
+		if resp.Data.(map[string]interface{})["revision"].(float64) <= firstRevision {
+			t.Fatal("revision did not increase after write")
+		}
+		assertKey(t, hub, "test", "second")
+
+		// Unconditional writes still bump the revision, so the old one must not work anymore
+		req, chn = client.MakeRequest(CmdWriteKey, map[string]interface{}{
+			"key":  "test",
+			"data": "third",
+		})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+		req, chn = client.MakeRequest(CmdCompareAndSwap, map[string]interface{}{
+			"key":      "test",
+			"data":     "nope",
+			"revision": firstRevision,
+		})
+		hub.SendMessage(req)
+		mustFail(t, waitReply(t, chn))
+		assertKey(t, hub, "test", "third")
+	}
+
+	t.Run("driver revisions", func(t *testing.T) {
+		makeHubClient(t, test)
+	})
+
+	t.Run("hub revisions", func(t *testing.T) {
+		log, _ := zap.NewDevelopment()
+		hub, err := NewHub(MakeBackend(), HubOptions{}, log)
+		if err != nil {
+			t.Fatal("hub initialization failed", err.Error())
+		}
+		makeHubClientWith(t, hub, log, test)
+	})
+}
+
+func TestKeyExpiry(t *testing.T) {
+	makeHubClient(t, func(hub *Hub, client *LocalClient) {
+		res := make(chan []string, 10)
+		cid := client.SetPrefixSubCallback("ttl-", func(key string, data string) {
+			res <- []string{key, data}
+		})
+		defer client.UnsetCallback(cid)
+
+		req, chn := client.MakeRequest(CmdSubscribePrefix, map[string]interface{}{
+			"prefix": "ttl-",
+		})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+
+		// Both keys get a TTL, but the second one is then overwritten without one
+		for _, key := range []string{"ttl-expire", "ttl-keep"} {
+			req, chn = client.MakeRequest(CmdWriteKey, map[string]interface{}{
+				"key":  key,
+				"data": "value",
+				"ttl":  0.05,
+			})
+			hub.SendMessage(req)
+			mustSucceed(t, waitReply(t, chn))
+		}
+		req, chn = client.MakeRequest(CmdWriteKey, map[string]interface{}{
+			"key":  "ttl-keep",
+			"data": "new value",
+		})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+
+		// Wait for the expiry push
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case <-timeout:
+				t.Fatal("expiry push took too long to arrive")
+			case push := <-res:
+				if push[0] != "ttl-expire" || push[1] != "" {
+					continue
+				}
+			}
+			break
+		}
+
+		if _, err := hub.db.Get(test_namespace + "ttl-expire"); err != ErrorKeyNotFound {
+			t.Fatal("expired key is still in the database")
+		}
+		assertKey(t, hub, "ttl-keep", "new value")
+	})
+}
+
+func TestTransaction(t *testing.T) {
+	test := func(hub *Hub, client *LocalClient) {
+		prepareKey(t, hub, "tx-counter", "1")
+		prepareKey(t, hub, "tx-old", "remove me")
+
+		// Compare, write and read back in the same transaction
+		req, chn := client.MakeRequest(CmdTransaction, map[string]interface{}{
+			"ops": []interface{}{
+				map[string]interface{}{"op": "compare", "key": "tx-counter", "value": "1"},
+				map[string]interface{}{"op": "compare", "key": "tx-new", "exists": false},
+				map[string]interface{}{"op": "set", "key": "tx-counter", "data": "2"},
+				map[string]interface{}{"op": "set", "key": "tx-new", "data": "new"},
+				map[string]interface{}{"op": "delete", "key": "tx-old"},
+				map[string]interface{}{"op": "get", "key": "tx-counter"},
+				map[string]interface{}{"op": "get", "key": "tx-old"},
+			},
+		})
+		hub.SendMessage(req)
+		resp := mustSucceed(t, waitReply(t, chn))
+		results := resp.Data.([]interface{})
+		if len(results) != 7 {
+			t.Fatalf("expected 7 results, got %d", len(results))
+		}
+		if counter := results[5].(map[string]interface{}); counter["value"] != "2" || counter["exists"] != true {
+			t.Fatalf("transaction did not read its own write: %v", counter)
+		}
+		if old := results[6].(map[string]interface{}); old["exists"] != false {
+			t.Fatalf("transaction did not read its own delete: %v", old)
+		}
+		assertKey(t, hub, "tx-counter", "2")
+		assertKey(t, hub, "tx-new", "new")
+		if _, err := hub.db.Get(test_namespace + "tx-old"); err != ErrorKeyNotFound {
+			t.Fatal("deleted key is still in the database")
+		}
+
+		// A failed comparison must not write anything
+		req, chn = client.MakeRequest(CmdTransaction, map[string]interface{}{
+			"ops": []interface{}{
+				map[string]interface{}{"op": "set", "key": "tx-new", "data": "overwritten"},
+				map[string]interface{}{"op": "compare", "key": "tx-counter", "value": "1"},
+			},
+		})
+		hub.SendMessage(req)
+		if err := mustFail(t, waitReply(t, chn)); err.Error != ErrCompareFailed {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrCompareFailed, err.Error)
+		}
+		assertKey(t, hub, "tx-new", "new")
+
+		// Keys written in the transaction have no revision to compare against
+		req, chn = client.MakeRequest(CmdTransaction, map[string]interface{}{
+			"ops": []interface{}{
+				map[string]interface{}{"op": "set", "key": "tx-pending", "data": "value"},
+				map[string]interface{}{"op": "compare", "key": "tx-pending", "revision": 0},
+			},
+		})
+		hub.SendMessage(req)
+		mustFail(t, waitReply(t, chn))
+		if _, err := hub.db.Get(test_namespace + "tx-pending"); err != ErrorKeyNotFound {
+			t.Fatal("aborted transaction wrote to the database")
+		}
+	}
+
+	t.Run("batch driver", func(t *testing.T) {
+		makeHubClient(t, test)
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		log, _ := zap.NewDevelopment()
+		hub, err := NewHub(MakeBackend(), HubOptions{}, log)
+		if err != nil {
+			t.Fatal("hub initialization failed", err.Error())
+		}
+		makeHubClientWith(t, hub, log, test)
+	})
+}
+
+func TestPermissions(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub := createInMemoryHub(t, log)
+	defer hub.Close()
+	go hub.Run()
+
+	client := NewLocalClient(ClientOptions{
+		Namespace: test_namespace,
+		ACL: ACL{
+			{Pattern: "public/*", Permissions: PermRead | PermSubscribe | PermList},
+			{Pattern: "public/mine", Permissions: PermWrite},
+		},
+	}, log)
+	defer client.Close()
+	go client.Run()
+
+	hub.AddClient(client)
+	client.Wait()
+	defer hub.RemoveClient(client)
+
+	prepareKey(t, hub, "public/other", "other")
+	prepareKey(t, hub, "private", "secret")
+
+	denied := map[string]map[string]interface{}{
+		CmdReadKey:         {"key": "private"},
+		CmdReadBulk:        {"keys": []interface{}{"public/other", "private"}},
+		CmdReadPrefix:      {"prefix": "priv"},
+		CmdWriteKey:        {"key": "public/other", "data": "nope"},
+		CmdWriteBulk:       {"public/mine": "ok", "public/other": "nope"},
+		CmdCompareAndSwap:  {"key": "public/other", "data": "nope", "revision": 0},
+		CmdRemoveKey:       {"key": "public/other"},
+		CmdSubscribeKey:    {"key": "private"},
+		CmdSubscribePrefix: {"prefix": "priv"},
+		CmdListKeys:        {"prefix": "priv"},
+		CmdTransaction: {"ops": []interface{}{
+			map[string]interface{}{"op": "get", "key": "public/other"},
+			map[string]interface{}{"op": "set", "key": "public/other", "data": "nope"},
+		}},
+	}
+	for cmd, data := range denied {
+		req, chn := client.MakeRequest(cmd, data)
+		hub.SendMessage(req)
+		if resp := mustFail(t, waitReply(t, chn)); resp.Error != ErrPermissionDenied {
+			t.Errorf("expected %s to fail with \"%s\", got \"%s\"", cmd, ErrPermissionDenied, resp.Error)
+		}
+	}
+	assertKey(t, hub, "public/other", "other")
+
+	req, chn := client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "public/mine", "data": "mine"})
+	hub.SendMessage(req)
+	mustSucceed(t, waitReply(t, chn))
+
+	// Prefix reads only return keys the client can read
+	req, chn = client.MakeRequest(CmdReadPrefix, map[string]interface{}{"prefix": ""})
+	hub.SendMessage(req)
+	resp := mustSucceed(t, waitReply(t, chn))
+	if values := resp.Data.(map[string]interface{}); len(values) != 2 || values["private"] != nil {
+		t.Fatalf("unexpected prefix read result: %v", values)
+	}
+
+	// Permissions can be replaced after connecting
+	if err := hub.SetACL(client.UID(), ACL{{Pattern: "*", Permissions: PermRead}}); err != nil {
+		t.Fatal(err)
+	}
+	req, chn = client.MakeRequest(CmdReadKey, map[string]interface{}{"key": "private"})
+	hub.SendMessage(req)
+	mustSucceed(t, waitReply(t, chn))
+	req, chn = client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "public/mine", "data": "nope"})
+	hub.SendMessage(req)
+	mustFail(t, waitReply(t, chn))
+}
+
+func TestPermissionsAfterLogout(t *testing.T) {
+	makeHubClient(t, func(hub *Hub, client *LocalClient) {
+		prepareKey(t, hub, "secret", "secret")
+		if err := hub.SetACL(client.UID(), ACL{{Pattern: "public/*", Permissions: PermRead}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Logging out only drops what the client got by authenticating
+		for _, cmd := range []string{CmdWriteKey, CmdLogout, CmdWriteKey} {
+			req, chn := client.MakeRequest(cmd, map[string]interface{}{"key": "secret", "data": "nope"})
+			hub.SendMessage(req)
+			if cmd == CmdLogout {
+				mustSucceed(t, waitReply(t, chn))
+			} else if resp := mustFail(t, waitReply(t, chn)); resp.Error != ErrPermissionDenied {
+				t.Fatalf("expected \"%s\", got \"%s\"", ErrPermissionDenied, resp.Error)
+			}
+		}
+		assertKey(t, hub, "secret", "secret")
+	})
+}
+
 func TestErrorMissingParam(t *testing.T) {
 	noParams := []string{
-		CmdReadKey, CmdReadBulk, CmdReadPrefix, CmdWriteKey, CmdRemoveKey,
+		CmdReadKey, CmdReadBulk, CmdReadPrefix, CmdWriteKey, CmdRemoveKey, CmdCompareAndSwap,
+		CmdTransaction,
 		CmdSubscribeKey, CmdSubscribePrefix, CmdUnsubscribeKey, CmdUnsubscribePrefix,
 	}
 	for _, cmd := range noParams {
@@ -359,7 +703,7 @@ func TestChallengeAuthentication(t *testing.T) {
 	defer hub.Close()
 	go hub.Run()
 
-	client := NewLocalClient(ClientOptions{test_namespace}, log)
+	client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
 	defer client.Close()
 	go client.Run()
 
@@ -407,6 +751,729 @@ func TestChallengeAuthentication(t *testing.T) {
 	}
 }
 
+// authenticate runs challenge authentication with the given klogin parameters and password, returning the kauth reply
+func authenticate(t *testing.T, hub *Hub, client *LocalClient, login map[string]interface{}, password string) interface{} {
+	req, chn := client.MakeRequest(CmdAuthRequest, login)
+	hub.SendMessage(req)
+	data := mustSucceed(t, waitReply(t, chn)).Data.(map[string]interface{})
+
+	challengeBytes, _ := base64.StdEncoding.DecodeString(data["challenge"].(string))
+	saltBytes, _ := base64.StdEncoding.DecodeString(data["salt"].(string))
+	hash := hmac.New(sha256.New, append([]byte(password), saltBytes...))
+	hash.Write(challengeBytes)
+
+	req, chn = client.MakeRequest(CmdAuthChallenge, map[string]interface{}{
+		"hash": base64.StdEncoding.EncodeToString(hash.Sum(nil)),
+	})
+	hub.SendMessage(req)
+	return waitReply(t, chn)
+}
+
+func TestUserAuthentication(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{
+		Users: NewMemoryUserStore(
+			User{Name: "admin", Password: "admin-pass", Namespace: "@admin/"},
+			User{Name: "viewer", Password: "viewer-pass", Namespace: "@overlay/", Role: "viewer"},
+			User{Name: "broken", Password: "broken-pass", Role: "missing"},
+			User{Name: "plain", Password: "plain-pass"},
+		),
+		Roles: map[string]ACL{
+			"viewer": {{Pattern: "*", Permissions: PermRead | PermSubscribe}},
+		},
+	})
+	defer hub.Close()
+	go hub.Run()
+
+	connect := func() *LocalClient {
+		client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
+		go client.Run()
+		hub.AddClient(client)
+		client.Wait()
+		return client
+	}
+
+	t.Run("wrong credentials", func(t *testing.T) {
+		client := connect()
+		defer client.Close()
+
+		// A username is required when there's no hub password
+		req, chn := client.MakeRequest(CmdAuthRequest, map[string]interface{}{})
+		hub.SendMessage(req)
+		if resp := mustFail(t, waitReply(t, chn)); resp.Error != ErrMissingParam {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrMissingParam, resp.Error)
+		}
+
+		for _, login := range []struct{ user, password string }{
+			{"admin", "viewer-pass"},
+			{"nobody", "admin-pass"},
+			{"broken", "broken-pass"},
+		} {
+			resp := mustFail(t, authenticate(t, hub, client, map[string]interface{}{"username": login.user}, login.password))
+			if resp.Error != ErrAuthFailed {
+				t.Fatalf("expected \"%s\" for user %s, got \"%s\"", ErrAuthFailed, login.user, resp.Error)
+			}
+		}
+	})
+
+	t.Run("namespace and role", func(t *testing.T) {
+		client := connect()
+		defer client.Close()
+
+		mustSucceed(t, authenticate(t, hub, client, map[string]interface{}{"username": "viewer"}, "viewer-pass"))
+		if user, ok := hub.clients.User(client.UID()); !ok || user != "viewer" {
+			t.Fatalf("client should be authenticated as viewer, got %q", user)
+		}
+
+		if err := hub.db.Set("@overlay/title", "hello"); err != nil {
+			t.Fatal(err)
+		}
+		req, chn := client.MakeRequest(CmdReadKey, map[string]interface{}{"key": "title"})
+		hub.SendMessage(req)
+		resp := mustSucceed(t, waitReply(t, chn))
+		if value := resp.Data.(map[string]interface{}); value["value"] != "hello" {
+			t.Fatalf("user namespace not applied, got %v", value)
+		}
+
+		req, chn = client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "title", "data": "nope"})
+		hub.SendMessage(req)
+		if resp := mustFail(t, waitReply(t, chn)); resp.Error != ErrPermissionDenied {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrPermissionDenied, resp.Error)
+		}
+	})
+
+	t.Run("no role", func(t *testing.T) {
+		client := connect()
+		defer client.Close()
+
+		mustSucceed(t, authenticate(t, hub, client, map[string]interface{}{"username": "admin"}, "admin-pass"))
+		req, chn := client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "setting", "data": "on"})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+		if value, err := hub.db.Get("@admin/setting"); err != nil || value != "on" {
+			t.Fatalf("key not written in the user's namespace: %q (%v)", value, err)
+		}
+	})
+
+	t.Run("no role on a restricted connection", func(t *testing.T) {
+		client := NewLocalClient(ClientOptions{
+			Namespace: test_namespace,
+			ACL:       ACL{{Pattern: "public/*", Permissions: PermRead}},
+		}, log)
+		go client.Run()
+		hub.AddClient(client)
+		client.Wait()
+		defer client.Close()
+
+		// The user has neither a role nor a namespace, so the connection's are kept
+		mustSucceed(t, authenticate(t, hub, client, map[string]interface{}{"username": "plain"}, "plain-pass"))
+		prepareKey(t, hub, "public/title", "hello")
+		req, chn := client.MakeRequest(CmdReadKey, map[string]interface{}{"key": "public/title"})
+		hub.SendMessage(req)
+		if value := mustSucceed(t, waitReply(t, chn)).Data.(map[string]interface{}); value["value"] != "hello" {
+			t.Fatalf("connection namespace not kept, got %v", value)
+		}
+		req, chn = client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "secret", "data": "nope"})
+		hub.SendMessage(req)
+		if resp := mustFail(t, waitReply(t, chn)); resp.Error != ErrPermissionDenied {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrPermissionDenied, resp.Error)
+		}
+	})
+
+	t.Run("switching users", func(t *testing.T) {
+		client := connect()
+		defer client.Close()
+
+		mustSucceed(t, authenticate(t, hub, client, map[string]interface{}{"username": "admin"}, "admin-pass"))
+		req, chn := client.MakeRequest(CmdSubscribePrefix, map[string]interface{}{"prefix": ""})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+
+		// Logging in again would keep subscriptions made in the old namespace
+		req, chn = client.MakeRequest(CmdAuthRequest, map[string]interface{}{"username": "viewer"})
+		hub.SendMessage(req)
+		if resp := mustFail(t, waitReply(t, chn)); resp.Error != ErrAlreadyAuth {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrAlreadyAuth, resp.Error)
+		}
+
+		req, chn = client.MakeRequest(CmdLogout, nil)
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+		mustSucceed(t, authenticate(t, hub, client, map[string]interface{}{"username": "viewer"}, "viewer-pass"))
+		if keys, prefixes := hub.subscriptions.Subscriptions(client.UID()); len(keys) > 0 || len(prefixes) > 0 {
+			t.Fatalf("subscriptions should be dropped on logout, got %v %v", keys, prefixes)
+		}
+	})
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+
+	tokens := NewMemoryTokenStore()
+	scoped, _, err := tokens.Mint(Token{
+		Name:      "overlay",
+		Namespace: "@overlay/",
+		Scopes:    ACL{{Pattern: "*", Permissions: PermRead}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := tokens.Mint(Token{ExpiresAt: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{Tokens: tokens})
+	defer hub.Close()
+	go hub.Run()
+
+	client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
+	defer client.Close()
+	go client.Run()
+	hub.AddClient(client)
+	client.Wait()
+
+	login := func(token string) <-chan interface{} {
+		req, chn := client.MakeRequest(CmdAuthRequest, map[string]interface{}{
+			"auth":  AuthTypeToken,
+			"token": token,
+		})
+		hub.SendMessage(req)
+		return chn
+	}
+
+	for _, token := range []string{expired, "kvt_nope_nope", "garbage"} {
+		if resp := mustFail(t, waitReply(t, login(token))); resp.Error != ErrAuthFailed {
+			t.Fatalf("expected \"%s\" for token %s, got \"%s\"", ErrAuthFailed, token, resp.Error)
+		}
+	}
+	if hub.clients.Authenticated(client.UID()) {
+		t.Fatal("client authenticated with an invalid token")
+	}
+
+	mustSucceed(t, waitReply(t, login(scoped)))
+	if !hub.clients.Authenticated(client.UID()) {
+		t.Fatal("client not authenticated after token login")
+	}
+
+	if err := hub.db.Set("@overlay/title", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	req, chn := client.MakeRequest(CmdReadKey, map[string]interface{}{"key": "title"})
+	hub.SendMessage(req)
+	resp := mustSucceed(t, waitReply(t, chn))
+	if value := resp.Data.(map[string]interface{}); value["value"] != "hello" {
+		t.Fatalf("token namespace not applied, got %v", value)
+	}
+
+	req, chn = client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "title", "data": "nope"})
+	hub.SendMessage(req)
+	if resp := mustFail(t, waitReply(t, chn)); resp.Error != ErrPermissionDenied {
+		t.Fatalf("expected \"%s\", got \"%s\"", ErrPermissionDenied, resp.Error)
+	}
+}
+
+func TestTokenInvalidatedWhileConnected(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+
+	tokens := NewMemoryTokenStore()
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{Tokens: tokens})
+	defer hub.Close()
+	go hub.Run()
+
+	connect := func(token string) *LocalClient {
+		client := NewLocalClient(ClientOptions{}, log)
+		go client.Run()
+		hub.AddClient(client)
+		client.Wait()
+		req, chn := client.MakeRequest(CmdAuthRequest, map[string]interface{}{"auth": AuthTypeToken, "token": token})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+		return client
+	}
+	request := func(client *LocalClient, cmd string, data map[string]interface{}) interface{} {
+		req, chn := client.MakeRequest(cmd, data)
+		hub.SendMessage(req)
+		return waitReply(t, chn)
+	}
+	expectLoggedOut := func(client *LocalClient) {
+		if resp := mustFail(t, request(client, CmdReadKey, map[string]interface{}{"key": "title"})); resp.Error != ErrAuthRequired {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrAuthRequired, resp.Error)
+		}
+		if hub.clients.Authenticated(client.UID()) {
+			t.Fatal("client still authenticated")
+		}
+		if keys, _ := hub.subscriptions.Subscriptions(client.UID()); len(keys) > 0 {
+			t.Fatalf("subscriptions should be dropped, got %v", keys)
+		}
+	}
+
+	t.Run("revoked", func(t *testing.T) {
+		str, token, err := tokens.Mint(Token{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := connect(str)
+		defer client.Close()
+		mustSucceed(t, request(client, CmdSubscribeKey, map[string]interface{}{"key": "title"}))
+
+		if err := tokens.Revoke(token.ID); err != nil {
+			t.Fatal(err)
+		}
+		expectLoggedOut(client)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		str, token, err := tokens.Mint(Token{ExpiresAt: time.Now().Add(200 * time.Millisecond)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := connect(str)
+		defer client.Close()
+		mustSucceed(t, request(client, CmdSubscribeKey, map[string]interface{}{"key": "title"}))
+		pushes := make(chan string, 10)
+		client.SetKeySubCallback("title", func(key string, value string) {
+			pushes <- value
+		})
+
+		time.Sleep(time.Until(token.ExpiresAt))
+		if err := hub.Set("title", "expired"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case value := <-pushes:
+			t.Fatalf("push received after the token expired: %s", value)
+		case <-time.After(100 * time.Millisecond):
+		}
+		expectLoggedOut(client)
+	})
+}
+
+// scramAuthenticate runs a SCRAM exchange like a client would, checking the server signature on success
+func scramAuthenticate(t *testing.T, hub *Hub, client *LocalClient, username string, password string) interface{} {
+	clientNonce := "fyko+d2lbbFgONRv9qkxdawL"
+	req, chn := client.MakeRequest(CmdAuthRequest, map[string]interface{}{
+		"auth":     AuthTypeScram,
+		"username": username,
+		"nonce":    clientNonce,
+	})
+	hub.SendMessage(req)
+	data := mustSucceed(t, waitReply(t, chn)).Data.(map[string]interface{})
+
+	nonce := data["nonce"].(string)
+	if !strings.HasPrefix(nonce, clientNonce) || len(nonce) == len(clientNonce) {
+		t.Fatalf("server nonce must extend the client nonce, got %s", nonce)
+	}
+	salt, _ := base64.StdEncoding.DecodeString(data["salt"].(string))
+	iterations := int(data["iterations"].(float64))
+
+	verifier := deriveScramVerifier(password, salt, iterations)
+	authMessage := fmt.Sprintf("n=%s,r=%s,r=%s,s=%s,i=%d,c=biws,r=%s", username, clientNonce, nonce, data["salt"], iterations, nonce)
+	clientKey := hmacSHA256(scramSaltedPassword([]byte(password), salt, iterations), []byte("Client Key"))
+	clientSignature := hmacSHA256(verifier.StoredKey, []byte(authMessage))
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	req, chn = client.MakeRequest(CmdAuthChallenge, map[string]interface{}{
+		"proof": base64.StdEncoding.EncodeToString(proof),
+	})
+	hub.SendMessage(req)
+	reply := waitReply(t, chn)
+	if resp, ok := reply.(Response); ok {
+		signature := resp.Data.(map[string]interface{})["signature"]
+		expected := base64.StdEncoding.EncodeToString(hmacSHA256(verifier.ServerKey, []byte(authMessage)))
+		if signature != expected {
+			t.Fatalf("wrong server signature, expected %s, got %v", expected, signature)
+		}
+	}
+	return reply
+}
+
+func TestScramAuthentication(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+
+	hubVerifier, err := NewScramVerifier("hub-pass", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userVerifier, err := NewScramVerifier("viewer-pass", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{
+		PasswordVerifier: &hubVerifier,
+		Users: NewMemoryUserStore(
+			User{Name: "admin", Password: "admin-pass", Namespace: "@admin/"},
+			User{Name: "viewer", Verifier: &userVerifier, Namespace: "@overlay/"},
+		),
+	})
+	defer hub.Close()
+	go hub.Run()
+
+	connect := func() *LocalClient {
+		client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
+		go client.Run()
+		hub.AddClient(client)
+		client.Wait()
+		return client
+	}
+
+	t.Run("wrong credentials", func(t *testing.T) {
+		client := connect()
+		defer client.Close()
+
+		for _, login := range []struct{ user, password string }{
+			{"", "wrong"},
+			{"viewer", "admin-pass"},
+			{"nobody", "viewer-pass"},
+		} {
+			resp := mustFail(t, scramAuthenticate(t, hub, client, login.user, login.password))
+			if resp.Error != ErrAuthFailed {
+				t.Fatalf("expected \"%s\" for user %q, got \"%s\"", ErrAuthFailed, login.user, resp.Error)
+			}
+		}
+
+		// Users with only a verifier can't use challenge auth
+		resp := mustFail(t, authenticate(t, hub, client, map[string]interface{}{"username": "viewer"}, ""))
+		if resp.Error != ErrAuthFailed {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrAuthFailed, resp.Error)
+		}
+		if hub.clients.Authenticated(client.UID()) {
+			t.Fatal("client authenticated with wrong credentials")
+		}
+	})
+
+	t.Run("hub verifier", func(t *testing.T) {
+		client := connect()
+		defer client.Close()
+
+		mustSucceed(t, scramAuthenticate(t, hub, client, "", "hub-pass"))
+		if !hub.clients.Authenticated(client.UID()) {
+			t.Fatal("client not authenticated")
+		}
+	})
+
+	t.Run("user verifier", func(t *testing.T) {
+		client := connect()
+		defer client.Close()
+
+		mustSucceed(t, scramAuthenticate(t, hub, client, "viewer", "viewer-pass"))
+		if user, ok := hub.clients.User(client.UID()); !ok || user != "viewer" {
+			t.Fatalf("client should be authenticated as viewer, got %q", user)
+		}
+	})
+
+	t.Run("user password", func(t *testing.T) {
+		client := connect()
+		defer client.Close()
+
+		mustSucceed(t, scramAuthenticate(t, hub, client, "admin", "admin-pass"))
+		if user, ok := hub.clients.User(client.UID()); !ok || user != "admin" {
+			t.Fatalf("client should be authenticated as admin, got %q", user)
+		}
+	})
+}
+
+func TestAuthChallengeLifetime(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{Password: "password"})
+	defer hub.Close()
+	go hub.Run()
+
+	client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
+	defer client.Close()
+	go client.Run()
+	hub.AddClient(client)
+	client.Wait()
+
+	requestChallenge := func() string {
+		req, chn := client.MakeRequest(CmdAuthRequest, map[string]interface{}{})
+		hub.SendMessage(req)
+		data := mustSucceed(t, waitReply(t, chn)).Data.(map[string]interface{})
+		challengeBytes, _ := base64.StdEncoding.DecodeString(data["challenge"].(string))
+		saltBytes, _ := base64.StdEncoding.DecodeString(data["salt"].(string))
+		hash := hmac.New(sha256.New, append([]byte("password"), saltBytes...))
+		hash.Write(challengeBytes)
+		return base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	}
+	submit := func(hash string) interface{} {
+		req, chn := client.MakeRequest(CmdAuthChallenge, map[string]interface{}{"hash": hash})
+		hub.SendMessage(req)
+		return waitReply(t, chn)
+	}
+
+	if resp := mustFail(t, submit("")); resp.Error != ErrAuthNotInit {
+		t.Fatalf("expected \"%s\" without a challenge, got \"%s\"", ErrAuthNotInit, resp.Error)
+	}
+
+	// A failed attempt uses up the challenge
+	hash := requestChallenge()
+	mustFail(t, submit(base64.StdEncoding.EncodeToString([]byte("wrong"))))
+	if resp := mustFail(t, submit(hash)); resp.Error != ErrAuthNotInit {
+		t.Fatalf("expected \"%s\" when reusing a challenge, got \"%s\"", ErrAuthNotInit, resp.Error)
+	}
+
+	// Expired challenges can't be used
+	hub.SetOptions(HubOptions{Password: "password", ChallengeTimeout: time.Nanosecond})
+	hash = requestChallenge()
+	time.Sleep(time.Millisecond)
+	if resp := mustFail(t, submit(hash)); resp.Error != ErrAuthNotInit {
+		t.Fatalf("expected \"%s\" for an expired challenge, got \"%s\"", ErrAuthNotInit, resp.Error)
+	}
+
+	hub.SetOptions(HubOptions{Password: "password"})
+	mustSucceed(t, submit(requestChallenge()))
+}
+
+func TestAuthLockout(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{Password: "password", AuthMaxFailures: 2, AuthLockout: time.Hour})
+	defer hub.Close()
+	go hub.Run()
+
+	connect := func(addr string) addrClient {
+		client := addrClient{NewLocalClient(ClientOptions{Namespace: test_namespace}, log), addr}
+		go client.Run()
+		hub.AddClient(client)
+		client.Wait()
+		return client
+	}
+	login := func(client addrClient, password string) interface{} {
+		// Messages must come from the wrapper for the hub to see the address
+		req, chn := client.MakeRequest(CmdAuthRequest, map[string]interface{}{})
+		req.Client = client
+		hub.SendMessage(req)
+		reply := waitReply(t, chn)
+		resp, ok := reply.(Response)
+		if !ok {
+			return reply
+		}
+		data := resp.Data.(map[string]interface{})
+		challengeBytes, _ := base64.StdEncoding.DecodeString(data["challenge"].(string))
+		saltBytes, _ := base64.StdEncoding.DecodeString(data["salt"].(string))
+		hash := hmac.New(sha256.New, append([]byte(password), saltBytes...))
+		hash.Write(challengeBytes)
+		req, chn = client.MakeRequest(CmdAuthChallenge, map[string]interface{}{
+			"hash": base64.StdEncoding.EncodeToString(hash.Sum(nil)),
+		})
+		req.Client = client
+		hub.SendMessage(req)
+		return waitReply(t, chn)
+	}
+
+	client := connect("192.0.2.1:4000")
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		if resp := mustFail(t, login(client, "wrong")); resp.Error != ErrAuthFailed {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrAuthFailed, resp.Error)
+		}
+	}
+	if resp := mustFail(t, login(client, "password")); resp.Error != ErrAuthLocked {
+		t.Fatalf("expected \"%s\" after too many failures, got \"%s\"", ErrAuthLocked, resp.Error)
+	}
+
+	// Reconnecting from the same address doesn't help
+	sameAddr := connect("192.0.2.1:4001")
+	defer sameAddr.Close()
+	if resp := mustFail(t, login(sameAddr, "password")); resp.Error != ErrAuthLocked {
+		t.Fatalf("expected \"%s\" from the same address, got \"%s\"", ErrAuthLocked, resp.Error)
+	}
+
+	otherAddr := connect("192.0.2.2:4000")
+	defer otherAddr.Close()
+	mustSucceed(t, login(otherAddr, "password"))
+}
+
+func TestSessions(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{Password: "password"})
+	defer hub.Close()
+	go hub.Run()
+
+	connect := func() *LocalClient {
+		client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
+		go client.Run()
+		hub.AddClient(client)
+		client.Wait()
+		return client
+	}
+	request := func(client *LocalClient, cmd string, data map[string]interface{}) interface{} {
+		req, chn := client.MakeRequest(cmd, data)
+		hub.SendMessage(req)
+		return waitReply(t, chn)
+	}
+	login := func(client *LocalClient) string {
+		resp := mustSucceed(t, authenticate(t, hub, client, map[string]interface{}{}, "password"))
+		session, _ := resp.Data.(map[string]interface{})["session"].(string)
+		if session == "" {
+			t.Fatal("no session token after authenticating")
+		}
+		return session
+	}
+
+	t.Run("logout", func(t *testing.T) {
+		client := connect()
+		defer client.Close()
+
+		session := login(client)
+		mustSucceed(t, request(client, CmdSubscribeKey, map[string]interface{}{"key": "test"}))
+		mustSucceed(t, request(client, CmdLogout, nil))
+		if resp := mustFail(t, request(client, CmdReadKey, map[string]interface{}{"key": "test"})); resp.Error != ErrAuthRequired {
+			t.Fatalf("expected \"%s\" after logging out, got \"%s\"", ErrAuthRequired, resp.Error)
+		}
+		if keys, _ := hub.subscriptions.Subscriptions(client.UID()); len(keys) != 0 {
+			t.Fatalf("client still subscribed to %v after logging out", keys)
+		}
+		if resp := mustFail(t, request(client, CmdResume, map[string]interface{}{"session": session})); resp.Error != ErrAuthFailed {
+			t.Fatalf("expected \"%s\" resuming a closed session, got \"%s\"", ErrAuthFailed, resp.Error)
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		client := connect()
+		session := login(client)
+		mustSucceed(t, request(client, CmdSubscribeKey, map[string]interface{}{"key": "title"}))
+		mustSucceed(t, request(client, CmdSubscribePrefix, map[string]interface{}{"prefix": "overlay/"}))
+		hub.RemoveClient(client)
+		<-client.done
+
+		reconnected := connect()
+		defer reconnected.Close()
+		resp := mustSucceed(t, request(reconnected, CmdResume, map[string]interface{}{"session": session}))
+		data := resp.Data.(map[string]interface{})
+		if fmt.Sprint(data["keys"]) != "[title]" || fmt.Sprint(data["prefixes"]) != "[overlay/]" {
+			t.Fatalf("wrong subscriptions restored: %v", data)
+		}
+		if !hub.clients.Authenticated(reconnected.UID()) {
+			t.Fatal("client not authenticated after resuming")
+		}
+		keys, prefixes := hub.subscriptions.Subscriptions(reconnected.UID())
+		if fmt.Sprint(keys) != "[@test/title]" || fmt.Sprint(prefixes) != "[@test/overlay/]" {
+			t.Fatalf("wrong subscriptions restored: %v %v", keys, prefixes)
+		}
+
+		// Tokens are rotated on every resume
+		newSession, _ := data["session"].(string)
+		if newSession == "" || newSession == session {
+			t.Fatalf("session token not rotated: %q", newSession)
+		}
+		other := connect()
+		defer other.Close()
+		if resp := mustFail(t, request(other, CmdResume, map[string]interface{}{"session": session})); resp.Error != ErrAuthFailed {
+			t.Fatalf("expected \"%s\" reusing a session token, got \"%s\"", ErrAuthFailed, resp.Error)
+		}
+
+		// Resuming a session that's still in use moves it to the new client
+		mustSucceed(t, request(other, CmdResume, map[string]interface{}{"session": newSession}))
+		if hub.clients.Authenticated(reconnected.UID()) {
+			t.Fatal("old client still authenticated after its session was resumed elsewhere")
+		}
+		if keys, _ := hub.subscriptions.Subscriptions(other.UID()); fmt.Sprint(keys) != "[@test/title]" {
+			t.Fatalf("subscriptions not moved: %v", keys)
+		}
+	})
+}
+
+func TestSessionRevalidation(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+
+	tokens := NewMemoryTokenStore()
+	users := NewMemoryUserStore(User{Name: "temp", Password: "temp-pass"})
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{Tokens: tokens, Users: users})
+	defer hub.Close()
+	go hub.Run()
+
+	connect := func() *LocalClient {
+		client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
+		go client.Run()
+		hub.AddClient(client)
+		client.Wait()
+		return client
+	}
+	request := func(client *LocalClient, cmd string, data map[string]interface{}) interface{} {
+		req, chn := client.MakeRequest(cmd, data)
+		hub.SendMessage(req)
+		return waitReply(t, chn)
+	}
+	// disconnect drops a client and returns a new one to resume its session with
+	disconnect := func(client *LocalClient) *LocalClient {
+		hub.RemoveClient(client)
+		<-client.done
+		return connect()
+	}
+	sessionOf := func(resp interface{}) string {
+		return mustSucceed(t, resp).Data.(map[string]interface{})["session"].(string)
+	}
+
+	t.Run("revoked token", func(t *testing.T) {
+		str, token, err := tokens.Mint(Token{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := connect()
+		session := sessionOf(request(client, CmdAuthRequest, map[string]interface{}{"auth": AuthTypeToken, "token": str}))
+
+		// Sessions can be resumed as long as the token is valid
+		reconnected := disconnect(client)
+		session = sessionOf(request(reconnected, CmdResume, map[string]interface{}{"session": session}))
+
+		if err := tokens.Revoke(token.ID); err != nil {
+			t.Fatal(err)
+		}
+		last := disconnect(reconnected)
+		defer last.Close()
+		if resp := mustFail(t, request(last, CmdResume, map[string]interface{}{"session": session})); resp.Error != ErrAuthFailed {
+			t.Fatalf("expected \"%s\" resuming with a revoked token, got \"%s\"", ErrAuthFailed, resp.Error)
+		}
+	})
+
+	t.Run("expiring token", func(t *testing.T) {
+		str, _, err := tokens.Mint(Token{ExpiresAt: time.Now().Add(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := connect()
+		session := sessionOf(request(client, CmdAuthRequest, map[string]interface{}{"auth": AuthTypeToken, "token": str}))
+		hub.RemoveClient(client)
+		<-client.done
+
+		// Session lifetime is capped at the token expiry
+		resumed, ok := hub.sessions.take(session, time.Now().Add(2*time.Minute))
+		if ok {
+			t.Fatalf("session should expire with its token, got %+v", resumed)
+		}
+	})
+
+	t.Run("removed user", func(t *testing.T) {
+		client := connect()
+		session := sessionOf(authenticate(t, hub, client, map[string]interface{}{"username": "temp"}, "temp-pass"))
+
+		if err := users.DeleteUser("temp"); err != nil {
+			t.Fatal(err)
+		}
+		reconnected := disconnect(client)
+		defer reconnected.Close()
+		if resp := mustFail(t, request(reconnected, CmdResume, map[string]interface{}{"session": session})); resp.Error != ErrAuthFailed {
+			t.Fatalf("expected \"%s\" resuming as a removed user, got \"%s\"", ErrAuthFailed, resp.Error)
+		}
+	})
+}
+
 func TestInteractiveAuthentication(t *testing.T) {
 	log, _ := zap.NewDevelopment()
 
@@ -418,7 +1485,7 @@ func TestInteractiveAuthentication(t *testing.T) {
 	defer hub.Close()
 	go hub.Run()
 
-	client := NewLocalClient(ClientOptions{test_namespace}, log)
+	client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
 	defer client.Close()
 	go client.Run()
 
@@ -444,6 +1511,53 @@ func TestInteractiveAuthentication(t *testing.T) {
 	}
 }
 
+func TestSessionCleanup(t *testing.T) {
+	t.Run("configured timeout", func(t *testing.T) {
+		sessions := newSessionStore()
+		timeout := 10 * time.Millisecond
+		for uid := int64(1); uid <= 2; uid++ {
+			if _, err := sessions.create(uid); err != nil {
+				t.Fatal(err)
+			}
+			sessions.detach(uid, authState{}, nil, nil, time.Now().Add(timeout), timeout)
+			time.Sleep(2 * timeout)
+		}
+		if len(sessions.sessions) != 1 {
+			t.Fatalf("expired session not pruned, %d sessions left", len(sessions.sessions))
+		}
+	})
+
+	t.Run("interactive auth after disconnecting", func(t *testing.T) {
+		log, _ := zap.NewDevelopment()
+		hub := createInMemoryHub(t, log)
+		release := make(chan struct{})
+		hub.UseInteractiveAuth(func(client Client, message map[string]interface{}) bool {
+			<-release
+			return true
+		})
+		defer hub.Close()
+		go hub.Run()
+
+		client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
+		go client.Run()
+		hub.AddClient(client)
+		client.Wait()
+
+		req, _ := client.MakeRequest(CmdAuthRequest, map[string]interface{}{"auth": AuthTypeInteractive})
+		hub.SendMessage(req)
+		hub.RemoveClient(client)
+		<-client.done
+		close(release)
+
+		time.Sleep(100 * time.Millisecond)
+		hub.sessions.mu.Lock()
+		defer hub.sessions.mu.Unlock()
+		if len(hub.sessions.sessions) != 0 {
+			t.Fatal("session created for a client that disconnected")
+		}
+	})
+}
+
 func waitReply(t *testing.T, chn <-chan interface{}) interface{} {
 	// Wait for response or timeout
 	select {
@@ -0,0 +1,149 @@
+package kv
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Subprotocol is the websocket subprotocol clients can ask for to make sure the server
+// speaks the same protocol version
+const Subprotocol = "kilovolt." + ProtoVersion
+
+// ConnectionPolicy decides which websocket connections the hub accepts
+type ConnectionPolicy struct {
+	// Origins websocket connections are accepted from, as patterns matched against the
+	// origin host, e.g. "example.com", "*.example.com" or "localhost:*". Connections from
+	// the server's own host and from clients that don't send an origin (not browsers) are
+	// always accepted.
+	//
+	// If empty, connections from any origin are accepted, so every webpage the user visits
+	// can connect: make sure authentication is required if that's the case.
+	AllowedOrigins []string
+
+	// Refuse clients that don't ask for the Subprotocol
+	RequireSubprotocol bool
+
+	// Maximum number of websocket clients connected at the same time, 0 means no limit
+	MaxConnections int
+
+	// Maximum number of websocket clients connected from the same address, 0 means no limit
+	MaxConnectionsPerIP int
+
+	// Addresses (like "10.0.0.1") or ranges (like "10.0.0.0/8") of reverse proxies in front of
+	// the server. The X-Forwarded-For header is only used to find the client address for
+	// connections coming from them.
+	TrustedProxies []string
+}
+
+// connectionLimiter counts websocket connections, in total and by address
+type connectionLimiter struct {
+	total int
+	perIP map[string]int
+	mu    sync.Mutex
+}
+
+func newConnectionLimiter() *connectionLimiter {
+	return &connectionLimiter{
+		perIP: make(map[string]int),
+	}
+}
+
+// acquire counts a new connection from an address, returning the HTTP status to refuse it
+// with if there are too many connections already (or 0 if it can be accepted)
+func (l *connectionLimiter) acquire(ip string, policy ConnectionPolicy) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if policy.MaxConnections > 0 && l.total >= policy.MaxConnections {
+		return http.StatusServiceUnavailable
+	}
+	if policy.MaxConnectionsPerIP > 0 && l.perIP[ip] >= policy.MaxConnectionsPerIP {
+		return http.StatusTooManyRequests
+	}
+	l.total++
+	l.perIP[ip]++
+	return 0
+}
+
+// release forgets a connection counted with acquire
+func (l *connectionLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+}
+
+// clientIP returns the address a request comes from, using X-Forwarded-For if the
+// request was sent by a trusted proxy
+func (policy ConnectionPolicy) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if len(policy.TrustedProxies) == 0 {
+		return ip
+	}
+	proxies := parseTrustedProxies(policy.TrustedProxies)
+	if !trustedProxy(proxies, ip) {
+		return ip
+	}
+
+	// Every proxy appends the address it got the request from, so go from the closest one
+	// and stop at the first address that's not one of our proxies
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = forwarded[i]
+		if !trustedProxy(proxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// parseTrustedProxies parses addresses and ranges, skipping invalid ones
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	var result []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				continue
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			result = append(result, network)
+		}
+	}
+	return result
+}
+
+func trustedProxy(proxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
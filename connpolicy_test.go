@@ -0,0 +1,113 @@
+package kv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+func TestClientIP(t *testing.T) {
+	policy := ConnectionPolicy{TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16", "not an address"}}
+	tests := []struct {
+		remote    string
+		forwarded string
+		expected  string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		// Untrusted clients can't pretend to be someone else
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		// Addresses added before the first untrusted one can't be trusted either
+		{"10.0.0.1:1234", "1.2.3.4, 198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "192.168.1.2, 192.168.1.1", "192.168.1.2"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := policy.clientIP(r); ip != test.expected {
+			t.Errorf("%s with X-Forwarded-For %q: expected %s, got %s", test.remote, test.forwarded, test.expected, ip)
+		}
+	}
+}
+
+func TestConnectionPolicy(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{
+		Connections: ConnectionPolicy{
+			AllowedOrigins:      []string{"overlay.example.com"},
+			RequireSubprotocol:  true,
+			MaxConnectionsPerIP: 1,
+		},
+	})
+	defer hub.Close()
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub.CreateWebsocketClient(w, r, ClientOptions{})
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dial := func(origin string, subprotocols ...string) (*websocket.Conn, error) {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: header, Subprotocols: subprotocols})
+		return conn, err
+	}
+
+	if _, err := dial("https://evil.example.com", Subprotocol); err == nil {
+		t.Fatal("connection from a forbidden origin accepted")
+	}
+
+	// Refused after the handshake
+	conn, err := dial("https://overlay.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.Read(ctx); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Fatalf("expected the connection to be closed for missing the subprotocol, got %v", err)
+	}
+
+	conn, err = dial("https://overlay.example.com", Subprotocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Subprotocol() != Subprotocol {
+		t.Fatalf("wrong subprotocol negotiated: %q", conn.Subprotocol())
+	}
+
+	// One connection per address
+	if _, err := dial("https://overlay.example.com", Subprotocol); err == nil {
+		t.Fatal("second connection from the same address accepted")
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	// The slot is freed once the server notices the connection is closed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err = dial("", Subprotocol)
+		if err == nil {
+			conn.Close(websocket.StatusNormalClosure, "")
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection slot not freed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
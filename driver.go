@@ -1,13 +1,21 @@
 package kv
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
-	ErrorKeyNotFound = errors.New("key not found")
+	ErrorKeyNotFound      = errors.New("key not found")
+	ErrorRevisionMismatch = errors.New("revision mismatch")
 )
 
+// Driver is a key-value database used by the hub to store keys. Drivers must be
+// safe for concurrent use, the hub runs commands from different clients in parallel.
 type Driver interface {
+	// Get returns the value of a key, or ErrorKeyNotFound if it doesn't exist
 	Get(key string) (string, error)
+	// GetBulk returns the values of every requested key that exists, missing keys should be left out
 	GetBulk(keys []string) (map[string]string, error)
 	GetPrefix(prefix string) (map[string]string, error)
 	Set(key string, value string) error
@@ -15,3 +23,55 @@ type Driver interface {
 	Delete(key string) error
 	List(prefix string) ([]string, error)
 }
+
+// RevisionDriver is an optional extension for drivers that keep track of key revisions.
+//
+// Every write (including deletes) must give the affected keys a revision higher than any
+// revision handed out before, so a key never goes back to a previous revision, even after
+// being deleted and written again. Missing keys are considered to be at revision 0.
+//
+// Drivers that don't implement this still support revisions, tracked in memory by the hub.
+type RevisionDriver interface {
+	Driver
+
+	// GetRevision returns the value of a key and its current revision
+	GetRevision(key string) (string, uint64, error)
+
+	// CompareAndSet writes a key only if it's currently at the given revision, and returns
+	// the key's new revision. If the revision doesn't match, ErrorRevisionMismatch is returned.
+	CompareAndSet(key string, value string, revision uint64) (uint64, error)
+}
+
+// BatchOp is a single write in a batch, either setting or deleting a key
+type BatchOp struct {
+	Key    string
+	Value  string
+	Delete bool
+}
+
+// TxDriver is an optional extension for drivers that can apply multiple writes atomically.
+//
+// Drivers that don't implement this still support transactions, but a failure while
+// committing might leave only some of the writes applied.
+type TxDriver interface {
+	Driver
+
+	// ApplyBatch applies every operation in order, either all of them are written or none are
+	ApplyBatch(ops []BatchOp) error
+}
+
+// ExpiryDriver is an optional extension for drivers that can store when keys expire, so keys
+// written with a time-to-live still expire after a restart. Writing or deleting a key must clear
+// its expiry time.
+//
+// With drivers that don't implement this, expiry times are only kept in memory by the hub and
+// keys written with a time-to-live are never removed if the hub restarts before they expire.
+type ExpiryDriver interface {
+	Driver
+
+	// SetExpiry sets when an existing key expires, missing keys are ignored
+	SetExpiry(key string, at time.Time) error
+
+	// Expiries returns every key that has an expiry time
+	Expiries() (map[string]time.Time, error)
+}
@@ -0,0 +1,177 @@
+package kv
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryScheduler keeps track of keys with a time-to-live. It doesn't remove
+// anything by itself: when a key is due, it signals the hub, which then pops
+// every expired key with popDue.
+type expiryScheduler struct {
+	queue   expiryQueue
+	entries map[string]*expiryEntry
+	timer   *time.Timer
+	mu      sync.Mutex
+
+	// Receives a value whenever there are keys to expire
+	signals chan struct{}
+}
+
+type expiryEntry struct {
+	key   string
+	at    time.Time
+	index int
+}
+
+func newExpiryScheduler() *expiryScheduler {
+	return &expiryScheduler{
+		entries: make(map[string]*expiryEntry),
+		signals: make(chan struct{}, 1),
+	}
+}
+
+// Set schedules a key for removal after ttl, replacing any previous schedule.
+// A ttl of 0 clears the key's schedule.
+func (e *expiryScheduler) Set(key string, ttl time.Duration) {
+	if ttl <= 0 {
+		e.SetAt(key, time.Time{})
+		return
+	}
+	e.SetAt(key, time.Now().Add(ttl))
+}
+
+// SetAt schedules a key for removal at the given time, replacing any previous schedule.
+// A zero time clears the key's schedule.
+func (e *expiryScheduler) SetAt(key string, at time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	entry, ok := e.entries[key]
+	if at.IsZero() {
+		if ok {
+			heap.Remove(&e.queue, entry.index)
+			delete(e.entries, key)
+			e.rearm()
+		}
+		return
+	}
+
+	if ok {
+		entry.at = at
+		heap.Fix(&e.queue, entry.index)
+	} else {
+		entry = &expiryEntry{key: key, at: at}
+		heap.Push(&e.queue, entry)
+		e.entries[key] = entry
+	}
+	e.rearm()
+}
+
+// Clear removes a key's schedule, if it has one
+func (e *expiryScheduler) Clear(key string) {
+	e.Set(key, 0)
+}
+
+// due returns every key that is past its expiry time, without removing them
+func (e *expiryScheduler) due(now time.Time) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Children are never due before their parent, so only due entries need to be visited
+	var keys []string
+	var visit func(i int)
+	visit = func(i int) {
+		if i >= len(e.queue) || e.queue[i].at.After(now) {
+			return
+		}
+		keys = append(keys, e.queue[i].key)
+		visit(2*i + 1)
+		visit(2*i + 2)
+	}
+	visit(0)
+	return keys
+}
+
+// popDue removes and returns the given keys that are still past their expiry time.
+// Keys that were written again since due was called (and thus rescheduled or cleared) are skipped.
+func (e *expiryScheduler) popDue(keys []string, now time.Time) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var expired []string
+	for _, key := range keys {
+		entry, ok := e.entries[key]
+		if !ok || entry.at.After(now) {
+			continue
+		}
+		heap.Remove(&e.queue, entry.index)
+		delete(e.entries, key)
+		expired = append(expired, key)
+	}
+	e.rearm()
+	return expired
+}
+
+// Stop stops the timer, no more signals will be sent
+func (e *expiryScheduler) Stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+}
+
+// rearm sets the timer to fire when the earliest key expires. Must be called with mu held.
+func (e *expiryScheduler) rearm() {
+	if len(e.queue) == 0 {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		return
+	}
+
+	wait := time.Until(e.queue[0].at)
+	if e.timer == nil {
+		e.timer = time.AfterFunc(wait, e.signal)
+	} else {
+		e.timer.Reset(wait)
+	}
+}
+
+func (e *expiryScheduler) signal() {
+	select {
+	case e.signals <- struct{}{}:
+	default:
+		// Hub already has a pending signal
+	}
+}
+
+// expiryQueue is a min-heap of entries sorted by expiry time
+type expiryQueue []*expiryEntry
+
+func (q expiryQueue) Len() int { return len(q) }
+
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x any) {
+	entry := x.(*expiryEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *expiryQueue) Pop() any {
+	old := *q
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return entry
+}
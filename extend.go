@@ -0,0 +1,75 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrCommandExists = errors.New("command already exists")
+
+// RegisterCommand adds a command to the hub, clients can send it like any other command.
+// Commands are registered per hub, so hubs in the same process can have different commands.
+// Built-in commands can't be replaced (use middleware to change how they behave).
+//
+// Handlers run on the hub's workers, like built-in commands, so they should reply with
+// SendResponse or Hub.SendError and check authentication and permissions themselves
+// with RequireAuth and RequirePermission. Custom commands are not rate limited.
+func (hub *Hub) RegisterCommand(name string, handler Handler) error {
+	if handler == nil {
+		return fmt.Errorf("no handler for command \"%s\"", name)
+	}
+	hub.commandsMu.Lock()
+	defer hub.commandsMu.Unlock()
+	if _, ok := hub.commands[name]; ok {
+		return fmt.Errorf("%w: %s", ErrCommandExists, name)
+	}
+	hub.commands[name] = handler
+	return nil
+}
+
+// command returns the handler of a command, if the hub has one
+func (hub *Hub) command(name string) (Handler, bool) {
+	hub.commandsMu.RLock()
+	defer hub.commandsMu.RUnlock()
+	handler, ok := hub.commands[name]
+	return handler, ok
+}
+
+// SendResponse replies to a request, data is sent as the "data" field
+func SendResponse(client Client, requestID string, data interface{}) {
+	client.SendJSON(Response{"response", true, requestID, data})
+}
+
+// SendError replies to a request with an error
+func (hub *Hub) SendError(client Client, msg Request, err ErrCode, details string) {
+	sendErr(hub, client, msg, err, details)
+}
+
+// RequireAuth checks that a client is authenticated (if the hub requires authentication),
+// sending an error to the client if it isn't
+func (hub *Hub) RequireAuth(client Client, msg Request) bool {
+	return requireAuth(hub, client, msg)
+}
+
+// RequirePermission checks that a client has a permission on every given key
+// (relative to its namespace), sending an error to the client if it doesn't
+func (hub *Hub) RequirePermission(client Client, msg Request, perm Permission, keys ...string) bool {
+	return requirePermission(hub, client, msg, perm, keys...)
+}
+
+// RequirePrefixPermission checks that a client might have a permission on keys starting
+// with prefix (relative to its namespace), sending an error to the client if it can't
+func (hub *Hub) RequirePrefixPermission(client Client, msg Request, perm Permission, prefix string) bool {
+	return requirePrefixPermission(hub, client, msg, perm, prefix)
+}
+
+// ClientOptions returns the options of a client, including the namespace and ACL it got
+// after connecting (e.g. by authenticating as a user)
+func (hub *Hub) ClientOptions(client Client) ClientOptions {
+	return hub.clientOptions(client)
+}
+
+// ClientKey maps a key sent by a client to the key in the database, by adding its namespace
+func (hub *Hub) ClientKey(client Client, key string) string {
+	return hub.clientOptions(client).Namespace + key
+}
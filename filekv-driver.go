@@ -0,0 +1,412 @@
+package kv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	fileSnapshotName = "snapshot.kv"
+	fileLogName      = "wal.kv"
+
+	// Default size the write log needs to reach before it's compacted into a new snapshot
+	defaultCompactionThreshold = 4 << 20
+
+	// Default interval for checking if the write log needs compacting
+	defaultCompactionInterval = time.Minute
+)
+
+var (
+	fileLogMagic = []byte("KVWAL01\n")
+
+	ErrDriverClosed = errors.New("driver is closed")
+	ErrCorruptedLog = errors.New("corrupted write log")
+)
+
+// FileBackendOptions is a list of tunable options for the file driver
+type FileBackendOptions struct {
+	// Skip fsync after every write, faster but writes might be lost on power loss
+	NoSync bool
+
+	// Size (in bytes) the write log must reach before being compacted into a snapshot (default 4 MiB)
+	CompactionThreshold int64
+
+	// How often to check if the write log needs compacting (default 1 minute, negative to disable)
+	CompactionInterval time.Duration
+}
+
+// filekv is a persistent driver that appends every write to a log file, which is
+// periodically compacted into a snapshot of the whole database.
+type filekv struct {
+	dir     string
+	options FileBackendOptions
+
+	data *memStore
+	mu   sync.RWMutex
+
+	// Writers (and compaction) must hold this for the whole duration of the write
+	writeMu sync.Mutex
+	log     *os.File
+	logSize int64
+	closed  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenFileBackend opens (or creates) a file database in the given directory.
+// A write torn by a crash at the end of the log is dropped, damage anywhere else
+// fails with ErrCorruptedLog and leaves the files untouched.
+func OpenFileBackend(dir string, options FileBackendOptions) (*filekv, error) {
+	if options.CompactionThreshold <= 0 {
+		options.CompactionThreshold = defaultCompactionThreshold
+	}
+	if options.CompactionInterval == 0 {
+		options.CompactionInterval = defaultCompactionInterval
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	b := &filekv{
+		dir:     dir,
+		options: options,
+		data:    newMemStore(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	err := readSnapshotFile(filepath.Join(dir, fileSnapshotName), b.data.apply)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.openLog(); err != nil {
+		return nil, err
+	}
+
+	go b.compactionLoop()
+
+	return b, nil
+}
+
+func (b *filekv) Get(key string) (string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	val, _, ok := b.data.get(key)
+	if !ok {
+		return "", ErrorKeyNotFound
+	}
+	return val, nil
+}
+
+func (b *filekv) GetRevision(key string) (string, uint64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	val, revision, ok := b.data.get(key)
+	if !ok {
+		return "", 0, ErrorKeyNotFound
+	}
+	return val, revision, nil
+}
+
+func (b *filekv) GetBulk(keys []string) (map[string]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	result := make(map[string]string)
+	for _, k := range keys {
+		if v, _, ok := b.data.get(k); ok {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+func (b *filekv) GetPrefix(prefix string) (map[string]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	result := make(map[string]string)
+	b.data.data.WalkPrefix(prefix, func(key string, entry memEntry) bool {
+		result[key] = entry.value
+		return true
+	})
+	return result, nil
+}
+
+func (b *filekv) List(prefix string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	keys := make([]string, 0)
+	b.data.data.WalkPrefix(prefix, func(key string, _ memEntry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys, nil
+}
+
+func (b *filekv) Set(key string, value string) error {
+	_, err := b.write([]recordOp{{op: recordOpSet, key: key, value: value}}, nil)
+	return err
+}
+
+func (b *filekv) SetBulk(kv map[string]string) error {
+	ops := make([]recordOp, 0, len(kv))
+	for k, v := range kv {
+		ops = append(ops, recordOp{op: recordOpSet, key: k, value: v})
+	}
+	_, err := b.write(ops, nil)
+	return err
+}
+
+func (b *filekv) Delete(key string) error {
+	_, err := b.write([]recordOp{{op: recordOpDelete, key: key}}, nil)
+	return err
+}
+
+func (b *filekv) CompareAndSet(key string, value string, revision uint64) (uint64, error) {
+	return b.write([]recordOp{{op: recordOpSet, key: key, value: value}}, func() error {
+		if b.data.currentRevision(key) != revision {
+			return ErrorRevisionMismatch
+		}
+		return nil
+	})
+}
+
+func (b *filekv) ApplyBatch(ops []BatchOp) error {
+	records := make([]recordOp, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			records[i] = recordOp{op: recordOpDelete, key: op.Key}
+		} else {
+			records[i] = recordOp{op: recordOpSet, key: op.Key, value: op.Value}
+		}
+	}
+	// A single record is either fully replayed or dropped as a torn write
+	_, err := b.write(records, nil)
+	return err
+}
+
+func (b *filekv) SetExpiry(key string, at time.Time) error {
+	_, err := b.write([]recordOp{{op: recordOpExpire, key: key, expires: at.UnixNano()}}, nil)
+	return err
+}
+
+func (b *filekv) Expiries() (map[string]time.Time, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.data.expiries(), nil
+}
+
+// Compact writes a new snapshot of the database and truncates the write log
+func (b *filekv) Compact() error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	if b.closed {
+		return ErrDriverClosed
+	}
+	return b.compact()
+}
+
+// Close stops background compaction, compacts the write log one last time and closes all files
+func (b *filekv) Close() error {
+	b.writeMu.Lock()
+	if b.closed {
+		b.writeMu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.writeMu.Unlock()
+
+	close(b.stop)
+	<-b.done
+
+	var err error
+	if b.logSize > int64(len(fileLogMagic)) {
+		err = b.compact()
+	}
+	if closeErr := b.log.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// write appends the operations to the log as a single record, then applies them to memory.
+// If check is provided, it's called before anything is written and aborts the write if it fails.
+// Returns the revision of the last operation.
+func (b *filekv) write(ops []recordOp, check func() error) (uint64, error) {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	if b.closed {
+		return 0, ErrDriverClosed
+	}
+
+	// Writers are locked out, so the store can be read without holding mu
+	if check != nil {
+		if err := check(); err != nil {
+			return 0, err
+		}
+	}
+
+	record := encodeRecord(ops)
+	if _, err := b.log.Write(record); err != nil {
+		// Remove whatever was partially written so the log stays readable
+		_ = b.log.Truncate(b.logSize)
+		_, _ = b.log.Seek(b.logSize, io.SeekStart)
+		return 0, err
+	}
+	if !b.options.NoSync {
+		if err := b.log.Sync(); err != nil {
+			// The caller is told the write failed, so it must not come back after a restart
+			_ = b.log.Truncate(b.logSize)
+			_, _ = b.log.Seek(b.logSize, io.SeekStart)
+			return 0, err
+		}
+	}
+	b.logSize += int64(len(record))
+
+	b.mu.Lock()
+	b.data.apply(ops)
+	revision := b.data.revision
+	b.mu.Unlock()
+
+	return revision, nil
+}
+
+func (b *filekv) compactionLoop() {
+	defer close(b.done)
+	if b.options.CompactionInterval < 0 {
+		<-b.stop
+		return
+	}
+
+	ticker := time.NewTicker(b.options.CompactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.writeMu.Lock()
+			if !b.closed && b.logSize >= b.options.CompactionThreshold {
+				// If this fails, the log is still intact and we'll try again next tick
+				_ = b.compact()
+			}
+			b.writeMu.Unlock()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// compact must be called with writeMu held
+func (b *filekv) compact() error {
+	// Writers are locked out, so the store can be read without holding mu
+	if err := writeSnapshotFile(filepath.Join(b.dir, fileSnapshotName), b.data); err != nil {
+		return err
+	}
+
+	// The snapshot now contains everything in the log, so it can be emptied.
+	// If we crash before this, replaying the log on top of the snapshot is harmless,
+	// revisions of the replayed keys will only end up higher than they were.
+	if err := b.log.Truncate(int64(len(fileLogMagic))); err != nil {
+		return err
+	}
+	if _, err := b.log.Seek(int64(len(fileLogMagic)), io.SeekStart); err != nil {
+		return err
+	}
+	b.logSize = int64(len(fileLogMagic))
+	return b.log.Sync()
+}
+
+func (b *filekv) openLog() error {
+	file, err := os.OpenFile(filepath.Join(b.dir, fileLogName), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// New log, write header
+	if stat.Size() == 0 {
+		if _, err := file.Write(fileLogMagic); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+		b.log = file
+		b.logSize = int64(len(fileLogMagic))
+		return nil
+	}
+
+	reader := bufio.NewReader(file)
+	if err := readMagic(reader, fileLogMagic); err != nil {
+		file.Close()
+		return fmt.Errorf("%s is not a valid write log", fileLogName)
+	}
+
+	// Replay every valid record, stop at the first incomplete or damaged one
+	offset := int64(len(fileLogMagic))
+	for {
+		ops, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A write torn by a crash can be dropped, as long as nothing valid follows it: either the
+			// record's (checksummed) length reaches the end of the log, or the header couldn't be read
+			// and only zeros (space allocated but never written) follow. Anything else is damage in
+			// the middle of the log, so refuse to throw away the records after it.
+			if size > 0 && offset+size >= stat.Size() || size == 0 && zeroTail(reader) {
+				break
+			}
+			file.Close()
+			return fmt.Errorf("%w: %s at offset %d of %s", ErrCorruptedLog, err.Error(), offset, fileLogName)
+		}
+		b.data.apply(ops)
+		offset += size
+	}
+
+	// Drop any torn write at the end of the log
+	if offset < stat.Size() {
+		if err := file.Truncate(offset); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	b.log = file
+	b.logSize = offset
+	return nil
+}
+
+// zeroTail returns true if every byte left in reader is zero
+func zeroTail(reader *bufio.Reader) bool {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err == io.EOF
+		}
+		if b != 0 {
+			return false
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package kv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestFileBackend(t *testing.T, dir string) *filekv {
+	db, err := OpenFileBackend(dir, FileBackendOptions{CompactionInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestFileBackend_Persistence(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openTestFileBackend(t, dir)
+	if err := db.Set("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetBulk(map[string]string{"key2": "value2", "key3": "value3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestFileBackend(t, dir)
+	defer db.Close()
+
+	val, err := db.GetPrefix("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(val) != 2 || val["key1"] != "value1" || val["key2"] != "value2" {
+		t.Fatalf("unexpected values after reopening: %v", val)
+	}
+	if _, err := db.Get("key3"); err != ErrorKeyNotFound {
+		t.Fatal("deleted key is still present after reopening")
+	}
+}
+
+func TestFileBackend_ReplayLog(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openTestFileBackend(t, dir)
+	if err := db.Set("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("key", "new-value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash by not closing the driver, only the log file
+	db.log.Close()
+
+	db = openTestFileBackend(t, dir)
+	defer db.Close()
+
+	val, err := db.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "new-value" {
+		t.Fatalf("expected 'new-value', got '%s'", val)
+	}
+}
+
+func TestFileBackend_TornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openTestFileBackend(t, dir)
+	if err := db.Set("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	validSize := db.logSize
+	db.log.Close()
+
+	// Cut the last record in half
+	logPath := filepath.Join(dir, fileLogName)
+	if err := os.Truncate(logPath, validSize-3); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestFileBackend(t, dir)
+	if _, err := db.Get("key1"); err != nil {
+		t.Fatal("key written before the torn write was lost")
+	}
+	if _, err := db.Get("key2"); err != ErrorKeyNotFound {
+		t.Fatal("torn write was not discarded")
+	}
+
+	// New writes must be readable after the torn write was dropped
+	if err := db.Set("key3", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	db.log.Close()
+
+	db = openTestFileBackend(t, dir)
+	defer db.Close()
+	if val, err := db.Get("key3"); err != nil || val != "value3" {
+		t.Fatal("write after recovery was lost")
+	}
+}
+
+func TestFileBackend_CorruptedRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openTestFileBackend(t, dir)
+	if err := db.Set("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.log.Close()
+
+	// Flip the last byte of the value
+	logPath := filepath.Join(dir, fileLogName)
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(logPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestFileBackend(t, dir)
+	defer db.Close()
+	if _, err := db.Get("key"); err != ErrorKeyNotFound {
+		t.Fatal("corrupted record was not discarded")
+	}
+}
+
+func TestFileBackend_CorruptedMiddleRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openTestFileBackend(t, dir)
+	if err := db.Set("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	firstEnd := db.logSize
+	if err := db.Set("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	db.log.Close()
+
+	// Flip the last byte of the first record, the second one is still valid
+	logPath := filepath.Join(dir, fileLogName)
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[firstEnd-1] ^= 0xff
+	if err := os.WriteFile(logPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenFileBackend(dir, FileBackendOptions{CompactionInterval: -1}); !errors.Is(err, ErrCorruptedLog) {
+		t.Fatalf("expected ErrCorruptedLog, got %v", err)
+	}
+
+	// The log must be left alone so it can be recovered by hand
+	after, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(data) {
+		t.Fatalf("log was truncated from %d to %d bytes", len(data), len(after))
+	}
+}
+
+func TestFileBackend_CorruptedRecordLength(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openTestFileBackend(t, dir)
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err := db.Set(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.log.Close()
+
+	// Make the first record look like it runs past the end of the log
+	logPath := filepath.Join(dir, fileLogName)
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(fileLogMagic)+6] ^= 0x01
+	if err := os.WriteFile(logPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenFileBackend(dir, FileBackendOptions{CompactionInterval: -1}); !errors.Is(err, ErrCorruptedLog) {
+		t.Fatalf("expected ErrCorruptedLog, got %v", err)
+	}
+	after, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(data) {
+		t.Fatalf("log was truncated from %d to %d bytes", len(data), len(after))
+	}
+}
+
+func TestFileBackend_Compact(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openTestFileBackend(t, dir)
+	for _, key := range []string{"b", "a", "c"} {
+		if err := db.Set(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if db.logSize != int64(len(fileLogMagic)) {
+		t.Fatal("write log was not truncated after compaction")
+	}
+
+	keys, err := db.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "c" {
+		t.Fatalf("unexpected key list: %v", keys)
+	}
+	db.Close()
+
+	db = openTestFileBackend(t, dir)
+	defer db.Close()
+	if val, err := db.Get("c"); err != nil || val != "c" {
+		t.Fatal("key lost after compaction")
+	}
+}
+
+func TestFileBackend_Revisions(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openTestFileBackend(t, dir)
+	revision, err := db.CompareAndSet("key", "value", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CompareAndSet("key", "value", 0); err != ErrorRevisionMismatch {
+		t.Fatal("compare and set succeeded on the wrong revision")
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("key", "new-value"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Revisions must keep going up after a restart, even for deleted keys
+	db = openTestFileBackend(t, dir)
+	defer db.Close()
+	_, newRevision, err := db.GetRevision("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newRevision <= revision {
+		t.Fatalf("revision went backwards after restart (%d -> %d)", revision, newRevision)
+	}
+	if _, err := db.CompareAndSet("key", "value", revision); err != ErrorRevisionMismatch {
+		t.Fatal("compare and set succeeded with a revision from before the key was deleted")
+	}
+}
+
+func TestFileBackend_Expiry(t *testing.T) {
+	dir := t.TempDir()
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	db := openTestFileBackend(t, dir)
+	for _, key := range []string{"logged", "compacted", "rewritten"} {
+		if err := db.Set(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetExpiry(key, at); err != nil {
+			t.Fatal(err)
+		}
+		if key == "compacted" {
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Writing a key clears its expiry
+	if err := db.Set("rewritten", "new-value"); err != nil {
+		t.Fatal(err)
+	}
+	db.log.Close()
+
+	db = openTestFileBackend(t, dir)
+	defer db.Close()
+	expiries, err := db.Expiries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expiries) != 2 || !expiries["logged"].Equal(at) || !expiries["compacted"].Equal(at) {
+		t.Fatalf("unexpected expiries after reopening: %v", expiries)
+	}
+}
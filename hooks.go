@@ -0,0 +1,120 @@
+package kv
+
+import "sync"
+
+// ClientInfo describes a client, for lifecycle hooks
+type ClientInfo struct {
+	Client Client
+	ID     int64
+
+	// Address the client connects from, empty for clients that are not connected over the network
+	RemoteAddr string
+
+	// Options of the client, including the namespace and ACL it got after connecting
+	Options ClientOptions
+
+	Authenticated bool
+
+	// User the client authenticated as ("token:<id>" for API tokens), if any
+	User string
+}
+
+// hooks are functions called when things happen to clients, nil if not set
+type hooks struct {
+	connect       func(info ClientInfo)
+	authenticated func(info ClientInfo, method AuthType)
+	disconnect    func(info ClientInfo)
+	commandError  func(info ClientInfo, request Request, err Error)
+	mu            sync.RWMutex
+}
+
+// OnConnect sets a function to call when a client connects, before it runs any command
+func (hub *Hub) OnConnect(fn func(info ClientInfo)) {
+	hub.hooks.mu.Lock()
+	defer hub.hooks.mu.Unlock()
+	hub.hooks.connect = fn
+}
+
+// OnAuthenticated sets a function to call when a client authenticates (or resumes its session)
+func (hub *Hub) OnAuthenticated(fn func(info ClientInfo, method AuthType)) {
+	hub.hooks.mu.Lock()
+	defer hub.hooks.mu.Unlock()
+	hub.hooks.authenticated = fn
+}
+
+// OnDisconnect sets a function to call when a client disconnects, after its last command
+func (hub *Hub) OnDisconnect(fn func(info ClientInfo)) {
+	hub.hooks.mu.Lock()
+	defer hub.hooks.mu.Unlock()
+	hub.hooks.disconnect = fn
+}
+
+// OnCommandError sets a function to call when a command fails, with the error sent to the client.
+//
+// The function runs on the hub's workers once the failed command has returned and released its keys,
+// so it can use the hub freely (e.g. Hub.Get, Hub.Set, Hub.SetACL) but it holds up the client's next
+// commands until it returns. It must not wait for a reply to a command from the same client
+// (e.g. with LocalClient.Do), since that command can't run before the function returns.
+func (hub *Hub) OnCommandError(fn func(info ClientInfo, request Request, err Error)) {
+	hub.hooks.mu.Lock()
+	defer hub.hooks.mu.Unlock()
+	hub.hooks.commandError = fn
+}
+
+// ClientInfo returns what the hub knows about a client
+func (hub *Hub) ClientInfo(client Client) ClientInfo {
+	info := ClientInfo{
+		Client:        client,
+		ID:            client.UID(),
+		Options:       hub.clientOptions(client),
+		Authenticated: hub.clients.Authenticated(client.UID()),
+	}
+	if addr, ok := client.(remoteAddresser); ok {
+		info.RemoteAddr = addr.RemoteAddr()
+	}
+	info.User, _ = hub.clients.User(client.UID())
+	return info
+}
+
+func (hub *Hub) clientConnected(client Client) {
+	hub.hooks.mu.RLock()
+	fn := hub.hooks.connect
+	hub.hooks.mu.RUnlock()
+	if fn != nil {
+		fn(hub.ClientInfo(client))
+	}
+}
+
+func (hub *Hub) clientAuthenticated(client Client, method AuthType) {
+	hub.hooks.mu.RLock()
+	fn := hub.hooks.authenticated
+	hub.hooks.mu.RUnlock()
+	if fn != nil {
+		fn(hub.ClientInfo(client), method)
+	}
+}
+
+func (hub *Hub) clientDisconnected(client Client) {
+	hub.hooks.mu.RLock()
+	fn := hub.hooks.disconnect
+	hub.hooks.mu.RUnlock()
+	if fn != nil {
+		fn(hub.ClientInfo(client))
+	}
+}
+
+// replyErr sends an error to a client and reports it to the OnCommandError hook.
+// Commands can fail while holding key locks, so the hook is queued to run after them.
+func (hub *Hub) replyErr(client Client, msg Request, err Error) {
+	client.SendJSON(err)
+
+	hub.hooks.mu.RLock()
+	fn := hub.hooks.commandError
+	hub.hooks.mu.RUnlock()
+	if fn != nil {
+		info := hub.ClientInfo(client)
+		hub.scheduler.Submit(client, func() {
+			fn(info, msg, err)
+		})
+	}
+}
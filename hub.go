@@ -4,9 +4,13 @@ import (
 	"context"
 	crand "crypto/rand"
 	"encoding/binary"
-	"fmt"
 	mrand "math/rand"
+	"net"
 	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"nhooyr.io/websocket"
 
@@ -23,6 +27,46 @@ type Message struct {
 type HubOptions struct {
 	Password string
 	Context  context.Context
+
+	// SCRAM verifier of the password, to be used instead of Password so the hub never
+	// knows it. Clients can then only authenticate with SCRAM.
+	PasswordVerifier *ScramVerifier
+
+	// Number of commands that can run at the same time (defaults to the number of CPUs)
+	Workers int
+
+	// Users clients can authenticate as, each with their own password, namespace and role
+	Users UserStore
+
+	// Permissions of each user role, users with a role that's not in here can't authenticate
+	Roles map[string]ACL
+
+	// API tokens clients can authenticate with, each with their own namespace and scopes
+	Tokens TokenStore
+
+	// How long clients have to answer an authentication challenge (defaults to a minute)
+	ChallengeTimeout time.Duration
+
+	// Failed authentications a client (or address) can have before being locked out (defaults to 3)
+	AuthMaxFailures int
+
+	// How long clients are locked out after AuthMaxFailures failures (defaults to a second),
+	// doubling with each further failure up to AuthMaxLockout (defaults to 5 minutes)
+	AuthLockout    time.Duration
+	AuthMaxLockout time.Duration
+
+	// How long clients can resume their session after disconnecting (defaults to 5 minutes),
+	// negative values disable sessions
+	SessionTimeout time.Duration
+
+	// Which websocket connections are accepted
+	Connections ConnectionPolicy
+
+	// How many commands clients can send, commands over the limit fail with a rate limited error
+	RateLimits RateLimits
+
+	// Receives every change made to keys by clients, to keep an audit log
+	Audit AuditSink
 }
 
 type InteractiveFn func(client Client, message map[string]interface{}) bool
@@ -34,11 +78,30 @@ type Hub struct {
 	register      chan Client
 	unregister    chan Client
 	subscriptions *subscriptionManager
+	scheduler     *scheduler
+	locks         keyLocks
+	authLimiter   *authLimiter
+	sessions      *sessionStore
+	connections   *connectionLimiter
+	rateLimiter   *rateLimiter
 	interactiveFn InteractiveFn
+	chain         middlewareChain
+	commands      map[string]Handler
+	commandsMu    sync.RWMutex
+	watchers      *watcherList
+	hooks         hooks
 	context       context.Context
 	cancel        context.CancelFunc
 
-	db Driver
+	db        Driver
+	revisions *revisionTracker
+	expiry    *expiryScheduler
+
+	// Random key used to derive stable SCRAM salts for users without a verifier
+	secret []byte
+
+	// Messages dropped for slow clients
+	dropped atomic.Uint64
 
 	logger *zap.Logger
 }
@@ -67,17 +130,40 @@ func NewHub(db Driver, options HubOptions, logger *zap.Logger) (*Hub, error) {
 		logger:        logger,
 		options:       options,
 		subscriptions: subscriptions,
+		scheduler:     newScheduler(),
+		authLimiter:   newAuthLimiter(),
+		sessions:      newSessionStore(),
+		connections:   newConnectionLimiter(),
+		rateLimiter:   newRateLimiter(),
+		expiry:        newExpiryScheduler(),
+		watchers:      newWatcherList(),
 		context:       hubContext,
 		cancel:        cancel,
 	}
 
 	subscriptions.hub = hub
+	hub.commands = make(map[string]Handler, len(handlers))
+	for name, handler := range handlers {
+		hub.commands[name] = handler
+	}
+	hub.secret = hub.randomBytes()
+
+	// Keep track of revisions ourselves if the driver can't
+	if _, ok := db.(RevisionDriver); !ok {
+		hub.revisions = newRevisionTracker()
+	}
+
+	if err := hub.loadExpiries(); err != nil {
+		cancel()
+		return nil, err
+	}
 
 	return hub, nil
 }
 
 func (hub *Hub) Close() {
 	hub.cancel()
+	hub.expiry.Stop()
 }
 
 func (hub *Hub) SetOptions(options HubOptions) {
@@ -89,20 +175,12 @@ func (hub *Hub) handleCmd(client Client, message Message) {
 	var msg Request
 	err := json.Unmarshal(message.Data, &msg)
 	if err != nil {
-		sendErr(message.Client, ErrInvalidFmt, err.Error(), msg.RequestID)
-		return
-	}
-
-	// Get handler for command
-	handler, ok := handlers[msg.CmdName]
-	if !ok {
-		// No handler found, send invalid command
-		sendErr(client, ErrUnknownCmd, fmt.Sprintf("command \"%s\" is mistyped or not supported", msg.CmdName), msg.RequestID)
+		sendErr(hub, message.Client, msg, ErrInvalidFmt, err.Error())
 		return
 	}
 
-	// Run handler
-	handler(hub, client, msg)
+	// Run handler, through middleware
+	hub.handler()(hub, client, msg)
 }
 
 func (hub *Hub) randomBytes() []byte {
@@ -117,12 +195,25 @@ func (hub *Hub) randomBytes() []byte {
 	return saltBytes
 }
 
-func sendErr(client Client, err ErrCode, details string, requestID string) {
-	client.SendJSON(Error{false, err, details, requestID})
+// sendErr replies to a request with an error
+func sendErr(h *Hub, client Client, msg Request, err ErrCode, details string) {
+	h.replyErr(client, msg, Error{false, err, details, msg.RequestID, 0})
 }
 
+// Run dispatches incoming messages until the hub is closed.
+//
+// Commands run on a pool of workers: commands from different clients run in parallel,
+// while commands from the same client always run one at a time, in the order they were sent.
 func (hub *Hub) Run() {
 	hub.logger.Debug("Hub is running")
+
+	workers := hub.options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	hub.scheduler.Start(workers)
+	defer hub.scheduler.Close()
+
 	for {
 		select {
 		case client := <-hub.register:
@@ -132,16 +223,37 @@ func (hub *Hub) Run() {
 			// Send welcome message
 			client.SendJSON(Hello{CmdType: "hello", Version: ProtoVersion})
 
+			// Queue before the client's first command
+			hub.scheduler.Submit(client, func() {
+				hub.clientConnected(client)
+			})
+
 		case client := <-hub.unregister:
-			// Unsubscribe from all keys
-			hub.subscriptions.UnsubscribeAll(client.UID())
+			// Queue after the client's pending commands so they can still reply
+			hub.scheduler.Submit(client, func() {
+				// Keep the client's state around in case it comes back
+				hub.detachSession(client)
+
+				hub.clientDisconnected(client)
 
-			// Delete entry and close channel
-			hub.clients.RemoveClient(client)
-			client.Close()
+				// Unsubscribe from all keys
+				hub.subscriptions.UnsubscribeAll(client.UID())
+
+				// Delete entry and close channel
+				hub.rateLimiter.forget(client.UID())
+				hub.clients.RemoveClient(client)
+				client.Close()
+			})
 
 		case message := <-hub.incoming:
-			hub.handleCmd(message.Client, message)
+			hub.scheduler.Submit(message.Client, func() {
+				hub.handleCmd(message.Client, message)
+			})
+
+		case <-hub.expiry.signals:
+			// Expiry takes key locks and writes to the driver, so it runs on the workers
+			// too, queued on its own (nil) client so only one runs at a time
+			hub.scheduler.Submit(nil, hub.expireKeys)
 
 		case <-hub.context.Done():
 			return
@@ -150,6 +262,9 @@ func (hub *Hub) Run() {
 }
 
 func (hub *Hub) AddClient(client Client) {
+	if local, ok := client.(*LocalClient); ok {
+		local.setHub(hub)
+	}
 	hub.register <- client
 }
 
@@ -165,27 +280,81 @@ func (hub *Hub) SetAuthenticated(id int64, authenticated bool) error {
 	return hub.clients.SetAuthenticated(id, authenticated)
 }
 
+// clientOptions returns the options of a client, including the ones set after it
+// connected (e.g. the namespace and ACL of the user it authenticated as)
+func (hub *Hub) clientOptions(client Client) ClientOptions {
+	return hub.clients.Options(client.UID(), client.Options())
+}
+
+// SendMessage queues a message from a client, unless it's over the client's rate limits
 func (hub *Hub) SendMessage(msg Message) {
+	if !hub.allowMessage(msg) {
+		return
+	}
 	hub.incoming <- msg
 }
 
+// sendMessageContext is SendMessage for callers that can't wait forever, it returns ctx.Err()
+// if ctx is done or ErrHubClosed if the hub is closed before the message could be queued
+func (hub *Hub) sendMessageContext(ctx context.Context, msg Message) error {
+	if !hub.allowMessage(msg) {
+		return nil
+	}
+	select {
+	case hub.incoming <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-hub.context.Done():
+		return ErrHubClosed
+	}
+}
+
 // ServeWs is the legacy handler for WS
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	hub.CreateWebsocketClient(w, r, ClientOptions{})
 }
 
 // CreateWebsocketClient upgrades a HTTP request to websocket and makes it a client for the hub
+//
+// Connections are refused according to HubOptions.Connections.
 func (hub *Hub) CreateWebsocketClient(w http.ResponseWriter, r *http.Request, options ClientOptions) {
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	policy := hub.options.Connections
+	ip := policy.clientIP(r)
+	if status := hub.connections.acquire(ip, policy); status != 0 {
+		hub.logger.Warn("refusing websocket connection, too many clients", zap.String("addr", ip))
+		http.Error(w, "too many connections", status)
+		return
+	}
+
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols:       []string{Subprotocol},
+		InsecureSkipVerify: len(policy.AllowedOrigins) == 0,
+		OriginPatterns:     policy.AllowedOrigins,
+	})
 	if err != nil {
-		hub.logger.Error("error starting websocket session", zap.Error(err))
+		hub.connections.release(ip)
+		hub.logger.Error("error starting websocket session", zap.Error(err), zap.String("addr", ip))
 		return
 	}
+	if policy.RequireSubprotocol && conn.Subprotocol() != Subprotocol {
+		hub.connections.release(ip)
+		hub.logger.Warn("refusing websocket connection without subprotocol", zap.String("addr", ip))
+		_ = conn.Close(websocket.StatusPolicyViolation, "the "+Subprotocol+" subprotocol is required")
+		return
+	}
+
+	// Keep the port when the address is not forwarded, to tell clients apart in logs
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err != nil || host != ip {
+		addr = ip
+	}
 
 	client := &WebsocketClient{
 		hub: hub, conn: conn,
-		send: make(chan []byte, 256), options: options,
-		addr: r.RemoteAddr,
+		queue: newOutboundQueue(options.QueueSize, options.SlowClientPolicy), options: options,
+		addr: addr,
+		ip:   ip,
 		ctx:  context.Background(),
 	}
 	client.hub.register <- client
@@ -196,6 +365,11 @@ func (hub *Hub) CreateWebsocketClient(w http.ResponseWriter, r *http.Request, op
 	go client.readPump()
 }
 
+// DroppedMessages returns how many messages were dropped for clients that didn't read them fast enough
+func (hub *Hub) DroppedMessages() uint64 {
+	return hub.dropped.Load()
+}
+
 func (hub *Hub) authRequired() bool {
-	return hub.options.Password != "" || hub.interactiveFn != nil
+	return hub.options.Password != "" || hub.options.PasswordVerifier != nil || hub.options.Users != nil || hub.options.Tokens != nil || hub.interactiveFn != nil
 }
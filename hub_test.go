@@ -1,6 +1,11 @@
 package kv
 
 import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,7 +24,7 @@ func TestHub(t *testing.T) {
 	go hub.Run()
 	defer hub.Close()
 
-	client := NewLocalClient(ClientOptions{test_namespace}, log)
+	client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
 	t.Run("register client", func(t *testing.T) {
 		hub.register <- client
 		// Wait for hello or timeout
@@ -39,7 +44,7 @@ func TestHub(t *testing.T) {
 		select {
 		case <-time.After(10 * time.Second):
 			t.Fatal("server took too long to take action")
-		case <-client.send:
+		case <-client.done:
 		}
 		if len(hub.clients.Clients()) > 0 {
 			t.Fatal("client not removed")
@@ -49,10 +54,563 @@ func TestHub(t *testing.T) {
 
 func createInMemoryHub(t *testing.T, log *zap.Logger) *Hub {
 	// Create hub with in-mem DB
-	hub, err := NewHub(MakeBackend(), HubOptions{}, log)
+	db, err := NewMemoryBackend(MemoryBackendOptions{})
+	if err != nil {
+		t.Fatal("database initialization failed", err.Error())
+	}
+	hub, err := NewHub(db, HubOptions{}, log)
 	if err != nil {
 		t.Fatal("hub initialization failed", err.Error())
 	}
 
 	return hub
 }
+
+// blockingDriver blocks reads of a key until released
+type blockingDriver struct {
+	Driver
+	key     string
+	release chan struct{}
+}
+
+func (d blockingDriver) Get(key string) (string, error) {
+	if key == d.key {
+		<-d.release
+	}
+	return d.Driver.Get(key)
+}
+
+func TestParallelCommands(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+
+	// A slow read must only hold up the client asking for it
+	db := blockingDriver{MakeBackend(), test_namespace + "slow", make(chan struct{})}
+	hub, err := NewHub(db, HubOptions{Workers: 4}, log)
+	if err != nil {
+		t.Fatal("hub initialization failed", err.Error())
+	}
+	defer hub.Close()
+	go hub.Run()
+
+	connect := func() *LocalClient {
+		client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
+		go client.Run()
+		hub.AddClient(client)
+		client.Wait()
+		return client
+	}
+	slow := connect()
+	defer slow.Close()
+	fast := connect()
+	defer fast.Close()
+
+	slowReq, slowChn := slow.MakeRequest(CmdReadKey, map[string]interface{}{
+		"key": "slow",
+	})
+	hub.SendMessage(slowReq)
+	// Queued behind the slow read, must wait for it
+	nextReq, nextChn := slow.MakeRequest(CmdProtoVersion, nil)
+	hub.SendMessage(nextReq)
+
+	req, chn := fast.MakeRequest(CmdReadKey, map[string]interface{}{
+		"key": "fast",
+	})
+	hub.SendMessage(req)
+	mustSucceed(t, waitReply(t, chn))
+
+	select {
+	case <-nextChn:
+		t.Fatal("command ran before the previous command from the same client was done")
+	default:
+	}
+
+	close(db.release)
+	mustSucceed(t, waitReply(t, slowChn))
+	mustSucceed(t, waitReply(t, nextChn))
+}
+
+func TestSchedulerOrdering(t *testing.T) {
+	s := newScheduler()
+	s.Start(8)
+	defer s.Close()
+
+	const clientCount = 10
+	const taskCount = 100
+
+	var wg sync.WaitGroup
+	results := make([][]int, clientCount)
+	var running [clientCount]int32
+	for c := 0; c < clientCount; c++ {
+		c := c
+		client := NewLocalClient(ClientOptions{}, nil)
+		for i := 0; i < taskCount; i++ {
+			i := i
+			wg.Add(1)
+			s.Submit(client, func() {
+				defer wg.Done()
+				if atomic.AddInt32(&running[c], 1) != 1 {
+					t.Error("tasks for the same client are running at the same time")
+				}
+				results[c] = append(results[c], i)
+				atomic.AddInt32(&running[c], -1)
+			})
+		}
+	}
+	wg.Wait()
+
+	for c, result := range results {
+		for i, value := range result {
+			if value != i {
+				t.Fatalf("tasks for client %d ran out of order: %v", c, result)
+			}
+		}
+	}
+}
+
+// recordingClient keeps every push it receives, in order
+type recordingClient struct {
+	uid    int64
+	pushes []Push
+	mu     sync.Mutex
+}
+
+func (c *recordingClient) Options() ClientOptions { return ClientOptions{} }
+func (c *recordingClient) Close()                 {}
+func (c *recordingClient) SetUID(uid int64)       { c.uid = uid }
+func (c *recordingClient) UID() int64             { return c.uid }
+func (c *recordingClient) SendJSON(data any)      {}
+
+func (c *recordingClient) SendMessage(data []byte) {
+	var push Push
+	if err := json.Unmarshal(data, &push); err != nil || push.CmdType != "push" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pushes = append(c.pushes, push)
+}
+
+func TestPushOrdering(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{Workers: 8})
+	defer hub.Close()
+	go hub.Run()
+
+	subscriber := &recordingClient{}
+	hub.clients.AddClient(subscriber)
+	hub.subscriptions.SubscribeKey(subscriber.UID(), test_namespace+"contended")
+
+	// Many clients write the same key at the same time
+	const writers = 8
+	const writes = 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
+		go client.Run()
+		hub.AddClient(client)
+		client.Wait()
+		defer client.Close()
+
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				req, chn := client.MakeRequest(CmdWriteKey, map[string]interface{}{
+					"key":  "contended",
+					"data": strconv.Itoa(w*writes + i),
+				})
+				hub.SendMessage(req)
+				mustSucceed(t, waitReply(t, chn))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	subscriber.mu.Lock()
+	defer subscriber.mu.Unlock()
+	if len(subscriber.pushes) != writers*writes {
+		t.Fatalf("expected %d pushes, got %d", writers*writes, len(subscriber.pushes))
+	}
+	// The last push must be the value that ended up in the database
+	last := subscriber.pushes[len(subscriber.pushes)-1].NewValue
+	assertKey(t, hub, "contended", last)
+}
+
+func TestMiddleware(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub := createInMemoryHub(t, log)
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(hub *Hub, client Client, msg Request) {
+				mu.Lock()
+				calls = append(calls, name+":"+msg.CmdName)
+				mu.Unlock()
+				next(hub, client, msg)
+			}
+		}
+	}
+	hub.Use(record("outer"), record("inner"))
+
+	// Middleware can reply on its own without running the command
+	hub.Use(func(next Handler) Handler {
+		return func(hub *Hub, client Client, msg Request) {
+			if key, _ := msg.Data["key"].(string); key == "forbidden" {
+				hub.SendError(client, msg, ErrPermissionDenied, "not today")
+				return
+			}
+			next(hub, client, msg)
+		}
+	})
+
+	makeHubClientWith(t, hub, log, func(hub *Hub, client *LocalClient) {
+		req, chn := client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "allowed", "data": "ok"})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+
+		req, chn = client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "forbidden", "data": "nope"})
+		hub.SendMessage(req)
+		if resp := mustFail(t, waitReply(t, chn)); resp.Error != ErrPermissionDenied {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrPermissionDenied, resp.Error)
+		}
+		if _, err := hub.db.Get(test_namespace + "forbidden"); err != ErrorKeyNotFound {
+			t.Fatal("command ran even though middleware refused it")
+		}
+
+		// Unknown commands go through middleware too
+		req, chn = client.MakeRequest("kmystery", map[string]interface{}{})
+		hub.SendMessage(req)
+		mustFail(t, waitReply(t, chn))
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	// LocalClient asks for its ID when it starts, so skip that
+	var got []string
+	for _, call := range calls {
+		if !strings.HasSuffix(call, CmdInternalClientID) {
+			got = append(got, call)
+		}
+	}
+	expected := []string{
+		"outer:" + CmdWriteKey, "inner:" + CmdWriteKey,
+		"outer:" + CmdWriteKey, "inner:" + CmdWriteKey,
+		"outer:kmystery", "inner:kmystery",
+	}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected middleware calls: %v", got)
+	}
+}
+
+func TestRegisterCommand(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub := createInMemoryHub(t, log)
+	other := createInMemoryHub(t, log)
+	defer other.Close()
+
+	// Appends to a key and returns the new value
+	err := hub.RegisterCommand("kappend", func(hub *Hub, client Client, msg Request) {
+		if !hub.RequireAuth(client, msg) {
+			return
+		}
+		key, ok := msg.Data["key"].(string)
+		if !ok {
+			hub.SendError(client, msg, ErrMissingParam, "invalid or missing 'key' parameter")
+			return
+		}
+		if !hub.RequirePermission(client, msg, PermRead|PermWrite, key) {
+			return
+		}
+		realKey := hub.ClientKey(client, key)
+		current, _ := hub.db.Get(realKey)
+		current += msg.Data["data"].(string)
+		if err := hub.db.Set(realKey, current); err != nil {
+			hub.SendError(client, msg, ErrServerError, err.Error())
+			return
+		}
+		SendResponse(client, msg.RequestID, current)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.RegisterCommand(CmdWriteKey, func(*Hub, Client, Request) {}); !errors.Is(err, ErrCommandExists) {
+		t.Fatalf("replaced a built-in command (%v)", err)
+	}
+
+	makeHubClientWith(t, hub, log, func(hub *Hub, client *LocalClient) {
+		for _, expected := range []string{"a", "aa"} {
+			req, chn := client.MakeRequest("kappend", map[string]interface{}{"key": "append", "data": "a"})
+			hub.SendMessage(req)
+			resp := mustSucceed(t, waitReply(t, chn))
+			if resp.Data != expected {
+				t.Fatalf("expected \"%s\", got %v", expected, resp.Data)
+			}
+		}
+		assertKey(t, hub, "append", "aa")
+	})
+
+	// Other hubs don't get the command
+	makeHubClientWith(t, other, log, func(hub *Hub, client *LocalClient) {
+		req, chn := client.MakeRequest("kappend", map[string]interface{}{"key": "append", "data": "a"})
+		hub.SendMessage(req)
+		if resp := mustFail(t, waitReply(t, chn)); resp.Error != ErrUnknownCmd {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrUnknownCmd, resp.Error)
+		}
+	})
+}
+
+func TestHubReadWrite(t *testing.T) {
+	makeHubClient(t, func(hub *Hub, client *LocalClient) {
+		req, chn := client.MakeRequest(CmdSubscribePrefix, map[string]interface{}{"prefix": "api-"})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+
+		pushes := make(chan string, 10)
+		cid := client.SetPrefixSubCallback("api-", func(key string, data string) {
+			pushes <- key + "=" + data
+		})
+		defer client.UnsetCallback(cid)
+		expectPush := func(expected string) {
+			select {
+			case <-time.After(10 * time.Second):
+				t.Fatalf("push for %s took too long to arrive", expected)
+			case push := <-pushes:
+				if push != expected {
+					t.Fatalf("expected push %s, got %s", expected, push)
+				}
+			}
+		}
+
+		// Keys are not namespaced
+		if err := hub.Set(test_namespace+"api-a", "1"); err != nil {
+			t.Fatal(err)
+		}
+		expectPush("api-a=1")
+		if value, err := hub.Get(test_namespace + "api-a"); err != nil || value != "1" {
+			t.Fatalf("expected 1, got %s (%v)", value, err)
+		}
+
+		if err := hub.SetBulk(map[string]string{test_namespace + "api-b": "2"}); err != nil {
+			t.Fatal(err)
+		}
+		expectPush("api-b=2")
+
+		if err := hub.Delete(test_namespace + "api-a"); err != nil {
+			t.Fatal(err)
+		}
+		expectPush("api-a=")
+		if _, err := hub.Get(test_namespace + "api-a"); err != ErrorKeyNotFound {
+			t.Fatalf("expected key to be deleted, got %v", err)
+		}
+	})
+}
+
+func TestWatch(t *testing.T) {
+	makeHubClient(t, func(hub *Hub, client *LocalClient) {
+		changes := make(chan Change, 10)
+		stop := hub.Watch(test_namespace+"watched/", func(change Change) {
+			changes <- change
+		})
+		defer stop()
+
+		// Watchers can write keys themselves
+		stopEcho := hub.Watch(test_namespace+"watched/echo", func(change Change) {
+			if change.Event == PushEventSet {
+				_ = hub.Set(test_namespace+"echoed", change.NewValue)
+			}
+		})
+		defer stopEcho()
+
+		expect := func(key string, event PushEvent, oldValue string, oldExists bool, newValue string, fromClient bool) {
+			select {
+			case <-time.After(10 * time.Second):
+				t.Fatalf("change to %s took too long to arrive", key)
+			case change := <-changes:
+				if change.Key != test_namespace+key || change.Event != event || change.OldValue != oldValue || change.OldExists != oldExists || change.NewValue != newValue {
+					t.Fatalf("unexpected change: %+v", change)
+				}
+				if fromClient != (change.Client != nil) {
+					t.Fatalf("unexpected client for change: %+v", change)
+				}
+			}
+		}
+
+		req, chn := client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "watched/a", "data": "1"})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+		expect("watched/a", PushEventSet, "", false, "1", true)
+
+		if err := hub.Set(test_namespace+"watched/a", "2"); err != nil {
+			t.Fatal(err)
+		}
+		expect("watched/a", PushEventSet, "1", true, "2", false)
+
+		req, chn = client.MakeRequest(CmdRemoveKey, map[string]interface{}{"key": "watched/a"})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+		expect("watched/a", PushEventDelete, "2", true, "", true)
+
+		req, chn = client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "watched/b", "data": "short-lived", "ttl": 0.05})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+		expect("watched/b", PushEventSet, "", false, "short-lived", true)
+		expect("watched/b", PushEventExpire, "short-lived", true, "", false)
+
+		// Keys outside the prefix are not watched
+		if err := hub.Set(test_namespace+"other", "x"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := hub.Set(test_namespace+"watched/echo", "hello"); err != nil {
+			t.Fatal(err)
+		}
+		expect("watched/echo", PushEventSet, "", false, "hello", false)
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			if value, _ := hub.Get(test_namespace + "echoed"); value == "hello" {
+				break
+			}
+			if time.Since(start) > 10*time.Second {
+				t.Fatal("watcher could not write a key")
+			}
+		}
+
+		// No more changes after stopping
+		stop()
+		if err := hub.Set(test_namespace+"watched/a", "3"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case change := <-changes:
+			t.Fatalf("change received after stopping: %+v", change)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{Password: "hunter2"})
+	defer hub.Close()
+	go hub.Run()
+
+	events := make(chan string, 10)
+	hub.OnConnect(func(info ClientInfo) {
+		events <- "connect " + info.Options.Namespace
+	})
+	hub.OnAuthenticated(func(info ClientInfo, method AuthType) {
+		events <- "authenticated " + string(method) + " " + strconv.FormatBool(info.Authenticated)
+	})
+	hub.OnCommandError(func(info ClientInfo, request Request, err Error) {
+		events <- "error " + request.CmdName + " " + string(err.Error)
+	})
+	hub.OnDisconnect(func(info ClientInfo) {
+		events <- "disconnect " + strconv.FormatBool(info.Authenticated)
+	})
+	expect := func(expected string) {
+		select {
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s hook took too long to run", expected)
+		case event := <-events:
+			if event != expected {
+				t.Fatalf("expected \"%s\" hook, got \"%s\"", expected, event)
+			}
+		}
+	}
+
+	client := NewLocalClient(ClientOptions{Namespace: test_namespace}, log)
+	defer client.Close()
+	go client.Run()
+	hub.AddClient(client)
+	client.Wait()
+	expect("connect " + test_namespace)
+
+	req, chn := client.MakeRequest(CmdReadKey, map[string]interface{}{"key": "test"})
+	hub.SendMessage(req)
+	mustFail(t, waitReply(t, chn))
+	expect("error " + CmdReadKey + " " + string(ErrAuthRequired))
+
+	mustSucceed(t, authenticate(t, hub, client, nil, "hunter2"))
+	expect("authenticated " + string(AuthTypeChallenge) + " true")
+
+	hub.RemoveClient(client)
+	expect("disconnect true")
+}
+
+func TestCommandErrorHookWrites(t *testing.T) {
+	makeHubClient(t, func(hub *Hub, client *LocalClient) {
+		// Fix up the key the command failed on, while the command holds it
+		hub.OnCommandError(func(info ClientInfo, request Request, err Error) {
+			key := info.Options.Namespace + request.Data["key"].(string)
+			if err := hub.Set(key, "fixed"); err != nil {
+				t.Error(err)
+			}
+		})
+
+		req, chn := client.MakeRequest(CmdCompareAndSwap, map[string]interface{}{"key": "test", "data": "new", "revision": 42})
+		hub.SendMessage(req)
+		if resp := mustFail(t, waitReply(t, chn)); resp.Error != ErrRevisionMismatch {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrRevisionMismatch, resp.Error)
+		}
+
+		// Runs after the hook
+		req, chn = client.MakeRequest(CmdReadKey, map[string]interface{}{"key": "test"})
+		hub.SendMessage(req)
+		resp := mustSucceed(t, waitReply(t, chn))
+		if value := resp.Data.(map[string]interface{}); value["value"] != "fixed" {
+			t.Fatalf("hook write not applied, got %v", value)
+		}
+	})
+}
+
+func TestExpiryAfterRestart(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	dir := t.TempDir()
+
+	db := openTestFileBackend(t, dir)
+	hub, err := NewHub(db, HubOptions{}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hub.Run()
+	client := NewLocalClient(ClientOptions{}, log)
+	go client.Run()
+	hub.AddClient(client)
+	client.Wait()
+	req, chn := client.MakeRequest(CmdWriteKey, map[string]interface{}{
+		"key":  "ttl",
+		"data": "value",
+		"ttl":  0.2,
+	})
+	hub.SendMessage(req)
+	mustSucceed(t, waitReply(t, chn))
+	client.Close()
+	hub.Close()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key must still expire with a new hub
+	db = openTestFileBackend(t, dir)
+	defer db.Close()
+	hub, err = NewHub(db, HubOptions{}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	go hub.Run()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := db.Get("ttl"); err == ErrorKeyNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("key did not expire after restarting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
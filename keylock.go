@@ -0,0 +1,50 @@
+package kv
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// Number of mutexes keys are spread across
+const keyLockStripes = 256
+
+// keyLocks serializes writes to the same key while letting writes to unrelated keys
+// run in parallel. Keys are hashed onto a fixed set of mutexes, so unrelated keys
+// can occasionally share one.
+//
+// Writers hold the locks of their keys until subscribers have been notified,
+// which is what keeps pushes for a key in the same order as its writes.
+type keyLocks struct {
+	stripes [keyLockStripes]sync.Mutex
+}
+
+// Lock locks every given key and returns a function that unlocks them.
+// Locks are always taken in the same order, so locking multiple keys can't deadlock.
+func (l *keyLocks) Lock(keys ...string) func() {
+	indexes := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		index := stripeIndex(key)
+		if !seen[index] {
+			seen[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+
+	for _, index := range indexes {
+		l.stripes[index].Lock()
+	}
+	return func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			l.stripes[indexes[i]].Unlock()
+		}
+	}
+}
+
+func stripeIndex(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % keyLockStripes)
+}
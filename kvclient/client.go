@@ -0,0 +1,591 @@
+// Package kvclient is a client for kilovolt servers, like kv-server, over websocket.
+//
+// Clients reconnect on their own when the connection drops, authenticating again
+// (resuming their session when possible) and restoring their subscriptions.
+package kvclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+
+	kv "git.sr.ht/~ashkeel/kilovolt/v11"
+)
+
+var json = jsoniter.ConfigDefault
+
+var (
+	// ErrDisconnected is returned by requests that were waiting for a reply when the connection dropped,
+	// the command might or might not have run
+	ErrDisconnected = errors.New("disconnected before getting a reply")
+
+	// ErrClosed is returned by requests made after the client is closed
+	ErrClosed = errors.New("client is closed")
+
+	// The connection dropped before the command could be sent, so it can be sent again
+	errNotSent = fmt.Errorf("%w (command not sent)", ErrDisconnected)
+)
+
+const (
+	defaultMinReconnectDelay = 500 * time.Millisecond
+	defaultMaxReconnectDelay = 30 * time.Second
+
+	defaultConnectTimeout = 10 * time.Second
+
+	// Servers send several messages in a single frame when they can
+	readLimit = 32 * 1024 * 1024
+)
+
+type Options struct {
+	// Password of the server (or of the user, if Username is set), for challenge authentication
+	Username string
+	Password string
+
+	// API token, used instead of Username and Password if set
+	Token string
+
+	// Added to the websocket handshake request, e.g. for Origin
+	HTTPHeader http.Header
+	HTTPClient *http.Client
+
+	// How long to wait before reconnecting after the connection drops, doubling after each
+	// failed attempt up to MaxReconnectDelay (defaults to 500ms and 30s)
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+
+	// How long connecting can take, from dialing to the server's hello, authentication and
+	// restoring subscriptions (defaults to 10s)
+	ConnectTimeout time.Duration
+
+	Logger *zap.Logger
+}
+
+// Callback is called with every change to a subscribed key, value is empty for deletions and expirations.
+//
+// Callbacks are called one at a time, in the order changes arrive, on a goroutine of their own.
+// They can call client methods, changes that arrive meanwhile are queued (with no limit), so
+// callbacks that take long make the queue grow.
+type Callback func(key string, value string, event kv.PushEvent)
+
+// Client is a connection to a kilovolt server, safe for concurrent use
+type Client struct {
+	url     string
+	options Options
+	logger  *zap.Logger
+
+	// Cancelled when the client is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Current connection, nil while reconnecting. ready is closed when a connection is available.
+	conn  *connection
+	ready chan struct{}
+
+	// Token to resume the session with after reconnecting
+	session string
+
+	subscriptions *subscriptions
+	pushes        *pushQueue
+
+	// Held while subscribing or unsubscribing, so the server always ends up with what callbacks need
+	subscribeMu sync.Mutex
+
+	lastID atomic.Uint64
+	done   chan struct{}
+	mu     sync.Mutex
+}
+
+// connection is a single websocket connection, replaced when reconnecting
+type connection struct {
+	ws *websocket.Conn
+
+	// Closed when the server says hello, requests can't be sent before that
+	hello chan struct{}
+
+	// Closed when the connection drops, err tells why
+	dead chan struct{}
+	err  error
+
+	// Requests waiting for a reply, by request ID
+	pending map[string]chan reply
+	closed  bool
+	mu      sync.Mutex
+}
+
+type reply struct {
+	data jsoniter.RawMessage
+	err  error
+}
+
+// message is any message sent by the server
+type message struct {
+	Type      string              `json:"type"`
+	Ok        bool                `json:"ok"`
+	RequestID string              `json:"request_id"`
+	Data      jsoniter.RawMessage `json:"data"`
+
+	// Errors
+	Error      kv.ErrCode `json:"error"`
+	Details    string     `json:"details"`
+	RetryAfter int64      `json:"retry_after"`
+
+	// Pushes
+	Key      string       `json:"key"`
+	NewValue string       `json:"new_value"`
+	Event    kv.PushEvent `json:"event"`
+}
+
+// Dial connects to a kilovolt server and authenticates, url is a websocket URL like "ws://localhost:8080".
+// Only the first connection has to succeed, the client keeps reconnecting after that until it's closed.
+func Dial(ctx context.Context, url string, options Options) (*Client, error) {
+	if options.MinReconnectDelay <= 0 {
+		options.MinReconnectDelay = defaultMinReconnectDelay
+	}
+	if options.MaxReconnectDelay < options.MinReconnectDelay {
+		options.MaxReconnectDelay = defaultMaxReconnectDelay
+	}
+	if options.ConnectTimeout <= 0 {
+		options.ConnectTimeout = defaultConnectTimeout
+	}
+	if options.Logger == nil {
+		options.Logger = zap.NewNop()
+	}
+
+	clientCtx, cancel := context.WithCancel(context.Background())
+	client := &Client{
+		url:           url,
+		options:       options,
+		logger:        options.Logger,
+		ctx:           clientCtx,
+		cancel:        cancel,
+		ready:         make(chan struct{}),
+		subscriptions: newSubscriptions(),
+		pushes:        newPushQueue(),
+		done:          make(chan struct{}),
+	}
+
+	conn, err := client.connect(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	client.setConnection(conn)
+	go client.dispatchPushes()
+	go client.run(conn)
+	return client, nil
+}
+
+// Close disconnects from the server, requests waiting for a reply fail with ErrDisconnected
+func (c *Client) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		conn.ws.Close(websocket.StatusNormalClosure, "bye")
+	}
+	<-c.done
+	return nil
+}
+
+// run keeps the client connected until it's closed
+func (c *Client) run(conn *connection) {
+	defer close(c.done)
+
+	delay := c.options.MinReconnectDelay
+	for {
+		<-conn.dead
+		// read already does this, unless the connection dropped before it was set
+		c.dropConnection(conn)
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.logger.Warn("disconnected from server, reconnecting", zap.Error(conn.err))
+
+		// Try again until it works or the client is closed
+		for {
+			// Wait a random time up to the delay, so clients don't all come back at once
+			wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+			select {
+			case <-time.After(wait):
+			case <-c.ctx.Done():
+				return
+			}
+
+			var err error
+			conn, err = c.connect(c.ctx)
+			if err == nil {
+				break
+			}
+			c.logger.Warn("could not reconnect to server", zap.Error(err))
+			delay *= 2
+			if delay > c.options.MaxReconnectDelay {
+				delay = c.options.MaxReconnectDelay
+			}
+		}
+		delay = c.options.MinReconnectDelay
+		c.setConnection(conn)
+		c.logger.Info("reconnected to server")
+	}
+}
+
+// setConnection makes requests use a new connection
+func (c *Client) setConnection(conn *connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	close(c.ready)
+}
+
+// dropConnection makes requests wait for a new connection, if conn is the current one
+func (c *Client) dropConnection(conn *connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == conn {
+		c.conn = nil
+		c.ready = make(chan struct{})
+	}
+}
+
+// connection returns the current connection, waiting for the client to reconnect if needed
+func (c *Client) connection(ctx context.Context) (*connection, error) {
+	for {
+		c.mu.Lock()
+		conn, ready := c.conn, c.ready
+		c.mu.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.ctx.Done():
+			return nil, ErrClosed
+		}
+	}
+}
+
+// connect opens a new connection, authenticates and restores subscriptions
+func (c *Client) connect(ctx context.Context) (*connection, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.options.ConnectTimeout)
+	defer cancel()
+
+	ws, _, err := websocket.Dial(ctx, c.url, &websocket.DialOptions{
+		HTTPClient:   c.options.HTTPClient,
+		HTTPHeader:   c.options.HTTPHeader,
+		Subprotocols: []string{kv.Subprotocol},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ws.SetReadLimit(readLimit)
+	conn := &connection{
+		ws:      ws,
+		hello:   make(chan struct{}),
+		dead:    make(chan struct{}),
+		pending: make(map[string]chan reply),
+	}
+	go c.read(conn)
+
+	// Drop the connection and wait for read to be done with it
+	abort := func(err error) (*connection, error) {
+		ws.CloseNow()
+		<-conn.dead
+		return nil, err
+	}
+
+	select {
+	case <-conn.hello:
+	case <-conn.dead:
+		return nil, conn.err
+	case <-ctx.Done():
+		return abort(ctx.Err())
+	}
+
+	if err := c.authenticate(ctx, conn); err != nil {
+		return abort(err)
+	}
+	for _, sub := range c.subscriptions.targets() {
+		if err := c.roundTrip(ctx, conn, sub.command(true), sub.params(), nil); err != nil {
+			return abort(err)
+		}
+	}
+	return conn, nil
+}
+
+// read handles messages from the server until the connection drops
+func (c *Client) read(conn *connection) {
+	var err error
+	defer func() {
+		conn.ws.CloseNow()
+		conn.fail(err)
+		c.dropConnection(conn)
+		close(conn.dead)
+	}()
+
+	for {
+		var data []byte
+		_, data, err = conn.ws.Read(c.ctx)
+		if err != nil {
+			return
+		}
+		// Servers can send several messages in a frame, separated by newlines
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var msg message
+			if err := json.Unmarshal(line, &msg); err != nil {
+				c.logger.Warn("invalid message from server", zap.Error(err))
+				continue
+			}
+			c.handle(conn, msg)
+		}
+	}
+}
+
+func (c *Client) handle(conn *connection, msg message) {
+	if msg.RequestID != "" {
+		if msg.Ok {
+			conn.reply(msg.RequestID, reply{data: msg.Data})
+		} else {
+			conn.reply(msg.RequestID, reply{err: &kv.CommandError{
+				Code:       msg.Error,
+				Details:    msg.Details,
+				RetryAfter: time.Duration(msg.RetryAfter) * time.Millisecond,
+			}})
+		}
+		return
+	}
+
+	switch msg.Type {
+	case "hello":
+		select {
+		case <-conn.hello:
+		default:
+			close(conn.hello)
+		}
+	case "push":
+		// Never wait for callbacks here, they might be waiting for a reply only we can deliver
+		c.pushes.add(kv.Push{CmdType: msg.Type, Key: msg.Key, NewValue: msg.NewValue, Event: msg.Event})
+	}
+}
+
+// dispatchPushes calls subscription callbacks, one at a time and in the order pushes arrived
+func (c *Client) dispatchPushes() {
+	for {
+		select {
+		case <-c.pushes.ready:
+			for _, push := range c.pushes.take() {
+				for _, callback := range c.subscriptions.callbacks(push.Key) {
+					callback(push.Key, push.NewValue, push.Event)
+				}
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// pushQueue holds pushes until their callbacks are called, adding to it never blocks
+type pushQueue struct {
+	pushes []kv.Push
+
+	// Receives a value when there are pushes to take
+	ready chan struct{}
+	mu    sync.Mutex
+}
+
+func newPushQueue() *pushQueue {
+	return &pushQueue{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *pushQueue) add(push kv.Push) {
+	q.mu.Lock()
+	q.pushes = append(q.pushes, push)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+		// Already signaled
+	}
+}
+
+// take removes and returns every queued push
+func (q *pushQueue) take() []kv.Push {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pushes := q.pushes
+	q.pushes = nil
+	return pushes
+}
+
+// reply delivers the reply to a request, if anyone is still waiting for it
+func (conn *connection) reply(requestID string, r reply) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if chn, ok := conn.pending[requestID]; ok {
+		delete(conn.pending, requestID)
+		chn <- r
+	}
+}
+
+// fail makes every request waiting for a reply fail, and any further request fail right away
+func (conn *connection) fail(err error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if err == nil {
+		err = ErrDisconnected
+	}
+	conn.err = err
+	conn.closed = true
+	for requestID, chn := range conn.pending {
+		chn <- reply{err: ErrDisconnected}
+		delete(conn.pending, requestID)
+	}
+}
+
+// request sends a command on the current connection and decodes its reply into out, if it's not nil
+func (c *Client) request(ctx context.Context, cmd string, data map[string]any, out any) error {
+	for {
+		conn, err := c.connection(ctx)
+		if err != nil {
+			return err
+		}
+		err = c.roundTrip(ctx, conn, cmd, data, out)
+		if err != errNotSent {
+			return err
+		}
+		// Try again once reconnected, the connection is dropped before dead is closed
+		select {
+		case <-conn.dead:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.ctx.Done():
+			return ErrClosed
+		}
+	}
+}
+
+// roundTrip sends a command on a connection and decodes its reply into out, if it's not nil
+func (c *Client) roundTrip(ctx context.Context, conn *connection, cmd string, data map[string]any, out any) error {
+	requestID := strconv.FormatUint(c.lastID.Add(1), 36)
+	payload, err := json.Marshal(kv.Request{CmdName: cmd, RequestID: requestID, Data: data})
+	if err != nil {
+		return err
+	}
+
+	chn := make(chan reply, 1)
+	conn.mu.Lock()
+	if conn.closed {
+		conn.mu.Unlock()
+		return errNotSent
+	}
+	conn.pending[requestID] = chn
+	conn.mu.Unlock()
+	forget := func() {
+		conn.mu.Lock()
+		delete(conn.pending, requestID)
+		conn.mu.Unlock()
+	}
+
+	if err := conn.ws.Write(ctx, websocket.MessageText, payload); err != nil {
+		forget()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errNotSent
+	}
+
+	select {
+	case r := <-chn:
+		if r.err != nil || out == nil {
+			return r.err
+		}
+		return json.Unmarshal(r.data, out)
+	case <-ctx.Done():
+		forget()
+		return ctx.Err()
+	}
+}
+
+// authenticate logs in on a new connection, resuming the session if there's one
+func (c *Client) authenticate(ctx context.Context, conn *connection) error {
+	var result struct {
+		Challenge string `json:"challenge"`
+		Salt      string `json:"salt"`
+		Session   string `json:"session"`
+	}
+
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	if session != "" {
+		err := c.roundTrip(ctx, conn, kv.CmdResume, map[string]any{"session": session}, &result)
+		if err == nil {
+			c.setSession(result.Session)
+			return nil
+		}
+		if !errors.Is(err, kv.ErrAuthFailed) {
+			return err
+		}
+		// The session expired, log in again
+	}
+
+	switch {
+	case c.options.Token != "":
+		err := c.roundTrip(ctx, conn, kv.CmdAuthRequest, map[string]any{"auth": string(kv.AuthTypeToken), "token": c.options.Token}, &result)
+		if err != nil {
+			return err
+		}
+	case c.options.Password != "":
+		login := map[string]any{}
+		if c.options.Username != "" {
+			login["username"] = c.options.Username
+		}
+		if err := c.roundTrip(ctx, conn, kv.CmdAuthRequest, login, &result); err != nil {
+			return err
+		}
+		challenge, err := base64.StdEncoding.DecodeString(result.Challenge)
+		if err != nil {
+			return err
+		}
+		salt, err := base64.StdEncoding.DecodeString(result.Salt)
+		if err != nil {
+			return err
+		}
+		hash := hmac.New(sha256.New, append([]byte(c.options.Password), salt...))
+		hash.Write(challenge)
+		err = c.roundTrip(ctx, conn, kv.CmdAuthChallenge, map[string]any{"hash": base64.StdEncoding.EncodeToString(hash.Sum(nil))}, &result)
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	c.setSession(result.Session)
+	return nil
+}
+
+func (c *Client) setSession(session string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.session = session
+}
@@ -0,0 +1,250 @@
+package kvclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+
+	kv "git.sr.ht/~ashkeel/kilovolt/v11"
+)
+
+func startServer(t *testing.T, options kv.HubOptions) (*kv.Hub, string) {
+	return startServerWith(t, options, kv.ClientOptions{})
+}
+
+func startServerWith(t *testing.T, options kv.HubOptions, clientOptions kv.ClientOptions) (*kv.Hub, string) {
+	log, _ := zap.NewDevelopment()
+	db, err := kv.NewMemoryBackend(kv.MemoryBackendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub, err := kv.NewHub(db, options, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hub.Run()
+	t.Cleanup(hub.Close)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub.CreateWebsocketClient(w, r, clientOptions)
+	}))
+	t.Cleanup(server.Close)
+	return hub, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestClient(t *testing.T) {
+	_, url := startServer(t, kv.HubOptions{Password: "hunter2"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := Dial(ctx, url, Options{Password: "wrong"}); !errors.Is(err, kv.ErrAuthFailed) {
+		t.Fatalf("expected authentication to fail, got %v", err)
+	}
+
+	client, err := Dial(ctx, url, Options{Password: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if version, err := client.Version(ctx); err != nil || version != kv.ProtoVersion {
+		t.Fatalf("unexpected version %s (%v)", version, err)
+	}
+	if _, err := client.Get(ctx, "missing"); err != kv.ErrorKeyNotFound {
+		t.Fatalf("expected kv.ErrorKeyNotFound, got %v", err)
+	}
+	if err := client.SetBulk(ctx, map[string]string{"a": "1", "b": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	values, err := client.GetPrefix(ctx, "")
+	if err != nil || len(values) != 2 || values["b"] != "2" {
+		t.Fatalf("unexpected values %v (%v)", values, err)
+	}
+
+	current, err := client.GetRevision(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision, err := client.CompareAndSwap(ctx, "a", "3", current.Revision)
+	if err != nil || revision <= current.Revision {
+		t.Fatalf("compare and swap failed: revision %d (%v)", revision, err)
+	}
+	if _, err := client.CompareAndSwap(ctx, "a", "4", current.Revision); !errors.Is(err, kv.ErrRevisionMismatch) {
+		t.Fatalf("expected revision mismatch, got %v", err)
+	}
+
+	results, err := client.Transaction(ctx, TxCompareValue("a", "3"), TxDelete("b"), TxGet("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0] != nil || results[2] == nil || results[2].Value != "3" {
+		t.Fatalf("unexpected transaction results %+v", results)
+	}
+	if keys, err := client.List(ctx, ""); err != nil || len(keys) != 1 {
+		t.Fatalf("unexpected keys %v (%v)", keys, err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	t.Run("resume session", func(t *testing.T) {
+		testReconnect(t, 0)
+	})
+	t.Run("log in again", func(t *testing.T) {
+		testReconnect(t, -1)
+	})
+}
+
+func testReconnect(t *testing.T, sessionTimeout time.Duration) {
+	hub, url := startServer(t, kv.HubOptions{Password: "hunter2", SessionTimeout: sessionTimeout})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, url, Options{Password: "hunter2", MinReconnectDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	pushes := make(chan string, 10)
+	if _, err := client.SubscribePrefix(ctx, "watched/", func(key string, value string, event kv.PushEvent) {
+		pushes <- key + "=" + value
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectPush := func(expected string) {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("push for %s took too long to arrive", expected)
+		case push := <-pushes:
+			if push != expected {
+				t.Fatalf("expected push %s, got %s", expected, push)
+			}
+		}
+	}
+	if err := hub.Set("watched/a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	expectPush("watched/a=1")
+
+	// Drop the connection, requests wait for the client to reconnect and log in again
+	client.mu.Lock()
+	client.conn.ws.CloseNow()
+	client.mu.Unlock()
+	if err := client.Set(ctx, "watched/b", "2"); err != nil && !errors.Is(err, ErrDisconnected) {
+		t.Fatal(err)
+	}
+	if err := client.Set(ctx, "watched/b", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscriptions are restored
+	for {
+		push := <-pushes
+		if push == "watched/b=3" {
+			break
+		}
+	}
+	if err := hub.Set("watched/c", "4"); err != nil {
+		t.Fatal(err)
+	}
+	expectPush("watched/c=4")
+
+	client.Close()
+	if err := client.Set(ctx, "watched/d", "5"); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestClientCallbackRequests(t *testing.T) {
+	// The server must not drop pushes for this one
+	const total = 1000
+	hub, url := startServerWith(t, kv.HubOptions{}, kv.ClientOptions{QueueSize: 2 * total})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, url, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Callbacks making requests while lots of pushes arrive must not block the client
+	seen := make(chan string, total)
+	if _, err := client.SubscribePrefix(ctx, "burst/", func(key string, value string, event kv.PushEvent) {
+		if _, err := client.Get(ctx, key); err != nil {
+			t.Errorf("request from callback failed: %s", err)
+		}
+		seen <- key
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < total; i++ {
+		if err := hub.Set("burst/"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < total; i++ {
+		select {
+		case <-seen:
+		case <-ctx.Done():
+			t.Fatalf("only %d pushes handled, client is stuck", i)
+		}
+	}
+}
+
+func TestClientConnectTimeout(t *testing.T) {
+	// Accepts websocket connections but never says hello
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{kv.Subprotocol}})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		_, _, _ = conn.Read(r.Context())
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, err := Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), Options{ConnectTimeout: 100 * time.Millisecond})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("connect took %s", elapsed)
+	}
+}
+
+func TestClientSubscribeDenied(t *testing.T) {
+	_, url := startServerWith(t, kv.HubOptions{}, kv.ClientOptions{
+		ACL: kv.ACL{{Pattern: "public/*", Permissions: kv.PermSubscribe}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, url, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	callback := func(key string, value string, event kv.PushEvent) {}
+	if _, err := client.Subscribe(ctx, "public/title", callback); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Subscribe(ctx, "secret", callback); !errors.Is(err, kv.ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+
+	// Subscriptions are registered before being sent, failed ones must not be restored later
+	if targets := client.subscriptions.targets(); len(targets) != 1 || targets[0].target != "public/title" {
+		t.Fatalf("unexpected subscriptions %+v", targets)
+	}
+}
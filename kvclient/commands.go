@@ -0,0 +1,180 @@
+package kvclient
+
+import (
+	"context"
+	"time"
+
+	kv "git.sr.ht/~ashkeel/kilovolt/v11"
+)
+
+// Errors sent by the server are returned as a *kv.CommandError, so they can be matched
+// with errors.Is(err, kv.ErrPermissionDenied) and so on. Requests made while the client
+// is reconnecting wait for the connection to come back (or for ctx to be done).
+
+// Do sends any command to the server and decodes the data of its reply into out, if it's not nil
+func (c *Client) Do(ctx context.Context, cmd string, data map[string]any, out any) error {
+	return c.request(ctx, cmd, data, out)
+}
+
+// Version returns the protocol version of the server
+func (c *Client) Version(ctx context.Context) (string, error) {
+	var version string
+	err := c.request(ctx, kv.CmdProtoVersion, nil, &version)
+	return version, err
+}
+
+// Get returns the value of a key, or kv.ErrorKeyNotFound if it doesn't exist
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var result kv.KeyValue
+	if err := c.request(ctx, kv.CmdReadKey, map[string]any{"key": key}, &result); err != nil {
+		return "", err
+	}
+	if !result.Exists {
+		return "", kv.ErrorKeyNotFound
+	}
+	return result.Value, nil
+}
+
+// GetRevision returns the value and revision of a key, Exists is false if it doesn't exist
+func (c *Client) GetRevision(ctx context.Context, key string) (kv.KeyValue, error) {
+	var result kv.KeyValue
+	err := c.request(ctx, kv.CmdReadKey, map[string]any{"key": key, "revision": true}, &result)
+	return result, err
+}
+
+// GetBulk returns the values of several keys, leaving out the ones that don't exist
+func (c *Client) GetBulk(ctx context.Context, keys []string) (map[string]string, error) {
+	list := make([]any, len(keys))
+	for index, key := range keys {
+		list[index] = key
+	}
+	result := make(map[string]string)
+	err := c.request(ctx, kv.CmdReadBulk, map[string]any{"keys": list}, &result)
+	return result, err
+}
+
+// GetPrefix returns every key starting with prefix and its value
+func (c *Client) GetPrefix(ctx context.Context, prefix string) (map[string]string, error) {
+	result := make(map[string]string)
+	err := c.request(ctx, kv.CmdReadPrefix, map[string]any{"prefix": prefix}, &result)
+	return result, err
+}
+
+// Set writes a key
+func (c *Client) Set(ctx context.Context, key string, value string) error {
+	return c.request(ctx, kv.CmdWriteKey, map[string]any{"key": key, "data": value}, nil)
+}
+
+// SetTTL writes a key that expires after ttl
+func (c *Client) SetTTL(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return c.request(ctx, kv.CmdWriteKey, map[string]any{"key": key, "data": value, "ttl": ttl.Seconds()}, nil)
+}
+
+// SetBulk writes several keys at once
+func (c *Client) SetBulk(ctx context.Context, kvs map[string]string) error {
+	data := make(map[string]any, len(kvs))
+	for key, value := range kvs {
+		data[key] = value
+	}
+	return c.request(ctx, kv.CmdWriteBulk, data, nil)
+}
+
+// CompareAndSwap writes a key only if it's at the given revision (0 if it must not exist),
+// returning its new revision. It fails with kv.ErrRevisionMismatch otherwise.
+func (c *Client) CompareAndSwap(ctx context.Context, key string, value string, revision uint64) (uint64, error) {
+	var result struct {
+		Revision uint64 `json:"revision"`
+	}
+	err := c.request(ctx, kv.CmdCompareAndSwap, map[string]any{"key": key, "data": value, "revision": revision}, &result)
+	return result.Revision, err
+}
+
+// Delete removes a key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.request(ctx, kv.CmdRemoveKey, map[string]any{"key": key}, nil)
+}
+
+// List returns the keys starting with prefix
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := c.request(ctx, kv.CmdListKeys, map[string]any{"prefix": prefix}, &keys)
+	return keys, err
+}
+
+// TxOp is an operation of a transaction, see the Tx functions
+type TxOp map[string]any
+
+func TxGet(key string) TxOp {
+	return TxOp{"op": "get", "key": key}
+}
+
+func TxSet(key string, value string) TxOp {
+	return TxOp{"op": "set", "key": key, "data": value}
+}
+
+func TxDelete(key string) TxOp {
+	return TxOp{"op": "delete", "key": key}
+}
+
+// TxCompareValue makes the transaction fail unless key has the given value
+func TxCompareValue(key string, value string) TxOp {
+	return TxOp{"op": "compare", "key": key, "value": value}
+}
+
+// TxCompareRevision makes the transaction fail unless key is at the given revision
+func TxCompareRevision(key string, revision uint64) TxOp {
+	return TxOp{"op": "compare", "key": key, "revision": revision}
+}
+
+// TxCompareExists makes the transaction fail unless key exists (or doesn't)
+func TxCompareExists(key string, exists bool) TxOp {
+	return TxOp{"op": "compare", "key": key, "exists": exists}
+}
+
+// Transaction runs operations atomically, returning a result for each of them (nil for
+// everything but gets). It fails with kv.ErrCompareFailed if a comparison doesn't match.
+func (c *Client) Transaction(ctx context.Context, ops ...TxOp) ([]*kv.KeyValue, error) {
+	list := make([]any, len(ops))
+	for index, op := range ops {
+		list[index] = map[string]any(op)
+	}
+	var results []*kv.KeyValue
+	err := c.request(ctx, kv.CmdTransaction, map[string]any{"ops": list}, &results)
+	return results, err
+}
+
+// Subscribe calls callback every time key changes, until the returned ID is passed to Unsubscribe.
+// See Callback for what callbacks can do.
+func (c *Client) Subscribe(ctx context.Context, key string, callback Callback) (int64, error) {
+	return c.subscribe(ctx, subscription{target: key}, callback)
+}
+
+// SubscribePrefix calls callback every time a key starting with prefix changes,
+// until the returned ID is passed to Unsubscribe
+func (c *Client) SubscribePrefix(ctx context.Context, prefix string, callback Callback) (int64, error) {
+	return c.subscribe(ctx, subscription{prefix: true, target: prefix}, callback)
+}
+
+func (c *Client) subscribe(ctx context.Context, sub subscription, callback Callback) (int64, error) {
+	c.subscribeMu.Lock()
+	defer c.subscribeMu.Unlock()
+	// Register first, so the subscription is restored if the client reconnects before the reply
+	id := c.subscriptions.add(sub, callback)
+	if err := c.request(ctx, sub.command(true), sub.params(), nil); err != nil {
+		c.subscriptions.remove(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// Unsubscribe stops calling a callback added with Subscribe or SubscribePrefix, the server
+// stops sending changes once no other callback needs them
+func (c *Client) Unsubscribe(ctx context.Context, id int64) error {
+	c.subscribeMu.Lock()
+	defer c.subscribeMu.Unlock()
+	sub, last, ok := c.subscriptions.remove(id)
+	if !ok || !last {
+		return nil
+	}
+	return c.request(ctx, sub.command(false), sub.params(), nil)
+}
@@ -0,0 +1,114 @@
+package kvclient
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	kv "git.sr.ht/~ashkeel/kilovolt/v11"
+)
+
+// subscription is a key or prefix the client is subscribed to on the server
+type subscription struct {
+	prefix bool
+	target string
+}
+
+func (s subscription) command(subscribe bool) string {
+	switch {
+	case subscribe && s.prefix:
+		return kv.CmdSubscribePrefix
+	case subscribe:
+		return kv.CmdSubscribeKey
+	case s.prefix:
+		return kv.CmdUnsubscribePrefix
+	default:
+		return kv.CmdUnsubscribeKey
+	}
+}
+
+func (s subscription) params() map[string]any {
+	if s.prefix {
+		return map[string]any{"prefix": s.target}
+	}
+	return map[string]any{"key": s.target}
+}
+
+type subscriptionCallback struct {
+	subscription
+	callback Callback
+}
+
+// subscriptions keeps track of callbacks and of what they need the server to send
+type subscriptions struct {
+	byID   map[int64]subscriptionCallback
+	count  map[subscription]int
+	lastID int64
+	mu     sync.Mutex
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		byID:  make(map[int64]subscriptionCallback),
+		count: make(map[subscription]int),
+	}
+}
+
+// add registers a callback, returning its ID
+func (s *subscriptions) add(sub subscription, callback Callback) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	s.byID[s.lastID] = subscriptionCallback{sub, callback}
+	s.count[sub]++
+	return s.lastID
+}
+
+// remove unregisters a callback, last is true if no other callback needs its subscription
+func (s *subscriptions) remove(id int64) (sub subscription, last bool, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.byID[id]
+	if !ok {
+		return subscription{}, false, false
+	}
+	delete(s.byID, id)
+	s.count[entry.subscription]--
+	if s.count[entry.subscription] > 0 {
+		return entry.subscription, false, true
+	}
+	delete(s.count, entry.subscription)
+	return entry.subscription, true, true
+}
+
+// targets returns every subscription needed by callbacks, to restore them after reconnecting
+func (s *subscriptions) targets() []subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	targets := make([]subscription, 0, len(s.count))
+	for sub := range s.count {
+		targets = append(targets, sub)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].target < targets[j].target
+	})
+	return targets
+}
+
+// callbacks returns the callbacks interested in a key, in the order they were added
+func (s *subscriptions) callbacks(key string) []Callback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]int64, 0)
+	for id, entry := range s.byID {
+		if entry.target == key || entry.prefix && strings.HasPrefix(key, entry.target) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	callbacks := make([]Callback, len(ids))
+	for index, id := range ids {
+		callbacks[index] = s.byID[id].callback
+	}
+	return callbacks
+}
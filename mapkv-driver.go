@@ -3,11 +3,13 @@ package kv
 import (
 	"sort"
 	"strings"
+	"sync"
 )
 
 // mapkv is an in-memory map[string]string driver. Should not be used!
 type mapkv struct {
 	data map[string]string
+	mu   sync.RWMutex
 }
 
 func MakeBackend() *mapkv {
@@ -17,6 +19,8 @@ func MakeBackend() *mapkv {
 }
 
 func (b *mapkv) Get(key string) (string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	val, ok := b.data[key]
 	if !ok {
 		return "", ErrorKeyNotFound
@@ -25,16 +29,22 @@ func (b *mapkv) Get(key string) (string, error) {
 }
 
 func (b *mapkv) Set(key string, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.data[key] = value
 	return nil
 }
 
 func (b *mapkv) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	delete(b.data, key)
 	return nil
 }
 
 func (b *mapkv) SetBulk(data map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	for k, v := range data {
 		b.data[k] = v
 	}
@@ -42,12 +52,11 @@ func (b *mapkv) SetBulk(data map[string]string) error {
 }
 
 func (b *mapkv) GetBulk(keys []string) (map[string]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	result := make(map[string]string)
 	for _, k := range keys {
-		v, err := b.Get(k)
-		if err != nil {
-			result[k] = ""
-		} else {
+		if v, ok := b.data[k]; ok {
 			result[k] = v
 		}
 	}
@@ -55,6 +64,8 @@ func (b *mapkv) GetBulk(keys []string) (map[string]string, error) {
 }
 
 func (b *mapkv) List(prefix string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	keys := make([]string, 0, len(b.data))
 	for k := range b.data {
 		if strings.HasPrefix(k, prefix) {
@@ -66,6 +77,8 @@ func (b *mapkv) List(prefix string) ([]string, error) {
 }
 
 func (b *mapkv) GetPrefix(prefix string) (map[string]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	result := make(map[string]string)
 	for k, v := range b.data {
 		if strings.HasPrefix(k, prefix) {
@@ -0,0 +1,165 @@
+package kv
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryBackendOptions is a list of tunable options for the in-memory driver
+type MemoryBackendOptions struct {
+	// If set, the database is loaded from this file when created and saved to it when closed
+	SnapshotPath string
+}
+
+// memkv is an in-memory driver that is safe for concurrent use. Keys are kept
+// in a radix tree so prefix lookups only visit matching keys, in order.
+type memkv struct {
+	options MemoryBackendOptions
+
+	data *memStore
+	mu   sync.RWMutex
+}
+
+// NewMemoryBackend creates an in-memory database, loading its snapshot file if one was specified
+func NewMemoryBackend(options MemoryBackendOptions) (*memkv, error) {
+	b := &memkv{
+		options: options,
+		data:    newMemStore(),
+	}
+
+	if options.SnapshotPath != "" {
+		if err := readSnapshotFile(options.SnapshotPath, b.data.apply); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+func (b *memkv) Get(key string) (string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	val, _, ok := b.data.get(key)
+	if !ok {
+		return "", ErrorKeyNotFound
+	}
+	return val, nil
+}
+
+func (b *memkv) GetRevision(key string) (string, uint64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	val, revision, ok := b.data.get(key)
+	if !ok {
+		return "", 0, ErrorKeyNotFound
+	}
+	return val, revision, nil
+}
+
+func (b *memkv) GetBulk(keys []string) (map[string]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	result := make(map[string]string)
+	for _, k := range keys {
+		if v, _, ok := b.data.get(k); ok {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+func (b *memkv) GetPrefix(prefix string) (map[string]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	result := make(map[string]string)
+	b.data.data.WalkPrefix(prefix, func(key string, entry memEntry) bool {
+		result[key] = entry.value
+		return true
+	})
+	return result, nil
+}
+
+func (b *memkv) List(prefix string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	keys := make([]string, 0)
+	b.data.data.WalkPrefix(prefix, func(key string, _ memEntry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys, nil
+}
+
+func (b *memkv) Set(key string, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data.set(key, value)
+	return nil
+}
+
+func (b *memkv) SetBulk(kv map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k, v := range kv {
+		b.data.set(k, v)
+	}
+	return nil
+}
+
+func (b *memkv) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data.delete(key)
+	return nil
+}
+
+func (b *memkv) CompareAndSet(key string, value string, revision uint64) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.data.currentRevision(key) != revision {
+		return 0, ErrorRevisionMismatch
+	}
+	return b.data.set(key, value), nil
+}
+
+func (b *memkv) ApplyBatch(ops []BatchOp) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, op := range ops {
+		if op.Delete {
+			b.data.delete(op.Key)
+		} else {
+			b.data.set(op.Key, op.Value)
+		}
+	}
+	return nil
+}
+
+func (b *memkv) SetExpiry(key string, at time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data.setExpiry(key, at.UnixNano())
+	return nil
+}
+
+func (b *memkv) Expiries() (map[string]time.Time, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.data.expiries(), nil
+}
+
+// Snapshot saves the database to the snapshot file, if one was specified
+func (b *memkv) Snapshot() error {
+	if b.options.SnapshotPath == "" {
+		return nil
+	}
+	// Hold a read lock to get a consistent view, readers can still go on
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return writeSnapshotFile(b.options.SnapshotPath, b.data)
+}
+
+// Close saves the database to the snapshot file, if one was specified
+func (b *memkv) Close() error {
+	return b.Snapshot()
+}
@@ -0,0 +1,160 @@
+package kv
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	db, err := NewMemoryBackend(MemoryBackendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetBulk(map[string]string{"key1": "value1", "key2": "value2", "other": "value3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("key0", "value0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Get("key1"); err != ErrorKeyNotFound {
+		t.Fatal("deleted key is still present")
+	}
+	if val, err := db.Get("key2"); err != nil || val != "value2" {
+		t.Fatal("key not found or value not set correctly")
+	}
+
+	keys, err := db.List("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "key0" || keys[1] != "key2" {
+		t.Fatalf("unexpected key list: %v", keys)
+	}
+
+	values, err := db.GetPrefix("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values["key0"] != "value0" || values["key2"] != "value2" {
+		t.Fatalf("unexpected prefix values: %v", values)
+	}
+}
+
+func TestMemoryBackend_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.kv")
+
+	db, err := NewMemoryBackend(MemoryBackendOptions{SnapshotPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < snapshotChunkSize*2+1; i++ {
+		if err := db.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewMemoryBackend(MemoryBackendOptions{SnapshotPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := db.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != snapshotChunkSize*2+1 {
+		t.Fatalf("expected %d keys after loading snapshot, got %d", snapshotChunkSize*2+1, len(keys))
+	}
+	if val, err := db.Get("key42"); err != nil || val != "value42" {
+		t.Fatal("key not found or value not loaded correctly")
+	}
+}
+
+func TestMemoryBackend_Concurrent(t *testing.T) {
+	db, err := NewMemoryBackend(MemoryBackendOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key-%d-%d", i, j)
+				_ = db.Set(key, "value")
+				_, _ = db.Get(key)
+				_, _ = db.List("key-")
+				_ = db.Delete(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	keys, _ := db.List("")
+	if len(keys) != 0 {
+		t.Fatalf("expected empty database, got %d keys", len(keys))
+	}
+}
+
+func TestRadixTree(t *testing.T) {
+	tree := newRadixTree[int]()
+	keys := []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus", "rom", ""}
+	for i, key := range keys {
+		tree.Insert(key, i)
+	}
+	if tree.Len() != len(keys) {
+		t.Fatalf("expected %d keys, got %d", len(keys), tree.Len())
+	}
+	for i, key := range keys {
+		if val, ok := tree.Get(key); !ok || val != i {
+			t.Fatalf("key '%s' not found or wrong value", key)
+		}
+	}
+
+	var found []string
+	tree.WalkPrefix("rub", func(key string, _ int) bool {
+		found = append(found, key)
+		return true
+	})
+	if fmt.Sprint(found) != "[rubens ruber rubicon rubicundus]" {
+		t.Fatalf("unexpected prefix walk result: %v", found)
+	}
+
+	found = nil
+	tree.WalkPath("romanesque", func(key string, _ int) bool {
+		found = append(found, key)
+		return true
+	})
+	if fmt.Sprint(found) != "[ rom romane]" {
+		t.Fatalf("unexpected path walk result: %v", found)
+	}
+
+	for _, key := range []string{"rubens", "rom", "romanus"} {
+		if _, ok := tree.Delete(key); !ok {
+			t.Fatalf("key '%s' not deleted", key)
+		}
+	}
+	if _, ok := tree.Delete("rubens"); ok {
+		t.Fatal("deleting a missing key should fail")
+	}
+
+	found = nil
+	tree.WalkPrefix("", func(key string, _ int) bool {
+		found = append(found, key)
+		return true
+	})
+	if fmt.Sprint(found) != "[ romane romulus ruber rubicon rubicundus]" {
+		t.Fatalf("unexpected walk result after delete: %v", found)
+	}
+}
@@ -0,0 +1,91 @@
+package kv
+
+import "time"
+
+type memEntry struct {
+	value    string
+	revision uint64
+
+	// When the key expires (Unix nanoseconds), 0 if it doesn't
+	expires int64
+}
+
+// memStore is the in-memory index shared by the bundled drivers. Every write
+// (including deletes) advances a global revision counter, so revisions of a
+// key never repeat, even across deletes. It is not safe for concurrent use.
+type memStore struct {
+	data     *radixTree[memEntry]
+	revision uint64
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		data: newRadixTree[memEntry](),
+	}
+}
+
+func (s *memStore) get(key string) (string, uint64, bool) {
+	entry, ok := s.data.Get(key)
+	return entry.value, entry.revision, ok
+}
+
+func (s *memStore) set(key string, value string) uint64 {
+	s.revision++
+	s.data.Insert(key, memEntry{value: value, revision: s.revision})
+	return s.revision
+}
+
+func (s *memStore) delete(key string) {
+	s.revision++
+	s.data.Delete(key)
+}
+
+// setExpiry sets when an existing key expires, writing or deleting the key clears it
+func (s *memStore) setExpiry(key string, expires int64) {
+	entry, ok := s.data.Get(key)
+	if !ok {
+		return
+	}
+	entry.expires = expires
+	s.data.Insert(key, entry)
+}
+
+// expiries returns every key that has an expiry time
+func (s *memStore) expiries() map[string]time.Time {
+	result := make(map[string]time.Time)
+	s.data.WalkPrefix("", func(key string, entry memEntry) bool {
+		if entry.expires != 0 {
+			result[key] = time.Unix(0, entry.expires)
+		}
+		return true
+	})
+	return result
+}
+
+// currentRevision returns the revision of a key, or 0 if the key does not exist
+func (s *memStore) currentRevision(key string) uint64 {
+	entry, _ := s.data.Get(key)
+	return entry.revision
+}
+
+func (s *memStore) apply(ops []recordOp) {
+	for _, op := range ops {
+		switch op.op {
+		case recordOpSet:
+			s.set(op.key, op.value)
+		case recordOpDelete:
+			s.delete(op.key)
+		case recordOpSetRevision:
+			s.data.Insert(op.key, memEntry{value: op.value, revision: op.revision})
+			if op.revision > s.revision {
+				s.revision = op.revision
+			}
+		case recordOpExpire:
+			s.setExpiry(op.key, op.expires)
+		case recordOpRevision:
+			if op.revision > s.revision {
+				s.revision = op.revision
+			}
+		}
+	}
+}
@@ -1,6 +1,6 @@
 package kv
 
-const ProtoVersion = "v9"
+const ProtoVersion = "v11"
 
 // Commands
 const (
@@ -10,6 +10,8 @@ const (
 	CmdReadPrefix        = "kget-all"
 	CmdWriteKey          = "kset"
 	CmdWriteBulk         = "kset-bulk"
+	CmdCompareAndSwap    = "kcas"
+	CmdTransaction       = "ktx"
 	CmdRemoveKey         = "kdel"
 	CmdSubscribeKey      = "ksub"
 	CmdSubscribePrefix   = "ksub-prefix"
@@ -18,6 +20,8 @@ const (
 	CmdListKeys          = "klist"
 	CmdAuthRequest       = "klogin"
 	CmdAuthChallenge     = "kauth"
+	CmdLogout            = "klogout"
+	CmdResume            = "kresume"
 	CmdInternalClientID  = "_uid"
 )
 
@@ -33,6 +37,12 @@ const (
 	ErrAuthRequired     ErrCode = "authentication required"
 	ErrAuthNotRequired  ErrCode = "authentication not required"
 	ErrAuthNotSupported ErrCode = "authentication method not supported"
+	ErrRevisionMismatch ErrCode = "revision mismatch"
+	ErrCompareFailed    ErrCode = "comparison failed"
+	ErrPermissionDenied ErrCode = "permission denied"
+	ErrAuthLocked       ErrCode = "authentication locked"
+	ErrRateLimited      ErrCode = "rate limited"
+	ErrAlreadyAuth      ErrCode = "already authenticated"
 )
 
 type AuthType string
@@ -40,6 +50,8 @@ type AuthType string
 const (
 	AuthTypeChallenge   AuthType = "challenge"
 	AuthTypeInteractive AuthType = "ask"
+	AuthTypeToken       AuthType = "token"
+	AuthTypeScram       AuthType = "scram-sha-256"
 )
 
 type Request struct {
@@ -53,6 +65,9 @@ type Error struct {
 	Error     ErrCode `json:"error"`
 	Details   string  `json:"details"`
 	RequestID string  `json:"request_id,omitempty"`
+
+	// For rate limited requests, how many milliseconds to wait before trying again
+	RetryAfter int64 `json:"retry_after,omitempty"`
 }
 
 type Response struct {
@@ -62,10 +77,26 @@ type Response struct {
 	Data      interface{} `json:"data,omitempty"`
 }
 
+type PushEvent string
+
+const (
+	PushEventSet    PushEvent = "set"
+	PushEventDelete PushEvent = "delete"
+	PushEventExpire PushEvent = "expire"
+)
+
+// KeyValue is the response to a key read
+type KeyValue struct {
+	Value    string `json:"value"`
+	Exists   bool   `json:"exists"`
+	Revision uint64 `json:"revision,omitempty"`
+}
+
 type Push struct {
-	CmdType  string `json:"type"`
-	Key      string `json:"key"`
-	NewValue string `json:"new_value"`
+	CmdType  string    `json:"type"`
+	Key      string    `json:"key"`
+	NewValue string    `json:"new_value"`
+	Event    PushEvent `json:"event"`
 }
 
 type Hello struct {
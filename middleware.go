@@ -0,0 +1,55 @@
+package kv
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Handler runs a command sent by a client, replying to it with client.SendJSON
+type Handler func(hub *Hub, client Client, msg Request)
+
+// Middleware wraps the handler of every command, it can inspect or change the request,
+// reply on its own (e.g. with an error) without calling next, or do things after next returns
+type Middleware func(next Handler) Handler
+
+// middlewareChain is the handler every command goes through, rebuilt when middleware is added
+type middlewareChain struct {
+	middleware []Middleware
+	handler    Handler
+	mu         sync.RWMutex
+}
+
+// Use adds middleware around every command the hub runs, including unknown commands.
+// Middleware added first is the outermost, so it sees requests before (and replies after) the rest.
+func (hub *Hub) Use(middleware ...Middleware) {
+	hub.chain.mu.Lock()
+	defer hub.chain.mu.Unlock()
+	hub.chain.middleware = append(hub.chain.middleware, middleware...)
+
+	handler := Handler(dispatchCmd)
+	for index := len(hub.chain.middleware) - 1; index >= 0; index-- {
+		handler = hub.chain.middleware[index](handler)
+	}
+	hub.chain.handler = handler
+}
+
+// handler returns the handler to run commands with, with all middleware applied
+func (hub *Hub) handler() Handler {
+	hub.chain.mu.RLock()
+	defer hub.chain.mu.RUnlock()
+	if hub.chain.handler == nil {
+		return dispatchCmd
+	}
+	return hub.chain.handler
+}
+
+// dispatchCmd runs the handler of a command, it's the innermost handler of the chain
+func dispatchCmd(h *Hub, client Client, msg Request) {
+	handler, ok := h.command(msg.CmdName)
+	if !ok {
+		// No handler found, send invalid command
+		sendErr(h, client, msg, ErrUnknownCmd, fmt.Sprintf("command \"%s\" is mistyped or not supported", msg.CmdName))
+		return
+	}
+	handler(h, client, msg)
+}
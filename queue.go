@@ -0,0 +1,175 @@
+package kv
+
+import (
+	"sync"
+)
+
+// SlowClientPolicy decides what happens when a client's outbound queue is full
+type SlowClientPolicy string
+
+const (
+	// Drop the oldest queued push to make room for the new message
+	SlowClientDropOldest SlowClientPolicy = "drop-oldest"
+
+	// Replace the queued push for the same key if there is one, otherwise drop the oldest queued push
+	SlowClientCoalesce SlowClientPolicy = "coalesce"
+
+	// Disconnect the client
+	SlowClientDisconnect SlowClientPolicy = "disconnect"
+)
+
+const (
+	// Default number of messages that can be queued for a client
+	defaultQueueSize = 256
+
+	// Default policy for clients that don't read fast enough
+	defaultSlowClientPolicy = SlowClientDropOldest
+)
+
+type queuedMessage struct {
+	data []byte
+
+	// Only set for pushes
+	key    string
+	isPush bool
+}
+
+// outboundQueue is a bounded queue of messages waiting to be written to a client.
+// Adding messages never blocks: when the queue is full, the slow client policy
+// decides which message to give up on.
+type outboundQueue struct {
+	messages []queuedMessage
+	limit    int
+	policy   SlowClientPolicy
+
+	// Number of messages dropped so far
+	dropped uint64
+
+	// Set when the client must be disconnected for being too slow
+	overflowed bool
+	closed     bool
+
+	mu sync.Mutex
+
+	// Receives a value whenever there's something new to write
+	wake chan struct{}
+}
+
+func newOutboundQueue(limit int, policy SlowClientPolicy) *outboundQueue {
+	if limit <= 0 {
+		limit = defaultQueueSize
+	}
+	if policy == "" {
+		policy = defaultSlowClientPolicy
+	}
+	return &outboundQueue{
+		limit:  limit,
+		policy: policy,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// push adds a message to the queue. It reports whether a message had to be dropped to
+// make room for it, and whether the client must now be disconnected for being too slow
+// (only reported once, later messages are silently discarded).
+func (q *outboundQueue) push(msg queuedMessage) (dropped bool, disconnect bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.overflowed {
+		return false, false
+	}
+
+	if len(q.messages) >= q.limit {
+		if !q.makeRoom(msg) {
+			// Nothing we can drop (or we're not allowed to), give up on the client
+			q.overflowed = true
+			q.messages = nil
+			q.signal()
+			return false, true
+		}
+		dropped = true
+		q.dropped++
+	}
+
+	q.messages = append(q.messages, msg)
+	q.signal()
+	return dropped, false
+}
+
+// makeRoom drops a queued push according to the policy. Must be called with mu held.
+func (q *outboundQueue) makeRoom(msg queuedMessage) bool {
+	if q.policy == SlowClientDisconnect {
+		return false
+	}
+
+	oldest := -1
+	for i, queued := range q.messages {
+		if !queued.isPush {
+			continue
+		}
+		if q.policy == SlowClientCoalesce && msg.isPush && queued.key == msg.key {
+			q.remove(i)
+			return true
+		}
+		if oldest < 0 {
+			oldest = i
+			if q.policy != SlowClientCoalesce {
+				break
+			}
+		}
+	}
+	if oldest < 0 {
+		// Queue is all responses, they can't be dropped
+		return false
+	}
+	q.remove(oldest)
+	return true
+}
+
+// remove removes the message at index i, keeping the order of the others. Must be called with mu held.
+func (q *outboundQueue) remove(i int) {
+	copy(q.messages[i:], q.messages[i+1:])
+	q.messages[len(q.messages)-1] = queuedMessage{}
+	q.messages = q.messages[:len(q.messages)-1]
+}
+
+// take removes and returns every queued message, along with whether the queue
+// was closed or the client must be disconnected
+func (q *outboundQueue) take() (messages [][]byte, closed bool, overflowed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) > 0 {
+		messages = make([][]byte, len(q.messages))
+		for i, msg := range q.messages {
+			messages[i] = msg.data
+		}
+		q.messages = q.messages[:0]
+	}
+	return messages, q.closed, q.overflowed
+}
+
+// droppedCount returns the number of messages dropped so far
+func (q *outboundQueue) droppedCount() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// close stops the queue from accepting messages, anything already queued is still delivered
+func (q *outboundQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+// signal wakes up the writer. Must be called with mu held.
+func (q *outboundQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+		// Writer already has a pending signal
+	}
+}
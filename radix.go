@@ -0,0 +1,234 @@
+package kv
+
+import (
+	"sort"
+	"strings"
+)
+
+// radixTree is a compressed prefix tree, iterating it always yields keys in lexicographic order.
+// It is not safe for concurrent use.
+type radixTree[T any] struct {
+	root radixNode[T]
+	size int
+}
+
+type radixNode[T any] struct {
+	prefix   string
+	value    T
+	hasValue bool
+
+	// Sorted by first byte of their prefix
+	children []*radixNode[T]
+}
+
+func newRadixTree[T any]() *radixTree[T] {
+	return &radixTree[T]{}
+}
+
+// Len returns the number of keys in the tree
+func (t *radixTree[T]) Len() int {
+	return t.size
+}
+
+func (t *radixTree[T]) Get(key string) (T, bool) {
+	n := &t.root
+	search := key
+	for len(search) > 0 {
+		_, child := n.child(search[0])
+		if child == nil || !strings.HasPrefix(search, child.prefix) {
+			var zero T
+			return zero, false
+		}
+		search = search[len(child.prefix):]
+		n = child
+	}
+	return n.value, n.hasValue
+}
+
+// Insert sets the value for a key, returning the previous value if there was one
+func (t *radixTree[T]) Insert(key string, value T) (T, bool) {
+	var zero T
+	n := &t.root
+	search := key
+	for {
+		if len(search) == 0 {
+			old, replaced := n.value, n.hasValue
+			n.value, n.hasValue = value, true
+			if !replaced {
+				t.size++
+			}
+			return old, replaced
+		}
+
+		idx, child := n.child(search[0])
+		if child == nil {
+			n.addChild(&radixNode[T]{prefix: search, value: value, hasValue: true})
+			t.size++
+			return zero, false
+		}
+
+		common := commonPrefixLength(search, child.prefix)
+		if common == len(child.prefix) {
+			search = search[common:]
+			n = child
+			continue
+		}
+
+		// Key diverges in the middle of the child's prefix, split it
+		split := &radixNode[T]{prefix: search[:common]}
+		child.prefix = child.prefix[common:]
+		split.children = []*radixNode[T]{child}
+		n.children[idx] = split
+
+		search = search[common:]
+		if len(search) == 0 {
+			split.value, split.hasValue = value, true
+		} else {
+			split.addChild(&radixNode[T]{prefix: search, value: value, hasValue: true})
+		}
+		t.size++
+		return zero, false
+	}
+}
+
+// Delete removes a key from the tree, returning its value if it was present
+func (t *radixTree[T]) Delete(key string) (T, bool) {
+	var zero T
+	var parent *radixNode[T]
+	n := &t.root
+	search := key
+	for len(search) > 0 {
+		_, child := n.child(search[0])
+		if child == nil || !strings.HasPrefix(search, child.prefix) {
+			return zero, false
+		}
+		search = search[len(child.prefix):]
+		parent, n = n, child
+	}
+	if !n.hasValue {
+		return zero, false
+	}
+
+	old := n.value
+	n.value, n.hasValue = zero, false
+	t.size--
+
+	// Root never gets removed or merged
+	if parent == nil {
+		return old, true
+	}
+
+	// Keep the tree compressed
+	switch len(n.children) {
+	case 0:
+		parent.removeChild(n.prefix[0])
+		if parent != &t.root && !parent.hasValue && len(parent.children) == 1 {
+			parent.mergeChild()
+		}
+	case 1:
+		n.mergeChild()
+	}
+
+	return old, true
+}
+
+// WalkPrefix calls fn for every key starting with prefix, in lexicographic order, until fn returns false
+func (t *radixTree[T]) WalkPrefix(prefix string, fn func(key string, value T) bool) {
+	n := &t.root
+	search := prefix
+	key := ""
+	for len(search) > 0 {
+		_, child := n.child(search[0])
+		if child == nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(search, child.prefix):
+			search = search[len(child.prefix):]
+		case strings.HasPrefix(child.prefix, search):
+			// Prefix ends in the middle of this node, every key below it matches
+			search = ""
+		default:
+			return
+		}
+		key += child.prefix
+		n = child
+	}
+	n.walk(key, fn)
+}
+
+// WalkPath calls fn for every key in the tree that is a prefix of key (including key itself),
+// from the shortest to the longest, until fn returns false
+func (t *radixTree[T]) WalkPath(key string, fn func(key string, value T) bool) {
+	n := &t.root
+	search := key
+	for {
+		if n.hasValue && !fn(key[:len(key)-len(search)], n.value) {
+			return
+		}
+		if len(search) == 0 {
+			return
+		}
+		_, child := n.child(search[0])
+		if child == nil || !strings.HasPrefix(search, child.prefix) {
+			return
+		}
+		search = search[len(child.prefix):]
+		n = child
+	}
+}
+
+func (n *radixNode[T]) walk(key string, fn func(key string, value T) bool) bool {
+	if n.hasValue && !fn(key, n.value) {
+		return false
+	}
+	for _, child := range n.children {
+		if !child.walk(key+child.prefix, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *radixNode[T]) child(label byte) (int, *radixNode[T]) {
+	idx := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].prefix[0] >= label
+	})
+	if idx < len(n.children) && n.children[idx].prefix[0] == label {
+		return idx, n.children[idx]
+	}
+	return idx, nil
+}
+
+func (n *radixNode[T]) addChild(child *radixNode[T]) {
+	idx, _ := n.child(child.prefix[0])
+	n.children = append(n.children, nil)
+	copy(n.children[idx+1:], n.children[idx:])
+	n.children[idx] = child
+}
+
+func (n *radixNode[T]) removeChild(label byte) {
+	idx, child := n.child(label)
+	if child == nil {
+		return
+	}
+	copy(n.children[idx:], n.children[idx+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+}
+
+// mergeChild merges a valueless node with its only child
+func (n *radixNode[T]) mergeChild() {
+	child := n.children[0]
+	n.prefix += child.prefix
+	n.value, n.hasValue = child.value, child.hasValue
+	n.children = child.children
+}
+
+func commonPrefixLength(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,211 @@
+package kv
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CommandClass groups commands that share the same rate limits
+type CommandClass string
+
+const (
+	// kget, kget-bulk, kget-all, klist
+	ClassRead CommandClass = "read"
+
+	// kset, kset-bulk, kcas, kdel, ktx
+	ClassWrite CommandClass = "write"
+
+	// ksub, ksub-prefix, kunsub, kunsub-prefix
+	ClassSubscribe CommandClass = "subscribe"
+
+	// klogin, kauth, klogout, kresume
+	ClassAuth CommandClass = "auth"
+)
+
+// Commands that are not in here (like version) are never rate limited
+var commandClasses = map[string]CommandClass{
+	CmdReadKey:           ClassRead,
+	CmdReadBulk:          ClassRead,
+	CmdReadPrefix:        ClassRead,
+	CmdListKeys:          ClassRead,
+	CmdWriteKey:          ClassWrite,
+	CmdWriteBulk:         ClassWrite,
+	CmdCompareAndSwap:    ClassWrite,
+	CmdRemoveKey:         ClassWrite,
+	CmdTransaction:       ClassWrite,
+	CmdSubscribeKey:      ClassSubscribe,
+	CmdSubscribePrefix:   ClassSubscribe,
+	CmdUnsubscribeKey:    ClassSubscribe,
+	CmdUnsubscribePrefix: ClassSubscribe,
+	CmdAuthRequest:       ClassAuth,
+	CmdAuthChallenge:     ClassAuth,
+	CmdLogout:            ClassAuth,
+	CmdResume:            ClassAuth,
+}
+
+// RateLimit lets Burst commands through at once, then Rate commands per second
+type RateLimit struct {
+	// A rate of 0 (or less) never refills, only Burst commands are ever let through
+	Rate float64
+
+	// Defaults to Rate (rounded up, at least 1)
+	Burst int
+}
+
+// rateNever is returned instead of a wait time by buckets that never refill
+const rateNever = time.Duration(math.MaxInt64)
+
+func (limit RateLimit) rate() float64 {
+	return math.Max(0, limit.Rate)
+}
+
+func (limit RateLimit) burst() float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return math.Max(1, math.Ceil(limit.rate()))
+}
+
+// RateLimits sets how many commands of each class clients can send, classes with no
+// limit are not rate limited
+type RateLimits struct {
+	// Limits for every single client
+	PerClient map[CommandClass]RateLimit
+
+	// Limits shared by every client in the same namespace
+	PerNamespace map[CommandClass]RateLimit
+}
+
+// tokenBucket is refilled at a constant rate, every command takes a token out of it
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens gained since the last refill, returning how long until there's a full token
+// (rateNever if the bucket doesn't refill)
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) time.Duration {
+	rate := limit.rate()
+	b.tokens = math.Min(limit.burst(), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	if rate == 0 {
+		return rateNever
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// rateLimiter keeps a token bucket for every client and namespace, and for every command class
+type rateLimiter struct {
+	buckets map[string]*tokenBucket
+	mu      sync.Mutex
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take takes a token for a command from the client and namespace buckets, returning how long
+// to wait before trying again if either is empty (nothing is taken then)
+func (l *rateLimiter) take(limits RateLimits, class CommandClass, uid int64, namespace string, now time.Time) time.Duration {
+	type limitedBucket struct {
+		key   string
+		limit RateLimit
+	}
+	var toCheck []limitedBucket
+	if limit, ok := limits.PerClient[class]; ok {
+		toCheck = append(toCheck, limitedBucket{"client:" + strconv.FormatInt(uid, 10) + ":" + string(class), limit})
+	}
+	if limit, ok := limits.PerNamespace[class]; ok {
+		toCheck = append(toCheck, limitedBucket{"ns:" + namespace + ":" + string(class), limit})
+	}
+	if len(toCheck) == 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buckets := make([]*tokenBucket, len(toCheck))
+	var wait time.Duration
+	for i, check := range toCheck {
+		bucket, ok := l.buckets[check.key]
+		if !ok {
+			bucket = &tokenBucket{tokens: check.limit.burst(), last: now}
+			l.buckets[check.key] = bucket
+		}
+		buckets[i] = bucket
+		if remaining := bucket.refill(check.limit, now); remaining > wait {
+			wait = remaining
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return 0
+}
+
+// forget removes the buckets of a client that disconnected
+func (l *rateLimiter) forget(uid int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prefix := "client:" + strconv.FormatInt(uid, 10) + ":"
+	for _, class := range []CommandClass{ClassRead, ClassWrite, ClassSubscribe, ClassAuth} {
+		delete(l.buckets, prefix+string(class))
+	}
+}
+
+// commandHeader is the part of a request needed to rate limit it
+type commandHeader struct {
+	CmdName   string `json:"command"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// allowMessage checks a message against the rate limits before it's queued, replying
+// with an error if it can't go through. The error can reach the client before the
+// replies to commands that were already queued.
+func (hub *Hub) allowMessage(msg Message) bool {
+	limits := hub.options.RateLimits
+	if len(limits.PerClient) == 0 && len(limits.PerNamespace) == 0 {
+		return true
+	}
+
+	var header commandHeader
+	if err := json.Unmarshal(msg.Data, &header); err != nil {
+		// Let the handler report the error
+		return true
+	}
+	class, ok := commandClasses[header.CmdName]
+	if !ok {
+		return true
+	}
+
+	namespace := hub.clientOptions(msg.Client).Namespace
+	wait := hub.rateLimiter.take(limits, class, msg.Client.UID(), namespace, time.Now())
+	if wait == 0 {
+		return true
+	}
+	reply := Error{
+		Ok:        false,
+		Error:     ErrRateLimited,
+		RequestID: header.RequestID,
+	}
+	if wait == rateNever {
+		// No point in retrying, leave retry_after out
+		reply.Details = fmt.Sprintf("too many %s commands, no more are allowed", class)
+	} else {
+		reply.Details = fmt.Sprintf("too many %s commands, try again in %s", class, wait.Round(time.Millisecond))
+		reply.RetryAfter = (wait + time.Millisecond - 1).Milliseconds()
+	}
+	hub.replyErr(msg.Client, Request{CmdName: header.CmdName, RequestID: header.RequestID}, reply)
+	return false
+}
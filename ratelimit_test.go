@@ -0,0 +1,108 @@
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter()
+	limits := RateLimits{
+		PerClient:    map[CommandClass]RateLimit{ClassWrite: {Rate: 10, Burst: 2}},
+		PerNamespace: map[CommandClass]RateLimit{ClassWrite: {Rate: 1, Burst: 3}},
+	}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if wait := limiter.take(limits, ClassWrite, 1, "@a/", now); wait != 0 {
+			t.Fatalf("command #%d inside the burst limited for %s", i+1, wait)
+		}
+	}
+	if wait := limiter.take(limits, ClassWrite, 1, "@a/", now); wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait 100ms after the client burst, got %s", wait)
+	}
+
+	// Another client in the same namespace only has one command left in the namespace burst
+	if wait := limiter.take(limits, ClassWrite, 2, "@a/", now); wait != 0 {
+		t.Fatalf("namespace burst exhausted too early (%s)", wait)
+	}
+	if wait := limiter.take(limits, ClassWrite, 2, "@a/", now); wait != time.Second {
+		t.Fatalf("expected to wait 1s after the namespace burst, got %s", wait)
+	}
+
+	// Other classes and namespaces are not affected
+	if wait := limiter.take(limits, ClassRead, 1, "@a/", now); wait != 0 {
+		t.Fatalf("unlimited class limited for %s", wait)
+	}
+	if wait := limiter.take(limits, ClassWrite, 3, "@b/", now); wait != 0 {
+		t.Fatalf("other namespace limited for %s", wait)
+	}
+
+	// Buckets refill over time
+	if wait := limiter.take(limits, ClassWrite, 2, "@a/", now.Add(time.Second)); wait != 0 {
+		t.Fatalf("bucket not refilled after 1s (%s)", wait)
+	}
+}
+
+func TestRateLimitedCommands(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{
+		RateLimits: RateLimits{
+			PerClient: map[CommandClass]RateLimit{ClassWrite: {Rate: 0.001, Burst: 1}},
+		},
+	})
+	makeHubClientWith(t, hub, log, func(hub *Hub, client *LocalClient) {
+		set := func() interface{} {
+			req, chn := client.MakeRequest(CmdWriteKey, map[string]interface{}{"key": "test", "data": "value"})
+			hub.SendMessage(req)
+			return waitReply(t, chn)
+		}
+
+		mustSucceed(t, set())
+		resp := mustFail(t, set())
+		if resp.Error != ErrRateLimited {
+			t.Fatalf("expected \"%s\", got \"%s\"", ErrRateLimited, resp.Error)
+		}
+		if resp.RetryAfter <= 0 {
+			t.Fatalf("rate limited error with no retry_after: %+v", resp)
+		}
+
+		// Reads are not limited
+		req, chn := client.MakeRequest(CmdReadKey, map[string]interface{}{"key": "test"})
+		hub.SendMessage(req)
+		mustSucceed(t, waitReply(t, chn))
+	})
+}
+
+func TestRateLimitNoRefill(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	hub := createInMemoryHub(t, log)
+	hub.SetOptions(HubOptions{
+		RateLimits: RateLimits{
+			PerClient: map[CommandClass]RateLimit{ClassWrite: {Rate: 0, Burst: 1}, ClassRead: {Rate: -1}},
+		},
+	})
+	makeHubClientWith(t, hub, log, func(hub *Hub, client *LocalClient) {
+		request := func(cmd string, data map[string]interface{}) interface{} {
+			req, chn := client.MakeRequest(cmd, data)
+			hub.SendMessage(req)
+			return waitReply(t, chn)
+		}
+
+		// Buckets with no rate never refill, and say so instead of giving a bogus retry_after
+		mustSucceed(t, request(CmdWriteKey, map[string]interface{}{"key": "test", "data": "value"}))
+		mustSucceed(t, request(CmdReadKey, map[string]interface{}{"key": "test"}))
+		for _, cmd := range []string{CmdWriteKey, CmdReadKey} {
+			resp := mustFail(t, request(cmd, map[string]interface{}{"key": "test", "data": "value"}))
+			if resp.Error != ErrRateLimited {
+				t.Fatalf("expected \"%s\", got \"%s\"", ErrRateLimited, resp.Error)
+			}
+			if resp.RetryAfter != 0 {
+				t.Fatalf("expected no retry_after for a limit that never refills, got %d", resp.RetryAfter)
+			}
+		}
+	})
+}
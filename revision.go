@@ -0,0 +1,81 @@
+package kv
+
+import (
+	"sync"
+)
+
+// revisionTracker keeps track of key revisions for drivers that don't implement
+// RevisionDriver. Revisions only live in memory and start over when the hub is restarted.
+//
+// Every write going through the hub holds the tracker lock, which is what makes
+// compare-and-set atomic on those drivers.
+type revisionTracker struct {
+	revisions map[string]uint64
+	last      uint64
+	mu        sync.Mutex
+}
+
+func newRevisionTracker() *revisionTracker {
+	return &revisionTracker{
+		revisions: make(map[string]uint64),
+	}
+}
+
+// current returns the value and revision of a key, assigning a revision to keys that
+// exist but were never written through the hub. Must be called with mu held.
+func (r *revisionTracker) current(db Driver, key string) (string, uint64, error) {
+	value, err := db.Get(key)
+	if err != nil {
+		if err == ErrorKeyNotFound {
+			delete(r.revisions, key)
+		}
+		return "", 0, err
+	}
+
+	revision, ok := r.revisions[key]
+	if !ok {
+		revision = r.bump(key)
+	}
+	return value, revision, nil
+}
+
+// bump gives a key a new revision. Must be called with mu held.
+func (r *revisionTracker) bump(key string) uint64 {
+	r.last++
+	r.revisions[key] = r.last
+	return r.last
+}
+
+// update runs a write while holding the lock, then updates the revisions of every
+// written and removed key if the write was successful.
+func (r *revisionTracker) update(written []string, removed []string, write func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := write(); err != nil {
+		return err
+	}
+	r.commit(written, removed)
+	return nil
+}
+
+// commit updates the revisions of every written and removed key. Must be called with mu held.
+func (r *revisionTracker) commit(written []string, removed []string) {
+	for _, key := range written {
+		r.bump(key)
+	}
+	for _, key := range removed {
+		r.last++
+		delete(r.revisions, key)
+	}
+}
+
+// readRevision reads a key along with its current revision
+func (hub *Hub) readRevision(key string) (string, uint64, error) {
+	if db, ok := hub.db.(RevisionDriver); ok {
+		return db.GetRevision(key)
+	}
+
+	hub.revisions.mu.Lock()
+	defer hub.revisions.mu.Unlock()
+	return hub.revisions.current(hub.db, key)
+}
@@ -0,0 +1,116 @@
+package kv
+
+import (
+	"sync"
+)
+
+// clientTasks is the queue of pending tasks for a single client
+type clientTasks struct {
+	client  Client
+	tasks   []func()
+	running bool
+}
+
+// scheduler runs tasks on a fixed pool of workers. Tasks for different clients
+// run in parallel, tasks for the same client run one at a time, in the order
+// they were submitted.
+type scheduler struct {
+	queues map[Client]*clientTasks
+
+	// Clients with pending tasks and none running
+	ready []*clientTasks
+
+	closed bool
+	mu     sync.Mutex
+	cond   *sync.Cond
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		queues: make(map[Client]*clientTasks),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Submit queues a task for a client, it never blocks
+func (s *scheduler) Submit(client Client, task func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue, ok := s.queues[client]
+	if !ok {
+		queue = &clientTasks{client: client}
+		s.queues[client] = queue
+	}
+	queue.tasks = append(queue.tasks, task)
+
+	// If the client has a task running it will be put back in the ready list when done
+	if !queue.running && len(queue.tasks) == 1 {
+		s.ready = append(s.ready, queue)
+		s.cond.Signal()
+	}
+}
+
+// Start starts the given number of workers, which run until the scheduler is closed
+func (s *scheduler) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+}
+
+// Close stops every worker once it's done with its current task, pending tasks are discarded
+func (s *scheduler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+func (s *scheduler) work() {
+	for {
+		task, queue, ok := s.next()
+		if !ok {
+			return
+		}
+		task()
+		s.done(queue)
+	}
+}
+
+// next waits for a client with pending tasks and takes its first one
+func (s *scheduler) next() (func(), *clientTasks, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.ready) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil, nil, false
+	}
+
+	queue := s.ready[0]
+	s.ready[0] = nil
+	s.ready = s.ready[1:]
+
+	task := queue.tasks[0]
+	queue.tasks[0] = nil
+	queue.tasks = queue.tasks[1:]
+	queue.running = true
+	return task, queue, true
+}
+
+// done marks a client's task as finished, making the client ready again if it has more tasks
+func (s *scheduler) done(queue *clientTasks) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue.running = false
+	if len(queue.tasks) > 0 {
+		s.ready = append(s.ready, queue)
+		s.cond.Signal()
+	} else {
+		delete(s.queues, queue.client)
+	}
+}
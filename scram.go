@@ -0,0 +1,205 @@
+package kv
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Default number of PBKDF2 iterations for new SCRAM verifiers
+const ScramIterations = 4096
+
+const scramPrefix = "SCRAM-SHA-256$"
+
+var ErrInvalidVerifier = errors.New("invalid SCRAM verifier")
+
+// ScramVerifier is what the server needs to authenticate a client with SCRAM-SHA-256
+// (RFC 5802/7677) without knowing its password.
+//
+// Verifiers are encoded as SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+// (the same format PostgreSQL uses), see ParseScramVerifier and String.
+type ScramVerifier struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramVerifier creates a verifier for a password with a random salt, using
+// ScramIterations if iterations is 0
+func NewScramVerifier(password string, iterations int) (ScramVerifier, error) {
+	if iterations <= 0 {
+		iterations = ScramIterations
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return ScramVerifier{}, err
+	}
+	return deriveScramVerifier(password, salt, iterations), nil
+}
+
+func deriveScramVerifier(password string, salt []byte, iterations int) ScramVerifier {
+	salted := scramSaltedPassword([]byte(password), salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return ScramVerifier{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, []byte("Server Key")),
+	}
+}
+
+// ParseScramVerifier decodes a verifier created by ScramVerifier.String
+func ParseScramVerifier(str string) (ScramVerifier, error) {
+	if !strings.HasPrefix(str, scramPrefix) {
+		return ScramVerifier{}, ErrInvalidVerifier
+	}
+	params, keys, ok := strings.Cut(str[len(scramPrefix):], "$")
+	if !ok {
+		return ScramVerifier{}, ErrInvalidVerifier
+	}
+	iterStr, saltStr, ok := strings.Cut(params, ":")
+	if !ok {
+		return ScramVerifier{}, ErrInvalidVerifier
+	}
+	storedKeyStr, serverKeyStr, ok := strings.Cut(keys, ":")
+	if !ok {
+		return ScramVerifier{}, ErrInvalidVerifier
+	}
+
+	iterations, err := strconv.Atoi(iterStr)
+	if err != nil || iterations <= 0 {
+		return ScramVerifier{}, ErrInvalidVerifier
+	}
+	var verifier ScramVerifier
+	verifier.Iterations = iterations
+	for _, field := range []struct {
+		str string
+		out *[]byte
+	}{
+		{saltStr, &verifier.Salt},
+		{storedKeyStr, &verifier.StoredKey},
+		{serverKeyStr, &verifier.ServerKey},
+	} {
+		*field.out, err = base64.StdEncoding.DecodeString(field.str)
+		if err != nil {
+			return ScramVerifier{}, ErrInvalidVerifier
+		}
+	}
+	if len(verifier.StoredKey) != sha256.Size || len(verifier.ServerKey) != sha256.Size {
+		return ScramVerifier{}, ErrInvalidVerifier
+	}
+	return verifier, nil
+}
+
+func (v ScramVerifier) String() string {
+	return fmt.Sprintf("%s%d:%s$%s:%s", scramPrefix, v.Iterations,
+		base64.StdEncoding.EncodeToString(v.Salt),
+		base64.StdEncoding.EncodeToString(v.StoredKey),
+		base64.StdEncoding.EncodeToString(v.ServerKey))
+}
+
+func (v ScramVerifier) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+func (v *ScramVerifier) UnmarshalText(text []byte) error {
+	verifier, err := ParseScramVerifier(string(text))
+	if err != nil {
+		return err
+	}
+	*v = verifier
+	return nil
+}
+
+// scramExchange is the state of a SCRAM authentication between klogin and kauth
+type scramExchange struct {
+	Verifier ScramVerifier
+
+	// client-first-message-bare + "," + server-first-message + "," + client-final-message-without-proof
+	AuthMessage string
+}
+
+// newScramExchange builds the server-first-message for a client nonce, returning the combined nonce
+func newScramExchange(username string, clientNonce string, serverNonce string, verifier ScramVerifier) (scramExchange, string) {
+	nonce := clientNonce + serverNonce
+	clientFirst := "n=" + scramEscape(username) + ",r=" + clientNonce
+	serverFirst := "r=" + nonce + ",s=" + base64.StdEncoding.EncodeToString(verifier.Salt) + ",i=" + strconv.Itoa(verifier.Iterations)
+	// "biws" is the base64 of the "n,," GS2 header, as channel binding is not supported
+	clientFinal := "c=biws,r=" + nonce
+	return scramExchange{
+		Verifier:    verifier,
+		AuthMessage: clientFirst + "," + serverFirst + "," + clientFinal,
+	}, nonce
+}
+
+// Verify checks a client proof, returning the server signature the client can use to authenticate the server
+func (e scramExchange) Verify(proof []byte) ([]byte, bool) {
+	if len(proof) != sha256.Size || len(e.Verifier.StoredKey) != sha256.Size {
+		return nil, false
+	}
+	clientSignature := hmacSHA256(e.Verifier.StoredKey, []byte(e.AuthMessage))
+	clientKey := make([]byte, sha256.Size)
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], e.Verifier.StoredKey) != 1 {
+		return nil, false
+	}
+	return hmacSHA256(e.Verifier.ServerKey, []byte(e.AuthMessage)), true
+}
+
+// validScramNonce checks that a client nonce only has printable characters other than ","
+func validScramNonce(nonce string) bool {
+	if nonce == "" {
+		return false
+	}
+	for i := 0; i < len(nonce); i++ {
+		if nonce[i] < 0x21 || nonce[i] > 0x7e || nonce[i] == ',' {
+			return false
+		}
+	}
+	return true
+}
+
+// scramEscape encodes a username as a SCRAM saslname
+func scramEscape(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// scramSaltedPassword is PBKDF2-HMAC-SHA256 with a key as long as a single hash
+func scramSaltedPassword(password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	var blockIndex [4]byte
+	binary.BigEndian.PutUint32(blockIndex[:], 1)
+	mac.Write(blockIndex[:])
+	u := mac.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,44 @@
+package kv
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestScramVerifier(t *testing.T) {
+	// Example exchange from RFC 7677
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	verifier := deriveScramVerifier("pencil", salt, 4096)
+
+	exchange, nonce := newScramExchange("user", "rOprNGfwEbeRWgbNEkqO", "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0", verifier)
+	if nonce != "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0" {
+		t.Fatalf("wrong nonce: %s", nonce)
+	}
+	proof, _ := base64.StdEncoding.DecodeString("dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	signature, ok := exchange.Verify(proof)
+	if !ok {
+		t.Fatal("valid proof rejected")
+	}
+	if encoded := base64.StdEncoding.EncodeToString(signature); encoded != "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Fatalf("wrong server signature: %s", encoded)
+	}
+
+	proof[0] ^= 1
+	if _, ok := exchange.Verify(proof); ok {
+		t.Fatal("invalid proof accepted")
+	}
+
+	// Encoding round trip
+	parsed, err := ParseScramVerifier(verifier.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != verifier.String() {
+		t.Fatalf("verifier changed after parsing: %s != %s", parsed, verifier)
+	}
+	for _, invalid := range []string{"", "SCRAM-SHA-256$4096", "SCRAM-SHA-256$0:AAAA$AAAA:AAAA", "md5$4096:AAAA$AAAA:AAAA"} {
+		if _, err := ParseScramVerifier(invalid); err != ErrInvalidVerifier {
+			t.Fatalf("expected ErrInvalidVerifier for %q, got %v", invalid, err)
+		}
+	}
+}
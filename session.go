@@ -0,0 +1,307 @@
+package kv
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultSessionTimeout = 5 * time.Minute
+
+// Not a klogin method, only used to log session resumptions
+const authMethodResume AuthType = "resume"
+
+// session lets a client that reconnects get back its authentication and subscriptions
+type session struct {
+	// Client using the session, 0 after it disconnected
+	client int64
+
+	// When the session can't be resumed anymore, only set after the client disconnected
+	expires time.Time
+
+	// Saved when the client disconnects
+	auth     authState
+	keys     []string
+	prefixes []string
+}
+
+// sessionStore keeps track of the sessions of authenticated clients, by token
+type sessionStore struct {
+	sessions map[string]*session
+	byClient map[int64]string
+
+	lastPrune time.Time
+	mu        sync.Mutex
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		sessions: make(map[string]*session),
+		byClient: make(map[int64]string),
+	}
+}
+
+// create starts a new session for a client, replacing the one it had
+func (s *sessionStore) create(uid int64) (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.byClient[uid]; ok {
+		delete(s.sessions, old)
+	}
+	s.sessions[token] = &session{client: uid}
+	s.byClient[uid] = token
+	return token, nil
+}
+
+// remove ends the session of a client, it can't be resumed anymore
+func (s *sessionStore) remove(uid int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token, ok := s.byClient[uid]; ok {
+		delete(s.sessions, token)
+		delete(s.byClient, uid)
+	}
+}
+
+// has returns true if a client has a session
+func (s *sessionStore) has(uid int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.byClient[uid]
+	return ok
+}
+
+// detach saves the state of a client that disconnected, so its session can be resumed until it expires.
+// Expired sessions are pruned along the way, at most once every timeout.
+func (s *sessionStore) detach(uid int64, auth authState, keys []string, prefixes []string, expires time.Time, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now(), timeout)
+
+	token, ok := s.byClient[uid]
+	if !ok {
+		return
+	}
+	delete(s.byClient, uid)
+	s.sessions[token] = &session{
+		expires:  expires,
+		auth:     auth,
+		keys:     keys,
+		prefixes: prefixes,
+	}
+}
+
+// take removes a session so it can be resumed, tokens can only be used once
+func (s *sessionStore) take(token string, now time.Time) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.sessions[token]
+	if !ok {
+		return session{}, false
+	}
+	delete(s.sessions, token)
+	if current.client != 0 {
+		delete(s.byClient, current.client)
+	} else if !now.Before(current.expires) {
+		return session{}, false
+	}
+	return *current, true
+}
+
+// prune removes expired sessions, at most once every interval. Must be called with mu held.
+func (s *sessionStore) prune(now time.Time, interval time.Duration) {
+	if now.Sub(s.lastPrune) < interval {
+		return
+	}
+	s.lastPrune = now
+	for token, current := range s.sessions {
+		if current.client == 0 && now.After(current.expires) {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+func (options HubOptions) sessionTimeout() time.Duration {
+	if options.SessionTimeout == 0 {
+		return defaultSessionTimeout
+	}
+	return options.SessionTimeout
+}
+
+// startSession gives an authenticated client a token to resume its session with,
+// or an empty string if sessions are disabled
+func (hub *Hub) startSession(client Client) string {
+	if hub.options.sessionTimeout() < 0 {
+		return ""
+	}
+	token, err := hub.sessions.create(client.UID())
+	if err != nil {
+		hub.logger.Error("failed to create session", zap.Error(err))
+		return ""
+	}
+	// Sessions are only cleaned up once their client disconnects, which might have already happened
+	// (e.g. during interactive authentication)
+	if !hub.clients.Has(client) {
+		hub.sessions.remove(client.UID())
+		return ""
+	}
+	return token
+}
+
+// detachSession saves the state of a disconnecting client if it has a session
+func (hub *Hub) detachSession(client Client) {
+	uid := client.UID()
+	if !hub.sessions.has(uid) {
+		return
+	}
+	auth, _ := hub.clients.AuthState(uid)
+	keys, prefixes := hub.subscriptions.Subscriptions(uid)
+	// Sessions can't outlive the token they were authenticated with
+	timeout := hub.options.sessionTimeout()
+	expires := time.Now().Add(timeout)
+	if !auth.tokenExpires.IsZero() && auth.tokenExpires.Before(expires) {
+		expires = auth.tokenExpires
+	}
+	hub.sessions.detach(uid, auth, keys, prefixes, expires, timeout)
+}
+
+// revalidateSession checks that the token or user a session was authenticated with is still
+// valid, returning the session's authentication with their current permissions
+func (hub *Hub) revalidateSession(client Client, auth authState) (authState, bool, error) {
+	switch {
+	case auth.token != "":
+		if hub.options.Tokens == nil {
+			return auth, false, nil
+		}
+		token, err := hub.options.Tokens.ValidateToken(auth.token)
+		switch err {
+		case nil:
+		case ErrTokenNotFound, ErrTokenExpired, ErrInvalidToken:
+			return auth, false, nil
+		default:
+			return auth, false, err
+		}
+		// Subscriptions were made in the old namespace, they can't be moved
+		if token.Namespace != auth.namespace {
+			return auth, false, nil
+		}
+		auth.acl = token.Scopes
+		auth.tokenExpires = token.ExpiresAt
+	case auth.user != "":
+		if hub.options.Users == nil {
+			return auth, false, nil
+		}
+		user, err := hub.options.Users.GetUser(auth.user)
+		switch err {
+		case nil:
+		case ErrUserNotFound:
+			return auth, false, nil
+		default:
+			return auth, false, err
+		}
+		connection := client.Options()
+		if auth.hasHostACL {
+			connection.ACL = auth.hostACL
+		}
+		namespace, acl, ok := hub.userOptions(user, connection)
+		if !ok || namespace != auth.namespace {
+			return auth, false, nil
+		}
+		auth.acl = acl
+	}
+	return auth, true, nil
+}
+
+// logout removes the authentication and subscriptions of a client, restrictions set
+// by the host with Hub.SetACL stay
+func (hub *Hub) logout(uid int64) {
+	hub.sessions.remove(uid)
+	hub.subscriptions.UnsubscribeAll(uid)
+	_ = hub.clients.Logout(uid)
+}
+
+func cmdLogout(h *Hub, client Client, msg Request) {
+	h.logout(client.UID())
+	h.logger.Info("client logged out", zap.Int64("client", client.UID()))
+	client.SendJSON(Response{"response", true, msg.RequestID, nil})
+}
+
+func cmdResume(h *Hub, client Client, msg Request) {
+	if h.authRequired() == false {
+		sendErr(h, client, msg, ErrAuthNotRequired, "authentication is not required")
+		return
+	}
+	if !allowAuthAttempt(h, client, msg) {
+		return
+	}
+	token, ok := msg.Data["session"].(string)
+	if !ok || token == "" {
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'session' parameter")
+		return
+	}
+
+	resumed, ok := h.sessions.take(token, time.Now())
+	if ok && resumed.client != 0 {
+		// The old connection is still around (e.g. the server didn't notice it dropped yet),
+		// move everything from it
+		resumed.auth, _ = h.clients.AuthState(resumed.client)
+		resumed.keys, resumed.prefixes = h.subscriptions.Subscriptions(resumed.client)
+		h.logout(resumed.client)
+	}
+	if !ok || !resumed.auth.authenticated {
+		authFailed(h, client, msg, authMethodResume, "")
+		return
+	}
+	// Tokens can be revoked or expire and users removed while the session is around
+	auth, ok, err := h.revalidateSession(client, resumed.auth)
+	if err != nil {
+		sendErr(h, client, msg, ErrServerError, err.Error())
+		return
+	}
+	if !ok {
+		authFailed(h, client, msg, authMethodResume, resumed.auth.user)
+		return
+	}
+	resumed.auth = auth
+
+	uid := client.UID()
+	h.logout(uid)
+	_ = h.clients.SetAuthState(uid, resumed.auth)
+	for _, key := range resumed.keys {
+		h.subscriptions.SubscribeKey(uid, key)
+	}
+	for _, prefix := range resumed.prefixes {
+		h.subscriptions.SubscribePrefix(uid, prefix)
+	}
+	session := authSucceeded(h, client, authMethodResume, resumed.auth.user)
+
+	// Subscriptions are reported relative to the namespace, like they were made
+	namespace := h.clientOptions(client).Namespace
+	keys := make([]string, 0, len(resumed.keys))
+	for _, key := range resumed.keys {
+		keys = append(keys, strings.TrimPrefix(key, namespace))
+	}
+	prefixes := make([]string, 0, len(resumed.prefixes))
+	for _, prefix := range resumed.prefixes {
+		prefixes = append(prefixes, strings.TrimPrefix(prefix, namespace))
+	}
+	client.SendJSON(Response{"response", true, msg.RequestID, struct {
+		Session  string   `json:"session,omitempty"`
+		Keys     []string `json:"keys"`
+		Prefixes []string `json:"prefixes"`
+	}{
+		session,
+		keys,
+		prefixes,
+	}})
+}
@@ -0,0 +1,290 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Records bigger than this are considered corrupted
+	maxRecordSize = 1 << 30
+
+	// Checksum, length and checksum of the length
+	recordHeaderSize = 12
+
+	// How many keys to store in a single snapshot record
+	snapshotChunkSize = 1024
+)
+
+var (
+	snapshotMagic = []byte("KVSNAP1\n")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrCorruptedSnapshot = errors.New("snapshot file is corrupted")
+)
+
+const (
+	recordOpSet byte = iota + 1
+	recordOpDelete
+	// Set with an explicit revision, only used in snapshots
+	recordOpSetRevision
+	// Revision counter, only used in snapshots
+	recordOpRevision
+	// Expiry time of a key
+	recordOpExpire
+)
+
+type recordOp struct {
+	op       byte
+	key      string
+	value    string
+	revision uint64
+	expires  int64
+}
+
+// encodeRecord encodes a list of operations as a single checksummed record:
+// CRC-32C of payload (4 bytes) | payload length (4 bytes) | CRC-32C of length (4 bytes) | payload
+//
+// The length has its own checksum so a damaged length can't be mistaken for a record running past the end of the file.
+func encodeRecord(ops []recordOp) []byte {
+	payload := make([]byte, recordHeaderSize, 64)
+	for _, op := range ops {
+		payload = append(payload, op.op)
+		if op.op == recordOpRevision {
+			payload = binary.AppendUvarint(payload, op.revision)
+			continue
+		}
+		payload = binary.AppendUvarint(payload, uint64(len(op.key)))
+		payload = append(payload, op.key...)
+		if op.op == recordOpSet || op.op == recordOpSetRevision {
+			payload = binary.AppendUvarint(payload, uint64(len(op.value)))
+			payload = append(payload, op.value...)
+		}
+		if op.op == recordOpSetRevision {
+			payload = binary.AppendUvarint(payload, op.revision)
+		}
+		if op.op == recordOpExpire {
+			payload = binary.AppendUvarint(payload, uint64(op.expires))
+		}
+	}
+	binary.LittleEndian.PutUint32(payload[0:4], crc32.Checksum(payload[recordHeaderSize:], crcTable))
+	binary.LittleEndian.PutUint32(payload[4:8], uint32(len(payload)-recordHeaderSize))
+	binary.LittleEndian.PutUint32(payload[8:12], crc32.Checksum(payload[4:8], crcTable))
+	return payload
+}
+
+// readRecord reads and decodes a single record, returning its operations and its size on disk.
+// If the record header is intact, the size it declares is returned even if the rest of the record is damaged.
+func readRecord(reader *bufio.Reader) ([]recordOp, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.New("truncated record header")
+		}
+		return nil, 0, err
+	}
+
+	checksum := binary.LittleEndian.Uint32(header[0:4])
+	length := binary.LittleEndian.Uint32(header[4:8])
+	if crc32.Checksum(header[4:8], crcTable) != binary.LittleEndian.Uint32(header[8:12]) {
+		return nil, 0, errors.New("record header checksum mismatch")
+	}
+	size := int64(len(header)) + int64(length)
+	if length > maxRecordSize {
+		return nil, size, errors.New("invalid record length")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, size, errors.New("truncated record")
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, size, errors.New("checksum mismatch")
+	}
+
+	ops, err := decodeRecord(payload)
+	return ops, size, err
+}
+
+func decodeRecord(payload []byte) ([]recordOp, error) {
+	var ops []recordOp
+	readUvarint := func() (uint64, bool) {
+		value, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return 0, false
+		}
+		payload = payload[n:]
+		return value, true
+	}
+	readString := func() (string, bool) {
+		length, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < length {
+			return "", false
+		}
+		str := string(payload[n : n+int(length)])
+		payload = payload[n+int(length):]
+		return str, true
+	}
+
+	for len(payload) > 0 {
+		op := recordOp{op: payload[0]}
+		payload = payload[1:]
+
+		var ok bool
+		if op.op == recordOpRevision {
+			if op.revision, ok = readUvarint(); !ok {
+				return nil, errors.New("malformed record revision")
+			}
+			ops = append(ops, op)
+			continue
+		}
+		if op.key, ok = readString(); !ok {
+			return nil, errors.New("malformed record key")
+		}
+		switch op.op {
+		case recordOpSet, recordOpSetRevision:
+			if op.value, ok = readString(); !ok {
+				return nil, errors.New("malformed record value")
+			}
+		case recordOpDelete:
+		case recordOpExpire:
+			expires, ok := readUvarint()
+			if !ok {
+				return nil, errors.New("malformed record expiry")
+			}
+			op.expires = int64(expires)
+		default:
+			return nil, fmt.Errorf("unknown record operation %d", op.op)
+		}
+		if op.op == recordOpSetRevision {
+			if op.revision, ok = readUvarint(); !ok {
+				return nil, errors.New("malformed record revision")
+			}
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// writeSnapshotFile atomically replaces the snapshot at path with the content of data
+func writeSnapshotFile(path string, data *memStore) error {
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	err = writeSnapshot(file, data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func writeSnapshot(w io.Writer, data *memStore) error {
+	writer := bufio.NewWriter(w)
+	if _, err := writer.Write(snapshotMagic); err != nil {
+		return err
+	}
+
+	// Store the revision counter so revisions keep going up after a restart
+	if _, err := writer.Write(encodeRecord([]recordOp{{op: recordOpRevision, revision: data.revision}})); err != nil {
+		return err
+	}
+
+	// Split the database in multiple records so a huge database doesn't need a huge buffer
+	var err error
+	ops := make([]recordOp, 0, snapshotChunkSize)
+	data.data.WalkPrefix("", func(key string, entry memEntry) bool {
+		ops = append(ops, recordOp{op: recordOpSetRevision, key: key, value: entry.value, revision: entry.revision})
+		if entry.expires != 0 {
+			ops = append(ops, recordOp{op: recordOpExpire, key: key, expires: entry.expires})
+		}
+		if len(ops) >= snapshotChunkSize {
+			_, err = writer.Write(encodeRecord(ops))
+			ops = ops[:0]
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(ops) > 0 {
+		if _, err := writer.Write(encodeRecord(ops)); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// readSnapshotFile calls apply for every record in the snapshot at path, a missing file is not an error
+func readSnapshotFile(path string, apply func([]recordOp)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if err := readMagic(reader, snapshotMagic); err != nil {
+		return ErrCorruptedSnapshot
+	}
+	for {
+		ops, _, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// Snapshots are written atomically, so any damage here is not a torn write
+			return fmt.Errorf("%w: %s", ErrCorruptedSnapshot, err.Error())
+		}
+		apply(ops)
+	}
+}
+
+func readMagic(reader io.Reader, magic []byte) error {
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if string(header) != string(magic) {
+		return errors.New("invalid header")
+	}
+	return nil
+}
+
+// syncDir makes sure a rename inside a directory is persisted
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Some platforms (e.g. Windows) don't support syncing directories, ignore that
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) && !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+	return nil
+}
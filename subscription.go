@@ -1,107 +1,240 @@
 package kv
 
 import (
-	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// subscriberSet is a set of client IDs
+type subscriberSet map[int64]struct{}
+
+// clientSubscriptions is everything a single client is subscribed to,
+// so that removing a client doesn't need to go through every subscription
+type clientSubscriptions struct {
+	keys     map[string]struct{}
+	prefixes map[string]struct{}
+}
+
+// subscriptionManager keeps track of which clients are subscribed to which keys and prefixes.
+// Prefixes are indexed in a radix tree, so finding the subscribers of a key only visits
+// the prefixes that actually match it.
 type subscriptionManager struct {
-	keySubscribers    map[string][]int64
-	prefixSubscribers map[string][]int64
+	keySubscribers    map[string]subscriberSet
+	prefixSubscribers *radixTree[subscriberSet]
+	clients           map[int64]*clientSubscriptions
 	hub               *Hub
+
+	mu sync.RWMutex
 }
 
 func makeSubscriptionManager() *subscriptionManager {
 	return &subscriptionManager{
-		keySubscribers:    make(map[string][]int64),
-		prefixSubscribers: make(map[string][]int64),
+		keySubscribers:    make(map[string]subscriberSet),
+		prefixSubscribers: newRadixTree[subscriberSet](),
+		clients:           make(map[int64]*clientSubscriptions),
 	}
 }
 
 func (s *subscriptionManager) SubscribeKey(uid int64, key string) {
-	s.keySubscribers[key] = append(s.keySubscribers[key], uid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscribers, ok := s.keySubscribers[key]
+	if !ok {
+		subscribers = make(subscriberSet)
+		s.keySubscribers[key] = subscribers
+	}
+	subscribers[uid] = struct{}{}
+	s.client(uid).keys[key] = struct{}{}
 }
 
 func (s *subscriptionManager) SubscribePrefix(uid int64, prefix string) {
-	s.prefixSubscribers[prefix] = append(s.prefixSubscribers[prefix], uid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscribers, ok := s.prefixSubscribers.Get(prefix)
+	if !ok {
+		subscribers = make(subscriberSet)
+		s.prefixSubscribers.Insert(prefix, subscribers)
+	}
+	subscribers[uid] = struct{}{}
+	s.client(uid).prefixes[prefix] = struct{}{}
 }
 
 func (s *subscriptionManager) UnsubscribeKey(uid int64, key string) {
-	subscribers := s.keySubscribers[key]
-	for i, subscriber := range subscribers {
-		if subscriber == uid {
-			s.keySubscribers[key] = append(subscribers[:i], subscribers[i+1:]...)
-			break
-		}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeKey(uid, key)
+	if client, ok := s.clients[uid]; ok {
+		delete(client.keys, key)
+		s.pruneClient(uid, client)
 	}
 }
 
 func (s *subscriptionManager) UnsubscribePrefix(uid int64, prefix string) {
-	subscribers := s.prefixSubscribers[prefix]
-	for i, subscriber := range subscribers {
-		if subscriber == uid {
-			s.prefixSubscribers[prefix] = append(subscribers[:i], subscribers[i+1:]...)
-			break
-		}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removePrefix(uid, prefix)
+	if client, ok := s.clients[uid]; ok {
+		delete(client.prefixes, prefix)
+		s.pruneClient(uid, client)
 	}
 }
 
 func (s *subscriptionManager) UnsubscribeAll(uid int64) {
-	for key, subscribers := range s.keySubscribers {
-		for i, subscriber := range subscribers {
-			if subscriber == uid {
-				s.keySubscribers[key] = append(subscribers[:i], subscribers[i+1:]...)
-				break
-			}
-		}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, ok := s.clients[uid]
+	if !ok {
+		return
 	}
+	for key := range client.keys {
+		s.removeKey(uid, key)
+	}
+	for prefix := range client.prefixes {
+		s.removePrefix(uid, prefix)
+	}
+	delete(s.clients, uid)
+}
 
-	for prefix, subscribers := range s.prefixSubscribers {
-		for i, subscriber := range subscribers {
-			if subscriber == uid {
-				s.prefixSubscribers[prefix] = append(subscribers[:i], subscribers[i+1:]...)
-				break
-			}
-		}
+// Subscriptions returns the keys and prefixes a client is subscribed to, sorted
+func (s *subscriptionManager) Subscriptions(uid int64) (keys []string, prefixes []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	client, ok := s.clients[uid]
+	if !ok {
+		return nil, nil
 	}
+	for key := range client.keys {
+		keys = append(keys, key)
+	}
+	for prefix := range client.prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(keys)
+	sort.Strings(prefixes)
+	return keys, prefixes
 }
 
 func (s *subscriptionManager) GetSubscribers(key string) []int64 {
-	subscribers := make(map[int64]bool)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	// Get subscribers for key
+	// Get subscribers for key and for every prefix of it
+	var matches []subscriberSet
 	if keySubscribers, ok := s.keySubscribers[key]; ok {
-		for _, subscriber := range keySubscribers {
-			subscribers[subscriber] = true
+		matches = append(matches, keySubscribers)
+	}
+	s.prefixSubscribers.WalkPath(key, func(_ string, prefixSubscribers subscriberSet) bool {
+		matches = append(matches, prefixSubscribers)
+		return true
+	})
+
+	// Skip deduplication when there's a single list of subscribers
+	var result []int64
+	if len(matches) == 1 {
+		for subscriber := range matches[0] {
+			result = append(result, subscriber)
 		}
+		return result
 	}
 
-	// Get subscribers for prefix
-	for prefix, prefixSubscribers := range s.prefixSubscribers {
-		if bytes.HasPrefix([]byte(key), []byte(prefix)) {
-			for _, subscriber := range prefixSubscribers {
-				subscribers[subscriber] = true
+	seen := make(subscriberSet)
+	for _, subscribers := range matches {
+		for subscriber := range subscribers {
+			if _, ok := seen[subscriber]; !ok {
+				seen[subscriber] = struct{}{}
+				result = append(result, subscriber)
 			}
 		}
 	}
+	return result
+}
 
-	// Convert to array
-	result := []int64{}
-	for subscriber := range subscribers {
-		result = append(result, subscriber)
+// client returns the subscriptions of a client, creating them if needed. Must be called with mu held.
+func (s *subscriptionManager) client(uid int64) *clientSubscriptions {
+	client, ok := s.clients[uid]
+	if !ok {
+		client = &clientSubscriptions{
+			keys:     make(map[string]struct{}),
+			prefixes: make(map[string]struct{}),
+		}
+		s.clients[uid] = client
 	}
+	return client
+}
 
-	return result
+// pruneClient forgets about clients with no subscriptions left. Must be called with mu held.
+func (s *subscriptionManager) pruneClient(uid int64, client *clientSubscriptions) {
+	if len(client.keys) == 0 && len(client.prefixes) == 0 {
+		delete(s.clients, uid)
+	}
+}
+
+// removeKey removes a client from a key's subscribers. Must be called with mu held.
+func (s *subscriptionManager) removeKey(uid int64, key string) {
+	subscribers, ok := s.keySubscribers[key]
+	if !ok {
+		return
+	}
+	delete(subscribers, uid)
+	if len(subscribers) == 0 {
+		delete(s.keySubscribers, key)
+	}
 }
 
-func (s *subscriptionManager) KeyChanged(key string, value string) {
+// removePrefix removes a client from a prefix's subscribers. Must be called with mu held.
+func (s *subscriptionManager) removePrefix(uid int64, prefix string) {
+	subscribers, ok := s.prefixSubscribers.Get(prefix)
+	if !ok {
+		return
+	}
+	delete(subscribers, uid)
+	if len(subscribers) == 0 {
+		s.prefixSubscribers.Delete(prefix)
+	}
+}
+
+// KeyChanged notifies subscribers of a key change, value is ignored for deletions and expirations
+func (s *subscriptionManager) KeyChanged(key string, value string, event PushEvent) {
+	if event != PushEventSet {
+		value = ""
+	}
+
 	// Notify subscribers
+	now := time.Now()
 	clients := s.GetSubscribers(key)
 	for _, clientID := range clients {
 		client, ok := s.hub.clients.GetByID(clientID)
 		if ok {
-			options := client.Options()
-			msg, _ := json.Marshal(Push{"push", key[len(options.Namespace):], value})
-			client.SendMessage(msg)
+			// Clients are logged out on their next command once their token expires, stop pushes until then
+			if s.hub.clients.TokenExpired(clientID, now) {
+				continue
+			}
+			options := s.hub.clientOptions(client)
+			// Subscriptions are always made in the client's namespace, but don't trust that blindly
+			if !strings.HasPrefix(key, options.Namespace) {
+				continue
+			}
+			relativeKey := key[len(options.Namespace):]
+
+			// Prefix subscriptions can include keys the client is not allowed to see
+			if !options.ACL.Allows(relativeKey, PermSubscribe) {
+				continue
+			}
+
+			msg, _ := json.Marshal(Push{"push", relativeKey, value, event})
+			if sender, ok := client.(pushSender); ok {
+				sender.SendPush(key, msg)
+			} else {
+				client.SendMessage(msg)
+			}
 		}
 	}
 }
@@ -0,0 +1,111 @@
+package kv
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func sortedSubscribers(s *subscriptionManager, key string) []int64 {
+	subscribers := s.GetSubscribers(key)
+	sort.Slice(subscribers, func(i, j int) bool { return subscribers[i] < subscribers[j] })
+	return subscribers
+}
+
+func TestSubscriptionManager(t *testing.T) {
+	s := makeSubscriptionManager()
+	s.SubscribeKey(1, "overlay/title")
+	s.SubscribeKey(1, "overlay/title")
+	s.SubscribePrefix(1, "overlay/")
+	s.SubscribePrefix(2, "")
+	s.SubscribePrefix(3, "overlay/tit")
+	s.SubscribePrefix(3, "other/")
+	s.SubscribeKey(4, "overlay")
+
+	expected := map[string][]int64{
+		"overlay/title":  {1, 2, 3},
+		"overlay/titles": {1, 2, 3},
+		"overlay/text":   {1, 2},
+		"overlay":        {2, 4},
+		"other/key":      {2, 3},
+		"unrelated":      {2},
+	}
+	for key, want := range expected {
+		if got := sortedSubscribers(s, key); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("subscribers of %q: expected %v, got %v", key, want, got)
+		}
+	}
+
+	// Subscribing twice must not require unsubscribing twice
+	s.UnsubscribeKey(1, "overlay/title")
+	s.UnsubscribePrefix(1, "overlay/")
+	if got := sortedSubscribers(s, "overlay/title"); fmt.Sprint(got) != "[2 3]" {
+		t.Errorf("expected [2 3] after unsubscribing, got %v", got)
+	}
+
+	// Unsubscribing from something that was never subscribed is a no-op
+	s.UnsubscribeKey(5, "overlay/title")
+	s.UnsubscribePrefix(5, "missing/")
+
+	s.UnsubscribeAll(3)
+	if got := sortedSubscribers(s, "overlay/title"); fmt.Sprint(got) != "[2]" {
+		t.Errorf("expected [2] after removing client, got %v", got)
+	}
+	s.UnsubscribeAll(2)
+	s.UnsubscribeAll(4)
+	if len(s.keySubscribers) != 0 || s.prefixSubscribers.Len() != 0 || len(s.clients) != 0 {
+		t.Errorf("subscriptions left after every client was removed: %d keys, %d prefixes, %d clients",
+			len(s.keySubscribers), s.prefixSubscribers.Len(), len(s.clients))
+	}
+}
+
+// makeBenchmarkSubscriptions simulates a set of overlay clients each subscribing to
+// a few keys and a few prefixes of their own, plus a shared one
+func makeBenchmarkSubscriptions(clients int) *subscriptionManager {
+	s := makeSubscriptionManager()
+	for uid := int64(0); uid < int64(clients); uid++ {
+		for i := 0; i < 5; i++ {
+			s.SubscribeKey(uid, fmt.Sprintf("overlay/%d/key-%d", uid, i))
+			s.SubscribePrefix(uid, fmt.Sprintf("overlay/%d/widget-%d/", uid, i))
+		}
+		s.SubscribePrefix(uid, "global/")
+	}
+	return s
+}
+
+var benchmarkClientCounts = []int{10, 100, 1000}
+
+func BenchmarkGetSubscribers(b *testing.B) {
+	for _, clients := range benchmarkClientCounts {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			s := makeBenchmarkSubscriptions(clients)
+			key := fmt.Sprintf("overlay/%d/widget-2/state", clients/2)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.GetSubscribers(key)
+			}
+		})
+	}
+}
+
+func BenchmarkUnsubscribeAll(b *testing.B) {
+	for _, clients := range benchmarkClientCounts {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			s := makeBenchmarkSubscriptions(clients)
+			uid := int64(clients / 2)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < 5; j++ {
+					s.SubscribeKey(uid, fmt.Sprintf("overlay/%d/key-%d", uid, j))
+					s.SubscribePrefix(uid, fmt.Sprintf("overlay/%d/widget-%d/", uid, j))
+				}
+				s.SubscribePrefix(uid, "global/")
+				b.StartTimer()
+				s.UnsubscribeAll(uid)
+			}
+		})
+	}
+}
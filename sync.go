@@ -4,6 +4,7 @@ import (
 	"errors"
 	"math/rand"
 	"sync"
+	"time"
 )
 
 var ErrClientNotFound = errors.New("client not found")
@@ -11,12 +12,46 @@ var ErrClientNotFound = errors.New("client not found")
 type authChallenge struct {
 	Challenge []byte
 	Salt      []byte
+
+	// User the client is authenticating as, empty when using the hub password
+	User string
+	// Set if the user doesn't exist, so authentication fails without telling the client why
+	UnknownUser bool
+
+	// Set when using SCRAM authentication, Challenge and Salt are not used then
+	Scram *scramExchange
+
+	// The challenge can't be used after this, zero if there's no challenge
+	Expires time.Time
 }
 
-type clientData struct {
-	client        Client
-	challenge     authChallenge
+// authState is what a client gets by authenticating, it's saved in sessions so it can be restored
+type authState struct {
 	authenticated bool
+
+	// Name of the user the client authenticated as, if any
+	user string
+
+	// Token the client authenticated with, if any, so resumed sessions can check it's still valid
+	token        string
+	tokenExpires time.Time
+
+	// Set after connecting, replace the ones in the client options
+	acl          ACL
+	hasACL       bool
+	namespace    string
+	hasNamespace bool
+
+	// ACL set with Hub.SetACL, which the client keeps when it logs out
+	hostACL    ACL
+	hasHostACL bool
+}
+
+type clientData struct {
+	authState
+
+	client    Client
+	challenge authChallenge
 }
 
 type clientList struct {
@@ -53,8 +88,7 @@ func (c *clientList) AddClient(client Client) int64 {
 
 	client.SetUID(uid)
 	c.data[uid] = clientData{
-		client:        client,
-		authenticated: false,
+		client: client,
 	}
 
 	return uid
@@ -97,18 +131,111 @@ func (c *clientList) SetChallenge(id int64, challenge authChallenge) error {
 	return nil
 }
 
-func (c *clientList) Challenge(id int64) (authChallenge, error) {
+// TakeChallenge returns the pending challenge of a client and removes it, so it can only be used once
+func (c *clientList) TakeChallenge(id int64) (authChallenge, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[id]
+	if !ok || data.challenge.Expires.IsZero() {
+		return authChallenge{}, false
+	}
+
+	challenge := data.challenge
+	data.challenge = authChallenge{}
+	c.data[id] = data
+
+	return challenge, true
+}
+
+func (c *clientList) SetAuthenticated(id int64, authenticated bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[id]
+	if !ok {
+		return ErrClientNotFound
+	}
+
+	data.authenticated = authenticated
+	c.data[id] = data
+
+	return nil
+}
+
+func (c *clientList) SetACL(id int64, acl ACL) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[id]
+	if !ok {
+		return ErrClientNotFound
+	}
+
+	data.acl = acl
+	data.hasACL = true
+	data.hostACL = acl
+	data.hasHostACL = true
+	c.data[id] = data
+
+	return nil
+}
+
+func (c *clientList) SetUser(id int64, user string, namespace string, acl ACL) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[id]
+	if !ok {
+		return ErrClientNotFound
+	}
+
+	data.user = user
+	data.namespace = namespace
+	data.hasNamespace = true
+	data.acl = acl
+	data.hasACL = true
+	c.data[id] = data
+
+	return nil
+}
+
+// SetToken records the token a client authenticated with and when it expires
+func (c *clientList) SetToken(id int64, token string, expires time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[id]
+	if !ok {
+		return ErrClientNotFound
+	}
+
+	data.token = token
+	data.tokenExpires = expires
+	c.data[id] = data
+
+	return nil
+}
+
+// TokenExpired returns true if a client authenticated with a token that has expired since
+func (c *clientList) TokenExpired(id int64, now time.Time) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	data, ok := c.data[id]
 	if !ok {
-		return authChallenge{}, ErrClientNotFound
+		return false
 	}
 
-	return data.challenge, nil
+	return !data.tokenExpires.IsZero() && !now.Before(data.tokenExpires)
 }
 
-func (c *clientList) SetAuthenticated(id int64, authenticated bool) error {
+func (c *clientList) AuthState(id int64) (authState, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	data, ok := c.data[id]
+	if !ok {
+		return authState{}, false
+	}
+
+	return data.authState, true
+}
+
+func (c *clientList) SetAuthState(id int64, state authState) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	data, ok := c.data[id]
@@ -116,12 +243,63 @@ func (c *clientList) SetAuthenticated(id int64, authenticated bool) error {
 		return ErrClientNotFound
 	}
 
-	data.authenticated = authenticated
+	data.authState = state
+	data.challenge = authChallenge{}
+	c.data[id] = data
+
+	return nil
+}
+
+// Logout drops everything a client got by authenticating, only keeping the ACL set with Hub.SetACL
+func (c *clientList) Logout(id int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[id]
+	if !ok {
+		return ErrClientNotFound
+	}
+
+	data.authState = authState{
+		acl:        data.hostACL,
+		hasACL:     data.hasHostACL,
+		hostACL:    data.hostACL,
+		hasHostACL: data.hasHostACL,
+	}
+	data.challenge = authChallenge{}
 	c.data[id] = data
 
 	return nil
 }
 
+func (c *clientList) User(id int64) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	data, ok := c.data[id]
+	if !ok || data.user == "" {
+		return "", false
+	}
+
+	return data.user, true
+}
+
+// Options applies the options set after connecting to a client's own options
+func (c *clientList) Options(id int64, options ClientOptions) ClientOptions {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	data, ok := c.data[id]
+	if !ok {
+		return options
+	}
+
+	if data.hasNamespace {
+		options.Namespace = data.namespace
+	}
+	if data.hasACL {
+		options.ACL = data.acl
+	}
+	return options
+}
+
 func (c *clientList) Authenticated(id int64) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -0,0 +1,254 @@
+package kv
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenExpired  = errors.New("token expired")
+	ErrInvalidToken  = errors.New("invalid token")
+)
+
+// Tokens look like kvt_<id>_<secret>, only the hash of the secret is stored
+const tokenPrefix = "kvt_"
+
+// Token lets non-interactive clients (bots, browser sources) authenticate with a single
+// string instead of going through a challenge
+type Token struct {
+	// Public part of the token, used to revoke it
+	ID string `json:"id"`
+
+	// Description of what the token is used for
+	Name string `json:"name"`
+
+	// Namespace the client is moved to after authenticating, replacing the one in its options
+	Namespace string `json:"namespace"`
+
+	// What the token allows, nil grants every permission
+	Scopes ACL `json:"scopes"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	// The token can't be used after this, zero means it never expires
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// SHA-256 of the token secret, hex encoded
+	Hash string `json:"hash"`
+}
+
+// Expired returns true if the token can't be used anymore
+func (t Token) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// TokenStore validates tokens clients authenticate with
+type TokenStore interface {
+	// ValidateToken returns the token matching a token string, or an error if it's
+	// unknown (ErrTokenNotFound), malformed (ErrInvalidToken) or expired (ErrTokenExpired)
+	ValidateToken(token string) (Token, error)
+}
+
+// MemoryTokenStore is a TokenStore that only keeps tokens in memory, it is safe for concurrent use
+type MemoryTokenStore struct {
+	tokens map[string]Token
+	mu     sync.RWMutex
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		tokens: make(map[string]Token),
+	}
+}
+
+// Mint creates a new token from a template (ID, hash and creation time are filled in),
+// returning the token string to give to the client. The string can't be recovered later.
+func (s *MemoryTokenStore) Mint(template Token) (string, Token, error) {
+	idBytes := make([]byte, 8)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", Token{}, err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", Token{}, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	token := template
+	token.ID = hex.EncodeToString(idBytes)
+	token.Hash = hashTokenSecret(secret)
+	token.CreatedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.ID] = token
+	return tokenPrefix + token.ID + "_" + secret, token, nil
+}
+
+// Revoke deletes a token, clients authenticated with it are logged out on their next command
+func (s *MemoryTokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[id]; !ok {
+		return ErrTokenNotFound
+	}
+	delete(s.tokens, id)
+	return nil
+}
+
+// Tokens returns every token, sorted by creation time
+func (s *MemoryTokenStore) Tokens() []Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := make([]Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens
+}
+
+func (s *MemoryTokenStore) ValidateToken(str string) (Token, error) {
+	id, secret, ok := parseToken(str)
+	if !ok {
+		return Token{}, ErrInvalidToken
+	}
+
+	s.mu.RLock()
+	token, ok := s.tokens[id]
+	s.mu.RUnlock()
+	if !ok {
+		return Token{}, ErrTokenNotFound
+	}
+	if subtle.ConstantTimeCompare([]byte(hashTokenSecret(secret)), []byte(token.Hash)) != 1 {
+		return Token{}, ErrTokenNotFound
+	}
+	if token.Expired(time.Now()) {
+		return Token{}, ErrTokenExpired
+	}
+	return token, nil
+}
+
+func parseToken(str string) (id string, secret string, ok bool) {
+	if !strings.HasPrefix(str, tokenPrefix) {
+		return "", "", false
+	}
+	return strings.Cut(str[len(tokenPrefix):], "_")
+}
+
+func hashTokenSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// FileTokenStore is a TokenStore backed by a JSON file, every change is saved to the file right away.
+// The file is read again when it's changed by someone else (e.g. another process minting tokens).
+type FileTokenStore struct {
+	*MemoryTokenStore
+
+	path    string
+	modTime time.Time
+
+	// Serializes changes and reloads
+	fileMu sync.Mutex
+}
+
+// OpenFileTokenStore loads tokens from a JSON file, which is created when first saved if it doesn't exist
+func OpenFileTokenStore(path string) (*FileTokenStore, error) {
+	store := &FileTokenStore{
+		MemoryTokenStore: NewMemoryTokenStore(),
+		path:             path,
+	}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *FileTokenStore) Mint(template Token) (string, Token, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	str, token, err := s.MemoryTokenStore.Mint(template)
+	if err != nil {
+		return "", Token{}, err
+	}
+	return str, token, s.save()
+}
+
+func (s *FileTokenStore) Revoke(id string) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if err := s.MemoryTokenStore.Revoke(id); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *FileTokenStore) ValidateToken(str string) (Token, error) {
+	s.fileMu.Lock()
+	err := s.reload()
+	s.fileMu.Unlock()
+	if err != nil {
+		return Token{}, err
+	}
+	return s.MemoryTokenStore.ValidateToken(str)
+}
+
+// reload reads the file again if it changed since the last time. Must be called with fileMu held.
+func (s *FileTokenStore) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]Token)
+	for _, token := range tokens {
+		s.tokens[token.ID] = token
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes every token to the file, replacing it atomically. Must be called with fileMu held.
+func (s *FileTokenStore) save() error {
+	data, err := json.MarshalIndent(s.Tokens(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writePrivateFile(s.path, data); err != nil {
+		return err
+	}
+
+	// Don't reload our own changes
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
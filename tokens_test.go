@@ -0,0 +1,98 @@
+package kv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryTokenStore(t *testing.T) {
+	store := NewMemoryTokenStore()
+
+	str, token, err := store.Mint(Token{Name: "bot", Namespace: "@bot/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validated, err := store.ValidateToken(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validated.ID != token.ID || validated.Namespace != "@bot/" {
+		t.Fatalf("wrong token returned: %+v", validated)
+	}
+
+	// Right ID, wrong secret
+	if _, err := store.ValidateToken(tokenPrefix + token.ID + "_wrong"); err != ErrTokenNotFound {
+		t.Fatalf("expected ErrTokenNotFound, got %v", err)
+	}
+	if _, err := store.ValidateToken("not a token"); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+
+	expired, _, err := store.Mint(Token{ExpiresAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ValidateToken(expired); err != ErrTokenExpired {
+		t.Fatalf("expected ErrTokenExpired, got %v", err)
+	}
+
+	if err := store.Revoke(token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ValidateToken(str); err != ErrTokenNotFound {
+		t.Fatalf("revoked token is still valid (%v)", err)
+	}
+	if err := store.Revoke(token.ID); err != ErrTokenNotFound {
+		t.Fatalf("expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+func TestFileTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	store, err := OpenFileTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, _, err := store.Mint(Token{Name: "obs", Scopes: ACL{{Pattern: "overlay/*", Permissions: PermRead}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret must not end up in the file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, _ := parseToken(str)
+	if strings.Contains(string(data), secret) {
+		t.Fatal("token secret saved in plain text")
+	}
+
+	// Changes made by another process are picked up
+	other, err := OpenFileTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := other.ValidateToken(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !token.Scopes.Allows("overlay/title", PermRead) || token.Scopes.Allows("overlay/title", PermWrite) {
+		t.Fatalf("scopes not saved correctly: %+v", token.Scopes)
+	}
+	if err := other.Revoke(token.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time changes even on filesystems with coarse timestamps
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ValidateToken(str); err != ErrTokenNotFound {
+		t.Fatalf("token revoked by another store is still valid (%v)", err)
+	}
+}
@@ -0,0 +1,308 @@
+package kv
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type txOpKind string
+
+const (
+	txOpGet     txOpKind = "get"
+	txOpSet     txOpKind = "set"
+	txOpDelete  txOpKind = "delete"
+	txOpCompare txOpKind = "compare"
+)
+
+// permission returns the permission needed to run an operation
+func (k txOpKind) permission() Permission {
+	if k == txOpSet || k == txOpDelete {
+		return PermWrite
+	}
+	return PermRead
+}
+
+type txOp struct {
+	kind  txOpKind
+	key   string
+	value string
+	ttl   time.Duration
+
+	// Conditions for compare operations, nil ones are not checked
+	revision *uint64
+	expected *string
+	exists   *bool
+}
+
+// txCompareError is returned when a compare operation fails and the transaction is aborted
+type txCompareError struct {
+	index int
+	key   string
+}
+
+func (e txCompareError) Error() string {
+	return fmt.Sprintf("comparison failed at operation %d (key \"%s\")", e.index, e.key)
+}
+
+// txPending is the value a key will have once the transaction is committed
+type txPending struct {
+	value   string
+	deleted bool
+}
+
+func cmdTransaction(h *Hub, client Client, msg Request) {
+	if !requireAuth(h, client, msg) {
+		return
+	}
+
+	// Check params
+	rawOps, ok := msg.Data["ops"].([]interface{})
+	if !ok {
+		sendErr(h, client, msg, ErrMissingParam, "invalid or missing 'ops' parameter")
+		return
+	}
+
+	options := h.clientOptions(client)
+	ops := make([]txOp, len(rawOps))
+	for index, rawOp := range rawOps {
+		op, err := parseTxOp(rawOp)
+		if err != nil {
+			sendErr(h, client, msg, ErrMissingParam, fmt.Sprintf("invalid operation %d: %s", index, err.Error()))
+			return
+		}
+		if !requirePermission(h, client, msg, op.kind.permission(), op.key) {
+			return
+		}
+		// Remap key if necessary
+		op.key = options.Namespace + op.key
+		ops[index] = op
+	}
+
+	results, err := h.transaction(ops, h.recordChanges(client, msg.CmdName))
+	if err != nil {
+		if compareErr, ok := err.(txCompareError); ok {
+			// Don't leak the namespace in the error
+			compareErr.key = compareErr.key[len(options.Namespace):]
+			sendErr(h, client, msg, ErrCompareFailed, compareErr.Error())
+		} else {
+			sendErr(h, client, msg, ErrServerError, err.Error())
+		}
+		return
+	}
+
+	h.logger.Debug("transaction", zap.Int64("client", client.UID()), zap.Int("operations", len(ops)))
+	client.SendJSON(Response{"response", true, msg.RequestID, results})
+}
+
+func parseTxOp(raw interface{}) (txOp, error) {
+	data, ok := raw.(map[string]interface{})
+	if !ok {
+		return txOp{}, fmt.Errorf("operation must be an object")
+	}
+
+	kind, _ := data["op"].(string)
+	op := txOp{kind: txOpKind(kind)}
+	if op.key, ok = data["key"].(string); !ok {
+		return op, fmt.Errorf("invalid or missing 'key' parameter")
+	}
+
+	switch op.kind {
+	case txOpGet, txOpDelete:
+	case txOpSet:
+		if op.value, ok = data["data"].(string); !ok {
+			return op, fmt.Errorf("invalid or missing 'data' parameter")
+		}
+		if op.ttl, ok = ttlParam(data); !ok {
+			return op, fmt.Errorf("invalid 'ttl' parameter")
+		}
+	case txOpCompare:
+		if raw, ok := data["revision"]; ok {
+			revision, ok := revisionParam(raw)
+			if !ok {
+				return op, fmt.Errorf("invalid 'revision' parameter")
+			}
+			op.revision = &revision
+		}
+		if raw, ok := data["value"]; ok {
+			expected, ok := raw.(string)
+			if !ok {
+				return op, fmt.Errorf("invalid 'value' parameter")
+			}
+			op.expected = &expected
+		}
+		if raw, ok := data["exists"]; ok {
+			exists, ok := raw.(bool)
+			if !ok {
+				return op, fmt.Errorf("invalid 'exists' parameter")
+			}
+			op.exists = &exists
+		}
+		if op.revision == nil && op.expected == nil && op.exists == nil {
+			return op, fmt.Errorf("compare needs at least one of 'revision', 'value' or 'exists'")
+		}
+	default:
+		return op, fmt.Errorf("invalid or missing 'op' parameter")
+	}
+
+	return op, nil
+}
+
+// transaction runs a list of operations atomically, returning a result for each of them
+// (a KeyValue for reads, nil for everything else). Writes are only committed and
+// subscribers only notified if every comparison succeeds. Changes are recorded in changes (for the audit log and watchers).
+func (hub *Hub) transaction(ops []txOp, changes *changeRecord) ([]interface{}, error) {
+	// Lock every key, including the ones that are only read, so nothing can change them mid-transaction
+	keys := make([]string, len(ops))
+	for index, op := range ops {
+		keys[index] = op.key
+	}
+	unlock := hub.locks.Lock(keys...)
+	defer unlock()
+
+	if hub.revisions != nil {
+		hub.revisions.mu.Lock()
+		defer hub.revisions.mu.Unlock()
+	}
+
+	results := make([]interface{}, len(ops))
+	pending := make(map[string]txPending)
+	var batch []BatchOp
+	var written, removed []string
+
+	for index, op := range ops {
+		switch op.kind {
+		case txOpGet:
+			current, _, err := hub.txRead(op.key, pending)
+			if err != nil {
+				return nil, err
+			}
+			results[index] = current
+		case txOpCompare:
+			current, uncommitted, err := hub.txRead(op.key, pending)
+			if err != nil {
+				return nil, err
+			}
+			// Keys written by this transaction don't have a revision yet, so it can't match
+			if op.revision != nil && uncommitted {
+				return nil, txCompareError{index, op.key}
+			}
+			if !txCompare(op, current) {
+				return nil, txCompareError{index, op.key}
+			}
+		case txOpSet:
+			pending[op.key] = txPending{value: op.value}
+			batch = append(batch, BatchOp{Key: op.key, Value: op.value})
+			written = append(written, op.key)
+		case txOpDelete:
+			pending[op.key] = txPending{deleted: true}
+			batch = append(batch, BatchOp{Key: op.key, Delete: true})
+			removed = append(removed, op.key)
+		}
+	}
+
+	// Read-only transaction, nothing to commit
+	if len(batch) == 0 {
+		return results, nil
+	}
+
+	for _, op := range batch {
+		changes.before(op.Key)
+	}
+	if err := hub.applyBatch(batch); err != nil {
+		return nil, err
+	}
+	if hub.revisions != nil {
+		hub.revisions.commit(written, removed)
+	}
+
+	// Update expiry and notify subscribers of the final state of every key
+	expiries := make(map[string]time.Duration)
+	for _, op := range ops {
+		switch op.kind {
+		case txOpSet:
+			expiries[op.key] = op.ttl
+		case txOpDelete:
+			expiries[op.key] = 0
+		}
+	}
+	for key, ttl := range expiries {
+		hub.setExpiry(key, ttl)
+	}
+	notified := make(map[string]bool)
+	for _, op := range batch {
+		if notified[op.Key] {
+			continue
+		}
+		notified[op.Key] = true
+		if final := pending[op.Key]; final.deleted {
+			changes.remove(op.Key)
+			hub.subscriptions.KeyChanged(op.Key, "", PushEventDelete)
+		} else {
+			changes.set(op.Key, final.value)
+			hub.subscriptions.KeyChanged(op.Key, final.value, PushEventSet)
+		}
+	}
+
+	return results, nil
+}
+
+// txRead reads a key as it would be with the transaction's pending writes applied,
+// also reporting whether the key was written by the transaction (and thus has no revision yet).
+func (hub *Hub) txRead(key string, pending map[string]txPending) (KeyValue, bool, error) {
+	if write, ok := pending[key]; ok {
+		return KeyValue{Value: write.value, Exists: !write.deleted}, true, nil
+	}
+
+	var value string
+	var revision uint64
+	var err error
+	if db, ok := hub.db.(RevisionDriver); ok {
+		value, revision, err = db.GetRevision(key)
+	} else {
+		// Revision lock is already held
+		value, revision, err = hub.revisions.current(hub.db, key)
+	}
+	if err != nil {
+		if err == ErrorKeyNotFound {
+			return KeyValue{}, false, nil
+		}
+		return KeyValue{}, false, err
+	}
+	return KeyValue{Value: value, Exists: true, Revision: revision}, false, nil
+}
+
+func txCompare(op txOp, current KeyValue) bool {
+	if op.revision != nil && current.Revision != *op.revision {
+		return false
+	}
+	if op.expected != nil && (!current.Exists || current.Value != *op.expected) {
+		return false
+	}
+	if op.exists != nil && current.Exists != *op.exists {
+		return false
+	}
+	return true
+}
+
+// applyBatch writes a batch to the driver, atomically if the driver supports it
+func (hub *Hub) applyBatch(batch []BatchOp) error {
+	if db, ok := hub.db.(TxDriver); ok {
+		return db.ApplyBatch(batch)
+	}
+
+	// Fall back to one write per operation
+	for _, op := range batch {
+		var err error
+		if op.Delete {
+			err = hub.db.Delete(op.Key)
+		} else {
+			err = hub.db.Set(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
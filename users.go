@@ -0,0 +1,229 @@
+package kv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+// User is an account clients can authenticate as
+type User struct {
+	Name string `json:"name"`
+
+	// Password used for challenge and SCRAM authentication
+	Password string `json:"password,omitempty"`
+
+	// SCRAM verifier to use instead of Password, so the server never knows the user's password.
+	// Users with only a verifier can only authenticate with SCRAM.
+	Verifier *ScramVerifier `json:"verifier,omitempty"`
+
+	// Namespace the client is moved to after authenticating, replacing the one in its options.
+	// Users with no role and no namespace stay in the namespace of their connection.
+	Namespace string `json:"namespace"`
+
+	// Role deciding the user's permissions (see HubOptions.Roles), users with no role
+	// keep the permissions of their connection
+	Role string `json:"role,omitempty"`
+}
+
+// UserStore is a list of users clients can authenticate as
+type UserStore interface {
+	// GetUser returns a user by name, or ErrUserNotFound if it doesn't exist
+	GetUser(name string) (User, error)
+}
+
+// MemoryUserStore is a UserStore that only keeps users in memory, it is safe for concurrent use
+type MemoryUserStore struct {
+	users map[string]User
+	mu    sync.RWMutex
+}
+
+// NewMemoryUserStore creates a user store with the given users
+func NewMemoryUserStore(users ...User) *MemoryUserStore {
+	store := &MemoryUserStore{
+		users: make(map[string]User),
+	}
+	for _, user := range users {
+		store.users[user.Name] = user
+	}
+	return store
+}
+
+func (s *MemoryUserStore) GetUser(name string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[name]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// SetUser adds a user, replacing any existing user with the same name
+func (s *MemoryUserStore) SetUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.Name] = user
+	return nil
+}
+
+// DeleteUser removes a user, clients already authenticated as them are not affected
+func (s *MemoryUserStore) DeleteUser(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, name)
+	return nil
+}
+
+// Users returns every user, sorted by name
+func (s *MemoryUserStore) Users() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// userFile is the format of the file used by FileUserStore
+type userFile struct {
+	Roles map[string]ACL `json:"roles,omitempty"`
+	Users []User         `json:"users"`
+}
+
+// FileUserStore is a UserStore backed by a JSON file, every change is saved to the file right away.
+//
+// The file can also define roles, see Roles.
+type FileUserStore struct {
+	*MemoryUserStore
+
+	path  string
+	roles map[string]ACL
+
+	// Serializes changes so the file always matches the last one
+	writeMu sync.Mutex
+}
+
+// OpenFileUserStore loads users from a JSON file, which is created when first saved if it doesn't exist
+func OpenFileUserStore(path string) (*FileUserStore, error) {
+	store := &FileUserStore{
+		MemoryUserStore: NewMemoryUserStore(),
+		path:            path,
+	}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload reads the file again, replacing every user in memory
+func (s *FileUserStore) Reload() error {
+	var file userFile
+	data, err := os.ReadFile(s.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// Start empty
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &file); err != nil {
+			return err
+		}
+	}
+
+	users := make(map[string]User)
+	for _, user := range file.Users {
+		users[user.Name] = user
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+	s.roles = file.Roles
+	return nil
+}
+
+// Roles returns the roles defined in the file, to be used as HubOptions.Roles
+func (s *FileUserStore) Roles() map[string]ACL {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.roles
+}
+
+// SetUser adds a user, replacing any existing user with the same name, and saves the file
+func (s *FileUserStore) SetUser(user User) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.MemoryUserStore.SetUser(user); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// DeleteUser removes a user and saves the file
+func (s *FileUserStore) DeleteUser(name string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.MemoryUserStore.DeleteUser(name); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// save writes every user to the file, replacing it atomically. Must be called with writeMu held.
+func (s *FileUserStore) save() error {
+	data, err := json.MarshalIndent(userFile{
+		Roles: s.Roles(),
+		Users: s.Users(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(s.path, data)
+}
+
+// writePrivateFile replaces a file atomically with one only readable by its owner
+func writePrivateFile(path string, data []byte) error {
+	// Temporary files are created with 0600 permissions
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// userOptions returns the namespace and ACL of a client authenticated as a user, given the options
+// of its connection. Users with no role keep the connection's ACL, and its namespace too unless they
+// have their own, so they can't get out of restrictions the server put on the connection.
+func (hub *Hub) userOptions(user User, connection ClientOptions) (namespace string, acl ACL, ok bool) {
+	if user.Role == "" {
+		namespace = user.Namespace
+		if namespace == "" {
+			namespace = connection.Namespace
+		}
+		return namespace, connection.ACL, true
+	}
+	acl, ok = hub.options.Roles[user.Role]
+	return user.Namespace, acl, ok
+}
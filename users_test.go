@@ -0,0 +1,63 @@
+package kv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	store, err := OpenFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUser(User{Name: "ash", Password: "secret", Namespace: "@ash/", Role: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUser(User{Name: "temp", Password: "temp"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUser("temp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUser("temp"); err != ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+
+	// Reopen and check that changes were saved
+	store, err = OpenFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.GetUser("ash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Password != "secret" || user.Namespace != "@ash/" || user.Role != "admin" {
+		t.Fatalf("user not saved correctly: %+v", user)
+	}
+	if _, err := store.GetUser("temp"); err != ErrUserNotFound {
+		t.Fatal("deleted user is still in the store")
+	}
+}
+
+func TestFileUserStoreRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte(`{
+		"roles": { "viewer": [{ "pattern": "overlay/*", "permissions": "read,subscribe" }] },
+		"users": [{ "name": "obs", "password": "pass", "namespace": "@obs/", "role": "viewer" }]
+	}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer := store.Roles()["viewer"]
+	if !viewer.Allows("overlay/title", PermRead|PermSubscribe) || viewer.Allows("overlay/title", PermWrite) {
+		t.Fatalf("role not loaded correctly: %+v", viewer)
+	}
+}
@@ -0,0 +1,144 @@
+package kv
+
+import (
+	"strings"
+	"sync"
+)
+
+// Change is a change made to a key, as seen by watchers
+type Change struct {
+	// Full key, namespaces are not removed
+	Key   string
+	Event PushEvent
+
+	// Value before the change, OldExists is false if the key didn't exist
+	OldValue  string
+	OldExists bool
+
+	// Value after the change, empty for deletions and expirations
+	NewValue string
+
+	// Client that made the change, nil for changes made with Hub methods like Hub.Set and for expirations
+	Client Client
+}
+
+// WatchFn is called with every change to keys a watcher is interested in
+type WatchFn func(change Change)
+
+type watcher struct {
+	prefix string
+	fn     WatchFn
+
+	// Changes waiting to be passed to fn, wake is signaled when there are some
+	queue []Change
+	wake  chan struct{}
+	stop  chan struct{}
+	mu    sync.Mutex
+}
+
+// watcherList keeps track of the watchers of a hub
+type watcherList struct {
+	watchers map[*watcher]struct{}
+	mu       sync.RWMutex
+}
+
+func newWatcherList() *watcherList {
+	return &watcherList{
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// any returns true if there's at least one watcher
+func (l *watcherList) any() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.watchers) > 0
+}
+
+// matches returns true if a watcher is interested in a key
+func (l *watcherList) matches(key string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for w := range l.watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// notify queues a change for every watcher interested in it
+func (l *watcherList) notify(change Change) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for w := range l.watchers {
+		if strings.HasPrefix(change.Key, w.prefix) {
+			w.push(change)
+		}
+	}
+}
+
+func (w *watcher) push(change Change) {
+	w.mu.Lock()
+	w.queue = append(w.queue, change)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run passes queued changes to the watcher's function until it's stopped
+func (w *watcher) run(hub *Hub) {
+	for {
+		select {
+		case <-w.wake:
+		case <-w.stop:
+			return
+		case <-hub.context.Done():
+			return
+		}
+
+		w.mu.Lock()
+		changes := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		for _, change := range changes {
+			select {
+			case <-w.stop:
+				return
+			default:
+			}
+			w.fn(change)
+		}
+	}
+}
+
+// Watch calls fn with every change to keys starting with prefix (use "" for every key),
+// made by clients, Hub methods like Hub.Set or by keys expiring, until the returned function
+// is called. Keys are not namespaced.
+//
+// Changes are passed in the order they were made, one at a time, on a goroutine of their own,
+// so fn can take its time and write keys itself.
+func (hub *Hub) Watch(prefix string, fn WatchFn) (stop func()) {
+	w := &watcher{
+		prefix: prefix,
+		fn:     fn,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	hub.watchers.mu.Lock()
+	hub.watchers.watchers[w] = struct{}{}
+	hub.watchers.mu.Unlock()
+	go w.run(hub)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			hub.watchers.mu.Lock()
+			delete(hub.watchers.watchers, w)
+			hub.watchers.mu.Unlock()
+			close(w.stop)
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package kv
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// getBulk returns the values of the requested keys that exist. Drivers written for older
+// versions fill in missing keys with empty values, so empty values are checked one by one.
+func (hub *Hub) getBulk(keys []string) (map[string]string, error) {
+	results, err := hub.db.GetBulk(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, ok := results[key]
+		if !ok {
+			continue
+		}
+		if value == "" {
+			if _, err := hub.db.Get(key); err == ErrorKeyNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		out[key] = value
+	}
+	return out, nil
+}
+
+// writeKey writes a key, and sets it to expire after ttl if it's not 0
+func (hub *Hub) writeKey(key string, value string, ttl time.Duration) error {
+	var err error
+	if hub.revisions == nil {
+		err = hub.db.Set(key, value)
+	} else {
+		err = hub.revisions.update([]string{key}, nil, func() error {
+			return hub.db.Set(key, value)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	hub.setExpiry(key, ttl)
+	return nil
+}
+
+// compareAndSet writes a key only if it's at the expected revision, returning its new revision
+func (hub *Hub) compareAndSet(key string, value string, revision uint64, ttl time.Duration) (uint64, error) {
+	newRevision, err := hub.casKey(key, value, revision)
+	if err != nil {
+		return 0, err
+	}
+
+	hub.setExpiry(key, ttl)
+	return newRevision, nil
+}
+
+// setExpiry schedules a key that was just written to expire after ttl, or clears its schedule
+// if ttl is 0. Drivers clear expiry times on writes, so they only need to be told about new ones.
+func (hub *Hub) setExpiry(key string, ttl time.Duration) {
+	if ttl <= 0 {
+		hub.expiry.Clear(key)
+		return
+	}
+
+	at := time.Now().Add(ttl)
+	if db, ok := hub.db.(ExpiryDriver); ok {
+		if err := db.SetExpiry(key, at); err != nil {
+			// Still expire it while the hub is running
+			hub.logger.Error("could not store key expiry", zap.String("key", key), zap.Error(err))
+		}
+	}
+	hub.expiry.SetAt(key, at)
+}
+
+// loadExpiries schedules the keys that had an expiry time stored by the driver
+func (hub *Hub) loadExpiries() error {
+	db, ok := hub.db.(ExpiryDriver)
+	if !ok {
+		return nil
+	}
+	expiries, err := db.Expiries()
+	if err != nil {
+		return err
+	}
+	// Keys that expired while the hub was down are removed right away
+	for key, at := range expiries {
+		hub.expiry.SetAt(key, at)
+	}
+	return nil
+}
+
+func (hub *Hub) casKey(key string, value string, revision uint64) (uint64, error) {
+	if db, ok := hub.db.(RevisionDriver); ok {
+		return db.CompareAndSet(key, value, revision)
+	}
+
+	hub.revisions.mu.Lock()
+	defer hub.revisions.mu.Unlock()
+	_, current, err := hub.revisions.current(hub.db, key)
+	if err != nil && err != ErrorKeyNotFound {
+		return 0, err
+	}
+	if current != revision {
+		return 0, ErrorRevisionMismatch
+	}
+	if err := hub.db.Set(key, value); err != nil {
+		return 0, err
+	}
+	return hub.revisions.bump(key), nil
+}
+
+// writeBulk writes multiple keys at once, clearing their expiry
+func (hub *Hub) writeBulk(kvs map[string]string) error {
+	var err error
+	if hub.revisions == nil {
+		err = hub.db.SetBulk(kvs)
+	} else {
+		keys := make([]string, 0, len(kvs))
+		for key := range kvs {
+			keys = append(keys, key)
+		}
+		err = hub.revisions.update(keys, nil, func() error {
+			return hub.db.SetBulk(kvs)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	for key := range kvs {
+		hub.expiry.Clear(key)
+	}
+	return nil
+}
+
+func (hub *Hub) removeKey(key string) error {
+	var err error
+	if hub.revisions == nil {
+		err = hub.db.Delete(key)
+	} else {
+		err = hub.revisions.update(nil, []string{key}, func() error {
+			return hub.db.Delete(key)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	hub.expiry.Clear(key)
+	return nil
+}
+
+// expireKeys removes every key whose time-to-live has elapsed and notifies subscribers
+func (hub *Hub) expireKeys() {
+	now := time.Now()
+	keys := hub.expiry.due(now)
+	if len(keys) == 0 {
+		return
+	}
+
+	// Keys might be written again before we get their locks, popDue skips those
+	unlock := hub.locks.Lock(keys...)
+	defer unlock()
+
+	changes := hub.recordChanges(nil, "")
+	for _, key := range hub.expiry.popDue(keys, now) {
+		changes.before(key)
+		if err := hub.removeKey(key); err != nil {
+			hub.logger.Error("could not remove expired key", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		changes.expire(key)
+		hub.subscriptions.KeyChanged(key, "", PushEventExpire)
+		hub.logger.Debug("key expired", zap.String("key", key))
+	}
+}